@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,26 +23,16 @@ import (
 )
 
 func main() {
-	listen := flag.String("listen", "0.0.0.0:123", "UDP listen address (host:port)")
-	stratum := flag.Int("stratum", 2, "NTP stratum (use 16 for unsynchronized)")
-	rate := flag.Float64("rate", 0, "Per-IP request rate limit (requests/sec), 0=disabled")
-	burst := flag.Int("burst", 5, "Per-IP rate limit burst")
-	flag.Parse()
+	cfg, opts, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Printf("%v", err)
+		os.Exit(1)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	srv := ntpserver.New(ntpserver.Config{
-		ListenAddr:         *listen,
-		Stratum:            uint8(*stratum),
-		RateLimitPerSecond: *rate,
-		RateLimitBurst:     *burst,
-		Hook: func(req ntpserver.Packet, meta ntpserver.RequestMeta) (dropReason string) {
-			_ = req
-			_ = meta
-			return ""
-		},
-	})
+	srv := ntpserver.New(cfg)
 
 	if err := srv.Start(ctx); err != nil {
 		log.Printf("failed to start: %v", err)
@@ -41,10 +40,29 @@ func main() {
 	}
 	defer func() { _ = srv.Stop() }()
 
-	log.Printf("%s listening on udp://%s", ntpserver.VersionInfo(), *listen)
+	for _, addr := range srv.Addrs() {
+		log.Printf("%s listening on udp://%s", ntpserver.VersionInfo(), addr)
+	}
+	if cfg.NTS != nil {
+		log.Printf("NTS-KE listening on tcp://%s", srv.NTSKEAddr())
+	}
+	if opts.metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.MetricsHandler())
+		hs := &http.Server{Addr: opts.metricsListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("metrics listener: %v", err)
+			}
+		}()
+		defer func() { _ = hs.Close() }()
+		log.Printf("metrics listening on http://%s/metrics", opts.metricsListen)
+	}
 
 	sigCh := make(chan os.Signal, 2)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
 
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
@@ -54,9 +72,299 @@ func main() {
 		case <-sigCh:
 			fmt.Println("stopping...")
 			return
+		case <-hupCh:
+			// Only settings that Reconfigure documents take effect; the rest
+			// need a restart.
+			cfg, next, err := loadConfig(os.Args[1:])
+			if err == nil {
+				err = srv.Reconfigure(cfg)
+			}
+			if err != nil {
+				log.Printf("reload failed: %v", err)
+				continue
+			}
+			if changed := restartNeeded(opts.restart, next.restart); len(changed) > 0 {
+				log.Printf("configuration reloaded; restart to apply -%s", strings.Join(changed, ", -"))
+				continue
+			}
+			log.Printf("configuration reloaded")
 		case <-ticker.C:
 			m := srv.Metrics()
-			log.Printf("requests=%d responses=%d errors=%d unique_clients=%d last_ip=%s", m.TotalRequests, m.TotalResponses, m.TotalErrors, m.UniqueClients, m.LastRequestIP)
+			log.Printf("requests=%d responses=%d errors=%d unique_clients=%d last_ip=%s processing_p99=%v rx_to_tx_p99=%v", m.TotalRequests, m.TotalResponses, m.TotalErrors, m.UniqueClients, m.LastRequestIP, m.Processing.P99, m.RxToTx.P99)
+		}
+	}
+}
+
+// options are the CLI settings that are not part of ntpserver.Config.
+type options struct {
+	metricsListen string
+	// restart holds the values of the flags a reload cannot apply.
+	restart map[string]string
+}
+
+// reloadable are the flags whose settings Reconfigure applies on SIGHUP.
+var reloadable = map[string]bool{
+	"config": true, "stratum": true, "kod": true, "control-allow": true, "restrict": true,
+	"rate": true, "burst": true, "rate-clients": true, "rate-idle": true, "rate-full": true,
+	"prefix-rate": true, "prefix-burst": true, "prefix-v4": true, "prefix-v6": true,
+	"global-rate": true, "global-burst": true,
+}
+
+// restartSettings records the flags of fs that a reload cannot apply. Flags
+// naming a file also record its contents, so a rotated certificate or key
+// file is noticed.
+func restartSettings(fs *flag.FlagSet) map[string]string {
+	out := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if reloadable[f.Name] {
+			return
+		}
+		v := f.Value.String()
+		switch f.Name {
+		case "keys", "nts-cert", "nts-key":
+			if b, err := os.ReadFile(v); err == nil {
+				v = fmt.Sprintf("%s %x", v, sha256.Sum256(b))
+			}
+		}
+		out[f.Name] = v
+	})
+	return out
+}
+
+// restartNeeded returns the sorted names of the flags that differ between
+// the running and reloaded settings.
+func restartNeeded(running, reloaded map[string]string) []string {
+	var out []string
+	for name, v := range reloaded {
+		if running[name] != v {
+			out = append(out, name)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// loadConfig builds the server configuration from the command line args
+// and, with -config, a JSON file of flag values such as
+// {"stratum": 1, "restrict": "default kod limited"}. Flags given on the
+// command line take precedence over the file.
+func loadConfig(args []string) (ntpserver.Config, options, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configFile := fs.String("config", "", "JSON file of flag values, re-read on SIGHUP")
+	listen := fs.String("listen", "0.0.0.0:123", "Comma-separated UDP listen addresses (host:port, optionally host:port@iface)")
+	iface := fs.String("interface", "", "Bind listeners to this network interface (Linux only)")
+	workers := fs.Int("workers", 1, "Goroutines answering requests per listen address")
+	reusePort := fs.Bool("reuseport", false, "Give each worker its own SO_REUSEPORT socket instead of sharing one (Linux only)")
+	batch := fs.Int("batch", 0, "Requests read and answered per system call (recvmmsg/sendmmsg, Linux only), 0=one at a time")
+	stratum := fs.Int("stratum", 2, "NTP stratum (use 16 for unsynchronized)")
+	rate := fs.Float64("rate", 0, "Per-IP request rate limit (requests/sec), 0=disabled")
+	burst := fs.Int("burst", 5, "Per-IP rate limit burst")
+	rateClients := fs.Int("rate-clients", 65536, "Maximum clients tracked by the rate limiter")
+	rateIdle := fs.Duration("rate-idle", 0, "Forget rate-limited clients idle this long, 0=once their bucket refills")
+	rateFull := fs.String("rate-full", "evict", "New client when the rate limiter table is full: evict, open or closed")
+	prefixRate := fs.Float64("prefix-rate", 0, "Per-prefix request rate limit (requests/sec), 0=disabled")
+	prefixBurst := fs.Int("prefix-burst", 0, "Per-prefix rate limit burst, 0=one second's worth")
+	prefixV4 := fs.Int("prefix-v4", 24, "IPv4 prefix length that -prefix-rate applies to")
+	prefixV6 := fs.Int("prefix-v6", 64, "IPv6 prefix length that -prefix-rate applies to")
+	globalRate := fs.Float64("global-rate", 0, "Rate limit for all requests together (requests/sec), 0=disabled")
+	globalBurst := fs.Int("global-burst", 0, "Global rate limit burst, 0=one second's worth")
+	upstreams := fs.String("upstream", "", "Comma-separated upstream NTP servers to synchronize from (host[:port])")
+	interleaved := fs.Bool("interleaved", false, "Answer interleaved-mode clients (e.g. chrony xleave) with the previous reply's actual transmit time")
+	kernelTS := fs.Bool("kernel-timestamps", false, "Use kernel/NIC receive and transmit timestamps (SO_TIMESTAMPING, Linux only)")
+	kod := fs.Bool("kod", false, "Answer rate-limited clients with a RATE Kiss-o'-Death")
+	keysFile := fs.String("keys", "", "ntpd-style ntp.keys file; enables symmetric-key authentication")
+	ntsCert := fs.String("nts-cert", "", "TLS certificate (PEM) for NTS-KE; enables NTS when set")
+	ntsKey := fs.String("nts-key", "", "TLS private key (PEM) for NTS-KE")
+	ntsListen := fs.String("nts-listen", "0.0.0.0:4460", "NTS-KE TCP listen address (host:port)")
+	peers := fs.String("peer", "", "Comma-separated symmetric active peers (host[:port])")
+	passivePeers := fs.String("passive-peers", "", "Comma-separated prefixes allowed to peer with this server in symmetric passive mode")
+	broadcast := fs.String("broadcast", "", "Comma-separated broadcast/multicast destinations for mode 5 packets")
+	broadcastInterval := fs.Duration("broadcast-interval", 64*time.Second, "Interval between broadcast packets")
+	broadcastKey := fs.Uint("broadcast-key", 0, "Key ID from -keys used to sign broadcast packets, 0=unsigned")
+	controlAllow := fs.String("control-allow", "", "Comma-separated prefixes allowed to send ntpq (mode 6) queries")
+	topClients := fs.Int("top-clients", 10, "Clients listed as top clients")
+	topError := fs.Float64("top-clients-error", 0.001, "Error bound of top client counts as a share of all requests; tracks 1/x clients")
+	topWindow := fs.Duration("top-window", 10*time.Minute, "Period covered by the recent top clients")
+	latencyReset := fs.Bool("latency-reset", false, "Clear the latency histograms after each periodic log line; scrapes never clear them")
+	logLevel := fs.String("log-level", "warn", "Structured log level: debug (every request), info (refused requests), warn or error")
+	logFormat := fs.String("log-format", "text", "Structured log format: text or json")
+	logRate := fs.Float64("log-rate", 10, "Request log lines per second, negative=unlimited")
+	metricsListen := fs.String("metrics-listen", "", "TCP address serving Prometheus metrics at /metrics, empty=disabled")
+	restrict := fs.String("restrict", "", "Semicolon-separated ntpd-style restrict rules, e.g. \"default kod limited;192.0.2.0/24 ignore\"")
+	if err := fs.Parse(args); err != nil {
+		return ntpserver.Config{}, options{}, err
+	}
+	if *configFile != "" {
+		if err := applyConfigFile(fs, *configFile); err != nil {
+			return ntpserver.Config{}, options{}, err
+		}
+		if err := fs.Parse(args); err != nil {
+			return ntpserver.Config{}, options{}, err
+		}
+	}
+
+	switch ntpserver.RateLimitFullPolicy(*rateFull) {
+	case ntpserver.RateLimitEvict, ntpserver.RateLimitFailOpen, ntpserver.RateLimitFailClosed:
+	default:
+		return ntpserver.Config{}, options{}, fmt.Errorf("invalid -rate-full %q: want evict, open or closed", *rateFull)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return ntpserver.Config{}, options{}, fmt.Errorf("invalid -log-level: %w", err)
+	}
+	var handler slog.Handler
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	default:
+		return ntpserver.Config{}, options{}, fmt.Errorf("invalid -log-format %q: want text or json", *logFormat)
+	}
+
+	controlPrefixes, err := parsePrefixes(*controlAllow)
+	if err != nil {
+		return ntpserver.Config{}, options{}, fmt.Errorf("invalid -control-allow: %w", err)
+	}
+	restrictRules, err := parseRestrictRules(*restrict)
+	if err != nil {
+		return ntpserver.Config{}, options{}, fmt.Errorf("invalid -restrict: %w", err)
+	}
+	passivePrefixes, err := parsePrefixes(*passivePeers)
+	if err != nil {
+		return ntpserver.Config{}, options{}, fmt.Errorf("invalid -passive-peers: %w", err)
+	}
+
+	var keys *ntpserver.Keyring
+	if *keysFile != "" {
+		kr, err := ntpserver.LoadKeyFile(*keysFile)
+		if err != nil {
+			return ntpserver.Config{}, options{}, fmt.Errorf("failed to load keys: %w", err)
+		}
+		keys = kr
+	}
+
+	var nts *ntpserver.NTSConfig
+	if *ntsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*ntsCert, *ntsKey)
+		if err != nil {
+			return ntpserver.Config{}, options{}, fmt.Errorf("failed to load NTS certificate: %w", err)
+		}
+		nts = &ntpserver.NTSConfig{
+			KEListenAddr: *ntsListen,
+			TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+	}
+
+	return ntpserver.Config{
+		ListenAddrs:              splitList(*listen),
+		Interface:                *iface,
+		Workers:                  *workers,
+		ReusePort:                *reusePort,
+		BatchSize:                *batch,
+		Stratum:                  uint8(*stratum),
+		RateLimitPerSecond:       *rate,
+		RateLimitBurst:           *burst,
+		RateLimitClients:         *rateClients,
+		RateLimitIdleTimeout:     *rateIdle,
+		RateLimitFull:            ntpserver.RateLimitFullPolicy(*rateFull),
+		RateLimitPrefixPerSecond: *prefixRate,
+		RateLimitPrefixBurst:     *prefixBurst,
+		RateLimitPrefixV4:        *prefixV4,
+		RateLimitPrefixV6:        *prefixV6,
+		RateLimitGlobalPerSecond: *globalRate,
+		RateLimitGlobalBurst:     *globalBurst,
+		KoD:                      *kod,
+		Interleaved:              *interleaved,
+		KernelTimestamps:         *kernelTS,
+		Upstreams:                splitList(*upstreams),
+		Peers:                    splitList(*peers),
+		PassivePeers:             passivePrefixes,
+		Keys:                     keys,
+		NTS:                      nts,
+		ControlAllow:             controlPrefixes,
+		Restrict:                 restrictRules,
+		Broadcast:                splitList(*broadcast),
+		BroadcastInterval:        *broadcastInterval,
+		BroadcastKeyID:           uint32(*broadcastKey),
+		TopClients:               *topClients,
+		TopClientsError:          *topError,
+		TopClientsWindow:         *topWindow,
+		LatencyResetOnRead:       *latencyReset,
+		Slog:                     slog.New(handler),
+		LogRequestsPerSecond:     *logRate,
+		Hook: func(req ntpserver.Packet, meta ntpserver.RequestMeta) (dropReason string) {
+			_ = req
+			_ = meta
+			return ""
+		},
+	}, options{metricsListen: *metricsListen, restart: restartSettings(fs)}, nil
+}
+
+// applyConfigFile sets the flags named in the JSON object in path.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var values map[string]any
+	if err := d.Decode(&values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, v := range values {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+		switch v.(type) {
+		case string, json.Number, bool:
+		default:
+			return fmt.Errorf("%s: %q must be a string, number or boolean", path, name)
+		}
+		if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("%s: %q: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func parsePrefixes(v string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range splitList(v) {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// parseRestrictRules parses semicolon-separated restrict rules.
+func parseRestrictRules(v string) ([]ntpserver.RestrictRule, error) {
+	var out []ntpserver.RestrictRule
+	for _, s := range strings.Split(v, ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		r, err := ntpserver.ParseRestrictRule(s)
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, r)
 	}
+	return out, nil
 }
@@ -1,3 +1,8 @@
 module github.com/marcuoli/go-ntpserver
 
 go 1.25.5
+
+require (
+	golang.org/x/net v0.47.0
+	golang.org/x/sys v0.38.0
+)
@@ -0,0 +1,142 @@
+// Package clockselect implements the RFC 5905 mitigation algorithms: the
+// per-peer clock filter and the system-wide selection, clustering and combine
+// algorithms that pick a system peer from a set of time sources.
+package clockselect
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Protocol constants from RFC 5905, appendix A.
+const (
+	// FilterStages is the number of samples kept by the clock filter.
+	FilterStages = 8
+	// MaxDispersion is the dispersion assigned to empty filter stages.
+	MaxDispersion = 16 * time.Second
+	// MinDispersion is the minimum dispersion increment.
+	MinDispersion = 5 * time.Millisecond
+	// MaxDistance is the distance threshold for a usable source.
+	MaxDistance = 1500 * time.Millisecond
+	// MaxStratum is the stratum of an unsynchronized source.
+	MaxStratum = 16
+	// MinSurvivors is the minimum number of survivors kept by clustering.
+	MinSurvivors = 3
+	// PHI is the frequency tolerance (15 PPM).
+	PHI = 15e-6
+)
+
+// Sample is a single on-wire measurement of a peer.
+type Sample struct {
+	Offset     time.Duration
+	Delay      time.Duration
+	Dispersion time.Duration
+	At         time.Time
+}
+
+// FilterResult is the output of the clock filter.
+type FilterResult struct {
+	Offset     time.Duration
+	Delay      time.Duration
+	Dispersion time.Duration
+	Jitter     time.Duration
+	At         time.Time
+}
+
+// Filter is the 8-stage clock filter of RFC 5905, section 10. The zero value
+// is ready to use. It is not safe for concurrent use.
+type Filter struct {
+	stages [FilterStages]Sample
+	valid  [FilterStages]bool
+	next   int
+	last   time.Time
+
+	// Precision is the local clock precision, used as a jitter floor.
+	Precision time.Duration
+}
+
+// Add shifts a new sample into the filter and returns the filtered values.
+// ok is false until the filter has a sample newer than the last one it
+// released, as the RFC only uses each sample once.
+func (f *Filter) Add(s Sample) (FilterResult, bool) {
+	f.stages[f.next] = s
+	f.valid[f.next] = true
+	f.next = (f.next + 1) % FilterStages
+	return f.evaluate(s.At)
+}
+
+// Reset discards all samples.
+func (f *Filter) Reset() {
+	*f = Filter{Precision: f.Precision}
+}
+
+func (f *Filter) evaluate(now time.Time) (FilterResult, bool) {
+	type stage struct {
+		Sample
+		disp time.Duration
+		ok   bool
+	}
+	var st [FilterStages]stage
+	for i := range f.stages {
+		st[i] = stage{Sample: f.stages[i], ok: f.valid[i]}
+		if !f.valid[i] {
+			st[i].Delay = MaxDispersion
+			st[i].disp = MaxDispersion
+			continue
+		}
+		// Age each sample's dispersion by PHI since it was taken.
+		age := now.Sub(f.stages[i].At)
+		if age < 0 {
+			age = 0
+		}
+		st[i].disp = f.stages[i].Dispersion + time.Duration(PHI*float64(age))
+		if st[i].disp > MaxDispersion {
+			st[i].disp = MaxDispersion
+		}
+	}
+	sort.SliceStable(st[:], func(i, j int) bool {
+		if st[i].ok != st[j].ok {
+			return st[i].ok
+		}
+		return st[i].Delay < st[j].Delay
+	})
+
+	var disp float64
+	n := 0
+	for i := FilterStages - 1; i >= 0; i-- {
+		disp = 0.5 * (disp + float64(st[i].disp))
+		if st[i].ok {
+			n++
+		}
+	}
+	if n == 0 {
+		return FilterResult{}, false
+	}
+
+	best := st[0]
+	var jit float64
+	if n > 1 {
+		for i := 1; i < n; i++ {
+			d := float64(best.Offset - st[i].Offset)
+			jit += d * d
+		}
+		jit = math.Sqrt(jit / float64(n-1))
+	}
+	if jit < float64(f.Precision) {
+		jit = float64(f.Precision)
+	}
+
+	res := FilterResult{
+		Offset:     best.Offset,
+		Delay:      best.Delay,
+		Dispersion: time.Duration(disp),
+		Jitter:     time.Duration(jit),
+		At:         best.At,
+	}
+	if !best.At.After(f.last) && !f.last.IsZero() {
+		return res, false
+	}
+	f.last = best.At
+	return res, true
+}
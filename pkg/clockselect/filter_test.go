@@ -0,0 +1,54 @@
+package clockselect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilter_PicksMinimumDelaySample(t *testing.T) {
+	var f Filter
+	t0 := time.Unix(1000, 0)
+	samples := []Sample{
+		{Offset: 5 * time.Millisecond, Delay: 40 * time.Millisecond, At: t0},
+		{Offset: 1 * time.Millisecond, Delay: 10 * time.Millisecond, At: t0.Add(time.Second)},
+		{Offset: 9 * time.Millisecond, Delay: 80 * time.Millisecond, At: t0.Add(2 * time.Second)},
+	}
+	var res FilterResult
+	for _, s := range samples {
+		res, _ = f.Add(s)
+	}
+	if res.Offset != time.Millisecond || res.Delay != 10*time.Millisecond {
+		t.Fatalf("best sample: got offset=%v delay=%v", res.Offset, res.Delay)
+	}
+	if res.Jitter <= 0 {
+		t.Fatalf("jitter: expected > 0, got=%v", res.Jitter)
+	}
+	// Five empty stages contribute most of the dispersion.
+	if res.Dispersion < MaxDispersion/16 {
+		t.Fatalf("dispersion: got=%v", res.Dispersion)
+	}
+}
+
+func TestFilter_DoesNotReuseOldSample(t *testing.T) {
+	var f Filter
+	t0 := time.Unix(1000, 0)
+	if _, ok := f.Add(Sample{Delay: 10 * time.Millisecond, At: t0}); !ok {
+		t.Fatalf("first sample should be released")
+	}
+	// A worse (higher delay) newer sample keeps the old one as the best.
+	if _, ok := f.Add(Sample{Delay: 50 * time.Millisecond, At: t0.Add(time.Second)}); ok {
+		t.Fatalf("old best sample must not be released twice")
+	}
+}
+
+func TestFilter_DispersionSumsStages(t *testing.T) {
+	var f Filter
+	t0 := time.Unix(1000, 0)
+	var res FilterResult
+	for i := 0; i < FilterStages; i++ {
+		res, _ = f.Add(Sample{Dispersion: 0, Delay: time.Duration(i+1) * time.Millisecond, At: t0})
+	}
+	if res.Dispersion != 0 {
+		t.Fatalf("dispersion of a full filter with zero dispersion: got=%v", res.Dispersion)
+	}
+}
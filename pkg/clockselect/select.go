@@ -0,0 +1,217 @@
+package clockselect
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrNoCandidates is returned when no peer passes the sanity checks.
+	ErrNoCandidates = errors.New("clockselect: no selectable peers")
+	// ErrNoMajority is returned when the truechimers are not a majority.
+	ErrNoMajority = errors.New("clockselect: no majority clique")
+)
+
+// Peer is a time source as seen by the selection algorithm. Offset, Delay,
+// Dispersion and Jitter are the clock filter outputs for the peer.
+type Peer struct {
+	ID             string
+	Stratum        uint8
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+	Offset         time.Duration
+	Delay          time.Duration
+	Dispersion     time.Duration
+	Jitter         time.Duration
+}
+
+// RootDistance is the synchronization distance to the primary reference
+// (RFC 5905, appendix A.5.5.2, root_dist).
+func (p Peer) RootDistance() time.Duration {
+	d := p.RootDelay + p.Delay
+	if d < MinDispersion {
+		d = MinDispersion
+	}
+	return d/2 + p.RootDispersion + p.Dispersion + p.Jitter
+}
+
+// Result is the outcome of Select.
+type Result struct {
+	// SystemPeer is the survivor with the best merit; its stratum and root
+	// values describe the system clock.
+	SystemPeer Peer
+	// Survivors are the peers kept by clustering, best first.
+	Survivors []Peer
+	// Falsetickers are candidates outside the intersection interval.
+	Falsetickers []Peer
+	// Offset and Jitter are the combined system offset and jitter.
+	Offset time.Duration
+	Jitter time.Duration
+}
+
+// Select runs the selection (intersection), cluster and combine algorithms
+// over peers and returns the system peer and combined offset.
+func Select(peers []Peer) (Result, error) {
+	var cands []Peer
+	for _, p := range peers {
+		if p.Stratum == 0 || p.Stratum >= MaxStratum || p.RootDistance() > MaxDistance {
+			continue
+		}
+		cands = append(cands, p)
+	}
+	if len(cands) == 0 {
+		return Result{}, ErrNoCandidates
+	}
+
+	truechimers, falsetickers, err := intersect(cands)
+	if err != nil {
+		return Result{Falsetickers: falsetickers}, err
+	}
+	survivors := cluster(truechimers)
+	offset, jitter := combine(survivors)
+	return Result{
+		SystemPeer:   survivors[0],
+		Survivors:    survivors,
+		Falsetickers: falsetickers,
+		Offset:       offset,
+		Jitter:       jitter,
+	}, nil
+}
+
+// intersect is the Marzullo-style selection algorithm of RFC 5905,
+// section 11.2.1: find the smallest interval containing points from the
+// largest number of correctness intervals, allowing up to half of the
+// candidates to be falsetickers.
+func intersect(cands []Peer) (truechimers, falsetickers []Peer, err error) {
+	type edge struct {
+		val time.Duration
+		typ int // -1 lower endpoint, 0 midpoint, +1 upper endpoint
+	}
+	n := len(cands)
+	edges := make([]edge, 0, 3*n)
+	for _, p := range cands {
+		d := p.RootDistance()
+		edges = append(edges,
+			edge{p.Offset - d, -1},
+			edge{p.Offset, 0},
+			edge{p.Offset + d, +1},
+		)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].val == edges[j].val {
+			return edges[i].typ < edges[j].typ
+		}
+		return edges[i].val < edges[j].val
+	})
+
+	var low, high time.Duration
+	allow := 0
+	for ; 2*allow < n; allow++ {
+		found, chime := 0, 0
+		for _, e := range edges {
+			chime -= e.typ
+			if chime >= n-allow {
+				low = e.val
+				break
+			}
+			if e.typ == 0 {
+				found++
+			}
+		}
+		chime = 0
+		for i := len(edges) - 1; i >= 0; i-- {
+			e := edges[i]
+			chime += e.typ
+			if chime >= n-allow {
+				high = e.val
+				break
+			}
+			if e.typ == 0 {
+				found++
+			}
+		}
+		if found > allow {
+			continue
+		}
+		if high > low {
+			break
+		}
+	}
+	if 2*allow >= n {
+		return nil, cands, ErrNoMajority
+	}
+
+	for _, p := range cands {
+		if p.Offset < low || p.Offset > high {
+			falsetickers = append(falsetickers, p)
+			continue
+		}
+		truechimers = append(truechimers, p)
+	}
+	if len(truechimers) == 0 {
+		return nil, falsetickers, ErrNoMajority
+	}
+	return truechimers, falsetickers, nil
+}
+
+// merit orders survivors: lower stratum first, then lower root distance.
+func merit(p Peer) time.Duration {
+	return time.Duration(p.Stratum)*MaxDistance + p.RootDistance()
+}
+
+// cluster is the clustering algorithm of RFC 5905, section 11.2.2: it
+// repeatedly discards the outlier with the largest selection jitter until
+// that jitter is below the smallest peer jitter or MinSurvivors remain.
+func cluster(truechimers []Peer) []Peer {
+	s := append([]Peer(nil), truechimers...)
+	sort.SliceStable(s, func(i, j int) bool { return merit(s[i]) < merit(s[j]) })
+
+	for len(s) > MinSurvivors {
+		maxSel, maxIdx := -1.0, 0
+		minPeer := math.MaxFloat64
+		for i, p := range s {
+			var sum float64
+			for _, q := range s {
+				d := float64(p.Offset - q.Offset)
+				sum += d * d
+			}
+			sel := math.Sqrt(sum / float64(len(s)-1))
+			if sel > maxSel {
+				maxSel, maxIdx = sel, i
+			}
+			if j := float64(p.Jitter); j < minPeer {
+				minPeer = j
+			}
+		}
+		if maxSel <= minPeer {
+			break
+		}
+		s = append(s[:maxIdx], s[maxIdx+1:]...)
+	}
+	return s
+}
+
+// combine computes the weighted average offset of the survivors, weighted by
+// the reciprocal root distance, and the system jitter (RFC 5905, section 11.2.3).
+func combine(survivors []Peer) (offset, jitter time.Duration) {
+	var y, z float64
+	for _, p := range survivors {
+		x := 1 / float64(p.RootDistance())
+		y += x
+		z += x * float64(p.Offset)
+	}
+	off := z / y
+
+	sys := survivors[0]
+	var w float64
+	for _, p := range survivors {
+		x := 1 / float64(p.RootDistance())
+		d := float64(p.Offset - sys.Offset)
+		w += x * d * d
+	}
+	selJitter := math.Sqrt(w / y)
+	peerJitter := float64(sys.Jitter)
+	return time.Duration(off), time.Duration(math.Sqrt(selJitter*selJitter + peerJitter*peerJitter))
+}
@@ -0,0 +1,80 @@
+package clockselect
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func peer(id string, stratum uint8, offset time.Duration) Peer {
+	return Peer{
+		ID:         id,
+		Stratum:    stratum,
+		Offset:     offset,
+		Delay:      10 * time.Millisecond,
+		Dispersion: time.Millisecond,
+		Jitter:     100 * time.Microsecond,
+	}
+}
+
+func TestSelect_DiscardsFalseticker(t *testing.T) {
+	peers := []Peer{
+		peer("a", 1, 1*time.Millisecond),
+		peer("b", 2, 2*time.Millisecond),
+		peer("c", 2, 0),
+		peer("bad", 1, 500*time.Millisecond),
+	}
+	res, err := Select(peers)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if len(res.Falsetickers) != 1 || res.Falsetickers[0].ID != "bad" {
+		t.Fatalf("falsetickers: %+v", res.Falsetickers)
+	}
+	if res.SystemPeer.ID != "a" {
+		t.Fatalf("system peer: got=%q want=%q", res.SystemPeer.ID, "a")
+	}
+	if res.Offset < 0 || res.Offset > 2*time.Millisecond {
+		t.Fatalf("combined offset out of survivor range: %v", res.Offset)
+	}
+	if res.Jitter <= 0 {
+		t.Fatalf("jitter: expected > 0")
+	}
+}
+
+func TestSelect_NoMajority(t *testing.T) {
+	peers := []Peer{
+		peer("a", 1, 0),
+		peer("b", 1, 800*time.Millisecond),
+	}
+	if _, err := Select(peers); !errors.Is(err, ErrNoMajority) {
+		t.Fatalf("expected ErrNoMajority, got=%v", err)
+	}
+}
+
+func TestSelect_SkipsUnsynchronizedAndDistant(t *testing.T) {
+	far := peer("far", 1, 0)
+	far.RootDispersion = 2 * time.Second
+	peers := []Peer{peer("unsync", MaxStratum, 0), far}
+	if _, err := Select(peers); !errors.Is(err, ErrNoCandidates) {
+		t.Fatalf("expected ErrNoCandidates, got=%v", err)
+	}
+}
+
+func TestCluster_PrunesOutlierAboveMinimum(t *testing.T) {
+	peers := []Peer{
+		peer("a", 1, 0),
+		peer("b", 1, 100*time.Microsecond),
+		peer("c", 1, 200*time.Microsecond),
+		peer("d", 1, 20*time.Millisecond),
+	}
+	s := cluster(peers)
+	if len(s) != MinSurvivors {
+		t.Fatalf("survivors: got=%d want=%d", len(s), MinSurvivors)
+	}
+	for _, p := range s {
+		if p.ID == "d" {
+			t.Fatalf("outlier survived clustering")
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package ntpserver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+var errSIVOpen = errors.New("ntpserver: message authentication failed")
+
+// cmac implements AES-CMAC (RFC 4493).
+type cmac struct {
+	block  cipher.Block
+	k1, k2 [aes.BlockSize]byte
+}
+
+func newCMAC(key []byte) (*cmac, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	c := &cmac{block: block}
+	var l [aes.BlockSize]byte
+	block.Encrypt(l[:], l[:])
+	c.k1 = dbl(l)
+	c.k2 = dbl(c.k1)
+	return c, nil
+}
+
+// dbl multiplies a block by x in GF(2^128).
+func dbl(b [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var out [aes.BlockSize]byte
+	carry := b[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+	out[aes.BlockSize-1] = b[aes.BlockSize-1] << 1
+	if carry != 0 {
+		out[aes.BlockSize-1] ^= 0x87
+	}
+	return out
+}
+
+func (c *cmac) sum(msg []byte) [aes.BlockSize]byte {
+	var x [aes.BlockSize]byte
+	n := len(msg)
+	for n > aes.BlockSize {
+		subtle.XORBytes(x[:], x[:], msg[:aes.BlockSize])
+		c.block.Encrypt(x[:], x[:])
+		msg = msg[aes.BlockSize:]
+		n -= aes.BlockSize
+	}
+	var last [aes.BlockSize]byte
+	copy(last[:], msg)
+	if n == aes.BlockSize {
+		subtle.XORBytes(last[:], last[:], c.k1[:])
+	} else {
+		last[n] = 0x80
+		subtle.XORBytes(last[:], last[:], c.k2[:])
+	}
+	subtle.XORBytes(x[:], x[:], last[:])
+	c.block.Encrypt(x[:], x[:])
+	return x
+}
+
+// aesSIV implements AEAD_AES_SIV_CMAC_256/384/512 (RFC 5297). The nonce,
+// when not nil, is passed to S2V as the last associated data component,
+// as described in RFC 5297, section 3.
+type aesSIV struct {
+	mac *cmac
+	ctr cipher.Block
+}
+
+func newAESSIV(key []byte) (*aesSIV, error) {
+	switch len(key) {
+	case 32, 48, 64:
+	default:
+		return nil, aes.KeySizeError(len(key))
+	}
+	half := len(key) / 2
+	mac, err := newCMAC(key[:half])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[half:])
+	if err != nil {
+		return nil, err
+	}
+	return &aesSIV{mac: mac, ctr: ctr}, nil
+}
+
+func (a *aesSIV) NonceSize() int { return 16 }
+func (a *aesSIV) Overhead() int  { return aes.BlockSize }
+
+// s2v computes the synthetic IV over the associated data components ad, in
+// order, and the plaintext.
+func (a *aesSIV) s2v(plaintext []byte, ad ...[]byte) [aes.BlockSize]byte {
+	var zero [aes.BlockSize]byte
+	d := a.mac.sum(zero[:])
+	for _, s := range ad {
+		d = dbl(d)
+		m := a.mac.sum(s)
+		subtle.XORBytes(d[:], d[:], m[:])
+	}
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		tail := t[len(t)-aes.BlockSize:]
+		subtle.XORBytes(tail, tail, d[:])
+	} else {
+		d = dbl(d)
+		var pad [aes.BlockSize]byte
+		copy(pad[:], plaintext)
+		pad[len(plaintext)] = 0x80
+		subtle.XORBytes(d[:], d[:], pad[:])
+		t = d[:]
+	}
+	return a.mac.sum(t)
+}
+
+func (a *aesSIV) xorStream(dst, src []byte, v [aes.BlockSize]byte) {
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(a.ctr, v[:]).XORKeyStream(dst, src)
+}
+
+// Seal appends the synthetic IV and ciphertext to dst. A nil nonce is
+// omitted from S2V entirely (deterministic mode).
+func (a *aesSIV) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	if nonce == nil {
+		return a.seal(dst, plaintext, ad)
+	}
+	return a.seal(dst, plaintext, ad, nonce)
+}
+
+// Open authenticates and decrypts ciphertext, appending the plaintext to dst.
+func (a *aesSIV) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	if nonce == nil {
+		return a.open(dst, ciphertext, ad)
+	}
+	return a.open(dst, ciphertext, ad, nonce)
+}
+
+// seal is Seal with the S2V components given in order; a nonce is the last.
+func (a *aesSIV) seal(dst, plaintext []byte, ad ...[]byte) []byte {
+	v := a.s2v(plaintext, ad...)
+	out := append(dst, v[:]...)
+	start := len(out)
+	out = append(out, plaintext...)
+	a.xorStream(out[start:], out[start:], v)
+	return out
+}
+
+// open is Open with the S2V components given in order; a nonce is the last.
+func (a *aesSIV) open(dst, ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errSIVOpen
+	}
+	var v [aes.BlockSize]byte
+	copy(v[:], ciphertext[:aes.BlockSize])
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+	a.xorStream(plaintext, ciphertext[aes.BlockSize:], v)
+	want := a.s2v(plaintext, ad...)
+	if subtle.ConstantTimeCompare(want[:], v[:]) != 1 {
+		return nil, errSIVOpen
+	}
+	return append(dst, plaintext...), nil
+}
@@ -0,0 +1,100 @@
+package ntpserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode %q: %v", s, err)
+	}
+	return b
+}
+
+func TestCMAC_RFC4493Vectors(t *testing.T) {
+	c, err := newCMAC(mustHex(t, "2b7e151628aed2a6abf7158809cf4f3c"))
+	if err != nil {
+		t.Fatalf("newCMAC: %v", err)
+	}
+	cases := []struct{ msg, mac string }{
+		{"", "bb1d6929e95937287fa37d129b756746"},
+		{"6bc1bee22e409f96e93d7e117393172a", "070a16b46b4d4144f79bdd9dd04a287c"},
+		{"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411", "dfa66747de9ae63030ca32611497c827"},
+	}
+	for _, tc := range cases {
+		got := c.sum(mustHex(t, tc.msg))
+		if hex.EncodeToString(got[:]) != tc.mac {
+			t.Fatalf("cmac(%s): got=%x want=%s", tc.msg, got, tc.mac)
+		}
+	}
+}
+
+func TestAESSIV_RFC5297DeterministicVector(t *testing.T) {
+	a, err := newAESSIV(mustHex(t, "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"))
+	if err != nil {
+		t.Fatalf("newAESSIV: %v", err)
+	}
+	ad := mustHex(t, "101112131415161718191a1b1c1d1e1f2021222324252627")
+	pt := mustHex(t, "112233445566778899aabbccddee")
+	want := mustHex(t, "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c")
+
+	ct := a.Seal(nil, nil, pt, ad)
+	if !bytes.Equal(ct, want) {
+		t.Fatalf("seal: got=%x want=%x", ct, want)
+	}
+	got, err := a.Open(nil, nil, ct, ad)
+	if err != nil || !bytes.Equal(got, pt) {
+		t.Fatalf("open: got=%x err=%v", got, err)
+	}
+}
+
+// TestAESSIV_RFC5297NonceVector is the nonce-based example of RFC 5297,
+// appendix A.2, which has two associated data components before the nonce.
+func TestAESSIV_RFC5297NonceVector(t *testing.T) {
+	a, err := newAESSIV(mustHex(t, "7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f"))
+	if err != nil {
+		t.Fatalf("newAESSIV: %v", err)
+	}
+	ad1 := mustHex(t, "00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100")
+	ad2 := mustHex(t, "102030405060708090a0")
+	nonce := mustHex(t, "09f911029d74e35bd84156c5635688c0")
+	pt := mustHex(t, "7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553")
+	want := mustHex(t, "7bdb6e3b432667eb06f4d14bff2fbd0fcb900f2fddbe404326601965c889bf17dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d")
+
+	ct := a.seal(nil, pt, ad1, ad2, nonce)
+	if !bytes.Equal(ct, want) {
+		t.Fatalf("seal: got=%x want=%x", ct, want)
+	}
+	got, err := a.open(nil, ct, ad1, ad2, nonce)
+	if err != nil || !bytes.Equal(got, pt) {
+		t.Fatalf("open: got=%x err=%v", got, err)
+	}
+	if _, err := a.open(nil, ct, ad1, ad2); err == nil {
+		t.Fatalf("expected failure without the nonce")
+	}
+}
+
+func TestAESSIV_NonceRoundTripAndTamper(t *testing.T) {
+	a, err := newAESSIV(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("newAESSIV: %v", err)
+	}
+	nonce := bytes.Repeat([]byte{1}, 16)
+	ad := []byte("header")
+	ct := a.Seal(nil, nonce, []byte("some plaintext longer than a block"), ad)
+
+	if _, err := a.Open(nil, nonce, ct, ad); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := a.Open(nil, nonce, ct, []byte("other")); err == nil {
+		t.Fatalf("expected failure with different associated data")
+	}
+	ct[len(ct)-1] ^= 1
+	if _, err := a.Open(nil, nonce, ct, ad); err == nil {
+		t.Fatalf("expected failure with modified ciphertext")
+	}
+}
@@ -0,0 +1,157 @@
+package ntpserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPacket_MarshalTo(t *testing.T) {
+	p := Packet{VN: 4, Mode: ModeServer, Stratum: 2, RefID: 0x7f000001, Transmit: 0x0102030405060708}
+	buf := make([]byte, maxDatagramSize)
+	n, err := p.MarshalTo(buf)
+	if err != nil || n != p.Len() {
+		t.Fatalf("MarshalTo: n=%d err=%v want n=%d", n, err, p.Len())
+	}
+	if string(buf[:n]) != string(p.Marshal()) {
+		t.Fatalf("MarshalTo and Marshal differ")
+	}
+	if _, err := p.MarshalTo(buf[:n-1]); !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatalf("short buffer: got=%v want=%v", err, io.ErrShortBuffer)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { _, _ = p.MarshalTo(buf) }); allocs != 0 {
+		t.Fatalf("MarshalTo allocs: got=%v want=0", allocs)
+	}
+}
+
+func TestServer_HandlePacketNoAllocs(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := New(Config{Clock: fixedClock{t: now}, RateLimitPerSecond: 1e9, RateLimitBurst: 1e9, HistorySize: 8})
+	w := testWorker()
+	rw := &fakeWriter{countOnly: true}
+	from := remote{ap: netip.MustParseAddrPort("192.0.2.7:40123")}
+	b := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}).Marshal()
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		ev := srv.handlePacket(w, rw, b, from, now, TimestampUser)
+		srv.hub.publish(ev)
+	})
+	if allocs != 0 {
+		t.Fatalf("allocs per request: got=%v want=0", allocs)
+	}
+	if rw.n == 0 {
+		t.Fatalf("no replies written")
+	}
+	hist := srv.History()
+	if len(hist) != 8 || hist[7].ClientIP != "192.0.2.7" || hist[7].ClientPort != 40123 || !hist[7].Responded {
+		t.Fatalf("history: len=%d last=%+v", len(hist), hist[len(hist)-1])
+	}
+}
+
+// TestServer_ServeLoopNoAllocs measures a whole request/response exchange on
+// loopback, client included.
+func TestServer_ServeLoopNoAllocs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("loopback exchange")
+	}
+	if allocs := loopbackAllocs(t, Config{}, 1); allocs != 0 {
+		t.Fatalf("allocs per exchange: got=%v want=0", allocs)
+	}
+}
+
+// readBatchAddrAllocs is what x/net's ReadBatch allocates per message for
+// its source address: the *net.UDPAddr and its IP.
+const readBatchAddrAllocs = 2
+
+// TestServer_ServeBatchAllocs is TestServer_ServeLoopNoAllocs for the
+// recvmmsg/sendmmsg loop, with several requests in flight per batch. x/net's
+// ReadBatch allocates the source address of every message it reads; nothing
+// else may allocate.
+func TestServer_ServeBatchAllocs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("loopback exchange")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("no batched reads on this platform")
+	}
+	if raceEnabled {
+		t.Skip("sync.Pool drops buffers under the race detector")
+	}
+	const batch = 8
+	if allocs := loopbackAllocs(t, Config{}, batch); allocs > batch*readBatchAddrAllocs {
+		t.Fatalf("allocs per exchange: got=%v want<=%d", allocs, batch*readBatchAddrAllocs)
+	}
+}
+
+// loopbackAllocs serves on loopback with cfg and returns the allocations per
+// exchange of batch requests and replies. Each request echoes the receive
+// timestamp of the last reply, as an interleaved-mode client does.
+func loopbackAllocs(t *testing.T, cfg Config, batch int) float64 {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg.ListenAddr, cfg.Network, cfg.HistorySize = "127.0.0.1:0", "udp4", 8
+	if batch > 1 {
+		cfg.BatchSize = batch
+	}
+	srv := New(cfg)
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	c, err := net.Dial("udp4", srv.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	req := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}).Marshal()
+	resp := make([]byte, maxDatagramSize)
+	exchange := func() {
+		for i := 0; i < batch; i++ {
+			if _, err := c.Write(req); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		for i := 0; i < batch; i++ {
+			if _, err := c.Read(resp); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+		}
+		copy(req[24:32], resp[32:40])
+	}
+	if err := c.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatalf("deadline: %v", err)
+	}
+	exchange()
+
+	// Averaged over many exchanges, occasional runtime allocations (timers,
+	// the periodic read deadline) round down to zero.
+	return testing.AllocsPerRun(1000, exchange)
+}
+
+func BenchmarkPacket_MarshalTo(b *testing.B) {
+	p := Packet{VN: 4, Mode: ModeServer, Stratum: 2, Transmit: 0x0102030405060708}
+	buf := make([]byte, maxDatagramSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = p.MarshalTo(buf)
+	}
+}
+
+func BenchmarkServer_HandlePacket(b *testing.B) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := New(Config{Clock: fixedClock{t: now}, HistorySize: 64})
+	w := testWorker()
+	rw := &fakeWriter{countOnly: true}
+	from := remote{ap: netip.MustParseAddrPort("192.0.2.7:40123")}
+	req := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}).Marshal()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		srv.hub.publish(srv.handlePacket(w, rw, req, from, now, TimestampUser))
+	}
+}
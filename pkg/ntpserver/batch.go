@@ -0,0 +1,199 @@
+package ntpserver
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// batchConn reads and writes several datagrams per system call. ipv4 and
+// ipv6 messages are the same type, so this covers both packet conns.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchWriter queues replies and sends them with one WriteBatch per flush.
+// Queued buffers are sent as they are, so they must not be reused before
+// the flush.
+type batchWriter struct {
+	bc      batchConn
+	msgs    []ipv4.Message
+	owners  []int // index of the request each message answers
+	buffers []*[]byte
+	cur     int // index of the request being handled
+
+	// after holds the interleaved replies to pass to sent once flushed, with
+	// the request each answers in afterOwners; failed collects the requests
+	// whose reply could not be sent.
+	after       []sentReply
+	afterOwners []int
+	failed      []int
+	sent        func(sentReply)
+
+	addrs []*net.UDPAddr // reused for replies to remotes without a net.Addr
+}
+
+// writeTo queues p. The message slots, their buffer lists and, for a
+// remote that is not already a net.Addr, their addresses are reused from
+// earlier flushes, so queueing a reply does not allocate.
+func (b *batchWriter) writeTo(p []byte, to remote) error {
+	i := len(b.msgs)
+	if i < cap(b.msgs) {
+		b.msgs = b.msgs[:i+1]
+	} else {
+		b.msgs = append(b.msgs, ipv4.Message{})
+	}
+	m := &b.msgs[i]
+	if cap(m.Buffers) == 0 {
+		m.Buffers = make([][]byte, 1)
+	}
+	m.Buffers = m.Buffers[:1]
+	m.Buffers[0] = p
+	m.Addr = to.addr
+	if m.Addr == nil {
+		m.Addr = b.udpAddr(i, to.ap)
+	}
+	b.owners = append(b.owners, b.cur)
+	return nil
+}
+
+// udpAddr returns slot i of b.addrs set to ap.
+func (b *batchWriter) udpAddr(i int, ap netip.AddrPort) *net.UDPAddr {
+	for len(b.addrs) <= i {
+		b.addrs = append(b.addrs, &net.UDPAddr{IP: make(net.IP, 0, net.IPv6len)})
+	}
+	a, ip := b.addrs[i], ap.Addr()
+	if ip.Is4() {
+		v4 := ip.As4()
+		a.IP = append(a.IP[:0], v4[:]...)
+	} else {
+		v6 := ip.As16()
+		a.IP = append(a.IP[:0], v6[:]...)
+	}
+	a.Port, a.Zone = int(ap.Port()), ip.Zone()
+	return a
+}
+
+func (b *batchWriter) afterSend(r sentReply) {
+	b.after = append(b.after, r)
+	b.afterOwners = append(b.afterOwners, b.cur)
+}
+
+func (b *batchWriter) recycle(bp *[]byte) { b.buffers = append(b.buffers, bp) }
+
+// flush sends the queued replies and calls failed for each one that could
+// not be sent. The sent replies queued with afterSend are then recorded.
+func (b *batchWriter) flush(failed func(owner int, err error)) {
+	msgs, owners := b.msgs, b.owners
+	for len(msgs) > 0 {
+		n, err := b.bc.WriteBatch(msgs, 0)
+		if err != nil {
+			// sendmmsg fails only on the first unsent message; skip it.
+			// WriteBatch reports that as n = -1 when nothing was sent.
+			n = max(n, 0)
+			failed(owners[n], err)
+			b.failed = append(b.failed, owners[n])
+			n++
+		}
+		msgs, owners = msgs[n:], owners[n:]
+	}
+	for i, r := range b.after {
+		if !slices.Contains(b.failed, b.afterOwners[i]) {
+			b.sent(r)
+		}
+	}
+	for _, bp := range b.buffers {
+		replyBufs.Put(bp)
+	}
+	for i := range b.msgs {
+		// Keep each message's buffer list for the next flush.
+		m := &b.msgs[i]
+		clear(m.Buffers)
+		*m = ipv4.Message{Buffers: m.Buffers[:0]}
+	}
+	clear(b.after)
+	clear(b.buffers)
+	b.msgs, b.owners, b.buffers = b.msgs[:0], b.owners[:0], b.buffers[:0]
+	b.after, b.afterOwners, b.failed = b.after[:0], b.afterOwners[:0], b.failed[:0]
+}
+
+// serveBatch is serveLoop for Config.BatchSize > 1: it reads up to BatchSize
+// requests per system call, answers them all with one batched write and then
+// publishes their events. Each request is stamped with its kernel receive
+// timestamp, which setup enabled for the socket.
+func (s *Server) serveBatch(w *worker, bc batchConn, kernelTS bool, stop chan struct{}) error {
+	l := w.l
+	ms := make([]ipv4.Message, s.cfg.BatchSize)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, maxDatagramSize)}
+		ms[i].OOB = make([]byte, timestampOOBSize)
+	}
+	bw := &batchWriter{bc: bc, sent: s.storeSent}
+	events := make([]RequestEvent, 0, len(ms))
+	took := make([]time.Duration, 0, len(ms))
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		_ = l.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := bc.ReadBatch(ms, 0)
+		if err != nil {
+			if s.readTimeout(err, l, kernelTS) {
+				continue
+			}
+			return s.readError(err, stop)
+		}
+
+		readAt := s.cfg.Clock.Now()
+		for i := range ms[:n] {
+			m := &ms[i]
+			// The kernel starts stamping shortly after the socket option is
+			// set; until then the read time stands in, reported as "user".
+			receivedAt, rxSource := readAt, TimestampUser
+			if at, src, ok := parseKernelTimestamp(m.OOB[:m.NN]); ok {
+				receivedAt, rxSource = at, src
+			}
+			bw.cur = i
+			start := time.Now()
+			events = append(events, s.handlePacket(w, bw, m.Buffers[0][:m.N], remoteOf(m.Addr), receivedAt, rxSource))
+			took = append(took, time.Since(start))
+		}
+		bw.flush(func(i int, err error) { s.sendFailed(&events[i], err) })
+		for i, ev := range events {
+			s.observeLatency(&ev, took[i])
+			s.logRequest(&ev, took[i])
+			w.count(ev)
+			s.hub.publish(ev)
+		}
+		clear(events)
+		events, took = events[:0], took[:0]
+	}
+}
+
+// sendFailed records that the reply queued for ev could not be sent,
+// taking back the response handlePacket counted when it was queued.
+func (s *Server) sendFailed(ev *RequestEvent, err error) {
+	if !ev.Responded {
+		return
+	}
+	if !ev.countsAsResponse() {
+		// A refusal or peer reply, counted under its own error only.
+		if ev.Kiss != "" {
+			s.metrics.uncountKoD()
+			ev.Kiss = ""
+		}
+		ev.Responded = false
+		return
+	}
+	s.metrics.uncountResponse()
+	ev.Responded = false
+	ev.Error = err.Error()
+	s.metrics.incError("write_failed")
+}
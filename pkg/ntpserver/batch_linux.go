@@ -0,0 +1,23 @@
+//go:build linux
+
+package ntpserver
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// newBatchConn wraps conn for recvmmsg/sendmmsg, or returns nil if conn is
+// not a UDP socket.
+func newBatchConn(conn net.PacketConn) batchConn {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	if a, ok := uc.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() != nil {
+		return ipv4.NewPacketConn(uc)
+	}
+	return ipv6.NewPacketConn(uc)
+}
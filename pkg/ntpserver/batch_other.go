@@ -0,0 +1,11 @@
+//go:build !linux
+
+package ntpserver
+
+import "net"
+
+// newBatchConn returns nil: outside Linux x/net reads one message per
+// batch, so the plain serve loop is used instead.
+func newBatchConn(conn net.PacketConn) batchConn {
+	return nil
+}
@@ -0,0 +1,268 @@
+package ntpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestServer_BatchedReplies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", BatchSize: 16, Interleaved: true})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	c := dialServer(t, srv)
+	defer c.Close()
+	const n = 50
+	want := make(map[Timestamp]bool)
+	for i := 0; i < n; i++ {
+		req := Packet{VN: 4, Mode: ModeClient, Transmit: Timestamp(i + 1)}
+		want[req.Transmit] = true
+		if _, err := c.Write(req.Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		resp, ok := readPacket(t, c, 2*time.Second)
+		if !ok {
+			t.Fatalf("got %d of %d responses", i, n)
+		}
+		if !want[resp.Originate] {
+			t.Fatalf("unexpected or repeated origin %x", resp.Originate)
+		}
+		delete(want, resp.Originate)
+	}
+	for i := 0; i < n; i++ {
+		if ev := waitForEvent(t, events, ModeClient); !ev.Responded || ev.Error != "" {
+			t.Fatalf("event %d: %+v", i, ev)
+		}
+	}
+	if m := srv.Metrics(); m.TotalResponses != n {
+		t.Fatalf("responses: got=%d want=%d", m.TotalResponses, n)
+	}
+	// Interleaved state is recorded once the batch has been sent.
+	if srv.il.len() != 1 {
+		t.Fatalf("interleave entries: got=%d want=1", srv.il.len())
+	}
+}
+
+// failingBatchConn fails the message at index fail like sendmmsg: the
+// messages before it are sent by one call, and the next call returns -1 and
+// the error.
+type failingBatchConn struct {
+	fail   int
+	sent   int
+	failed bool
+}
+
+func (c *failingBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (c *failingBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	if !c.failed && c.fail < c.sent+len(ms) {
+		if c.fail == c.sent {
+			c.failed = true
+			return -1, errors.New("send failed")
+		}
+		n := c.fail - c.sent
+		c.sent += n
+		return n, nil
+	}
+	c.sent += len(ms)
+	return len(ms), nil
+}
+
+func TestBatchWriter_FlushSkipsFailedMessage(t *testing.T) {
+	bc := &failingBatchConn{fail: 2}
+	var stored []Timestamp
+	bw := &batchWriter{bc: bc, sent: func(r sentReply) { stored = append(stored, r.rx) }}
+	for i := 0; i < 5; i++ {
+		bw.cur = i
+		_ = bw.writeTo([]byte{byte(i)}, remote{})
+		bw.afterSend(sentReply{rx: Timestamp(i)})
+	}
+
+	var failed []int
+	bw.flush(func(owner int, err error) { failed = append(failed, owner) })
+	if len(failed) != 1 || failed[0] != 2 {
+		t.Fatalf("failed owners: got=%v want=[2]", failed)
+	}
+	// The reply that was not sent must not be stored as sent.
+	if want := []Timestamp{0, 1, 3, 4}; bc.sent != 4 || !slices.Equal(stored, want) {
+		t.Fatalf("sent=%d stored=%v want=%v", bc.sent, stored, want)
+	}
+	if len(bw.msgs) != 0 || len(bw.after) != 0 || len(bw.failed) != 0 {
+		t.Fatalf("writer not reset after flush")
+	}
+}
+
+func TestBatchWriter_FlushFirstMessageFails(t *testing.T) {
+	bc := &failingBatchConn{fail: 0}
+	bw := &batchWriter{bc: bc}
+	for i := 0; i < 3; i++ {
+		bw.cur = i
+		_ = bw.writeTo([]byte{byte(i)}, remote{})
+	}
+	var failed []int
+	bw.flush(func(owner int, err error) { failed = append(failed, owner) })
+	if len(failed) != 1 || failed[0] != 0 || bc.sent != 2 {
+		t.Fatalf("failed owners=%v sent=%d", failed, bc.sent)
+	}
+}
+
+// scriptedBatchConn returns reqs from the first ReadBatch, then closes stop
+// and fails the next read. Every WriteBatch fails.
+type scriptedBatchConn struct {
+	reqs []ipv4.Message
+	stop chan struct{}
+}
+
+func (c *scriptedBatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	if c.reqs == nil {
+		close(c.stop)
+		return 0, errors.New("closed")
+	}
+	n := 0
+	for ; n < len(c.reqs); n++ {
+		ms[n].N = copy(ms[n].Buffers[0], c.reqs[n].Buffers[0])
+		ms[n].Addr = c.reqs[n].Addr
+	}
+	c.reqs = nil
+	return n, nil
+}
+
+func (c *scriptedBatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	return -1, errors.New("send failed")
+}
+
+func TestServer_ServeBatchWriteFails(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := New(Config{Clock: fixedClock{t: now}, BatchSize: 4, RateLimitPerSecond: 0.001, RateLimitBurst: 1, KoD: true})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	// The second request is rate limited and answered with a kiss.
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: 1}.Marshal()
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	bc := &scriptedBatchConn{stop: make(chan struct{})}
+	for i := 0; i < 2; i++ {
+		bc.reqs = append(bc.reqs, ipv4.Message{Buffers: [][]byte{req}, Addr: from})
+	}
+	w := &worker{l: &listener{conn: conn, local: "127.0.0.1:123"}}
+	if err := srv.serveBatch(w, bc, false, bc.stop); err != nil {
+		t.Fatalf("serveBatch: %v", err)
+	}
+
+	// The kiss that was not sent leaves the request counted as rate limited.
+	for i, want := range []string{"send failed", "rate_limited"} {
+		ev := waitForEvent(t, events, ModeClient)
+		if ev.Responded || ev.Kiss != "" || ev.Error != want {
+			t.Fatalf("event %d: %+v", i, ev)
+		}
+	}
+	m := srv.Metrics()
+	if m.TotalResponses != 0 || m.KoDSent != 0 {
+		t.Fatalf("responses=%d kod=%d, want 0", m.TotalResponses, m.KoDSent)
+	}
+	want := map[string]uint64{"write_failed": 1, "rate_limited": 1}
+	if !reflect.DeepEqual(m.ErrorsByReason, want) || m.TotalErrors != 2 {
+		t.Fatalf("errors: got=%v total=%d want=%v", m.ErrorsByReason, m.TotalErrors, want)
+	}
+}
+
+func TestBatchWriter_FlushToPortZero(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	bc := newBatchConn(conn)
+	if bc == nil {
+		t.Skip("no batched I/O on this platform")
+	}
+	bw := &batchWriter{bc: bc}
+	_ = bw.writeTo([]byte{1}, remote{ap: netip.MustParseAddrPort("127.0.0.1:0")})
+	_ = bw.writeTo([]byte{2}, remote{ap: netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(conn.LocalAddr().(*net.UDPAddr).Port))})
+	var failed []int
+	bw.flush(func(owner int, err error) { failed = append(failed, owner) })
+	if len(failed) != 1 || failed[0] != 0 {
+		t.Fatalf("failed owners: got=%v want=[0]", failed)
+	}
+}
+
+// BenchmarkServe compares the plain serve loop with the batched one on
+// loopback. Clients keep a window of requests in flight so that batches can
+// fill up.
+func BenchmarkServe(b *testing.B) {
+	for _, batch := range []int{1, 64} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			benchmarkServe(b, batch)
+		})
+	}
+}
+
+func benchmarkServe(b *testing.B, batch int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", BatchSize: batch, HistorySize: 1})
+	if err := srv.Start(ctx); err != nil {
+		b.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	const clients, window = 8, 16
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: 1}.Marshal()
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		n := b.N / clients
+		if i < b.N%clients {
+			n++
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			c := dialServer(b, srv)
+			defer c.Close()
+			buf := make([]byte, 128)
+			for n > 0 {
+				k := min(n, window)
+				for j := 0; j < k; j++ {
+					_, _ = c.Write(req)
+				}
+				_ = c.SetReadDeadline(time.Now().Add(time.Second))
+				for j := 0; j < k; j++ {
+					if _, err := c.Read(buf); err != nil {
+						break
+					}
+				}
+				n -= k
+			}
+		}(n)
+	}
+	wg.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "req/s")
+}
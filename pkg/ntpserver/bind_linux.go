@@ -0,0 +1,9 @@
+//go:build linux
+
+package ntpserver
+
+import "golang.org/x/sys/unix"
+
+func bindToDevice(fd uintptr, iface string) error {
+	return unix.BindToDevice(int(fd), iface)
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package ntpserver
+
+func bindToDevice(fd uintptr, iface string) error {
+	return ErrBindToDeviceUnsupported
+}
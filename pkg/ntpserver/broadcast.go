@@ -0,0 +1,168 @@
+package ntpserver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// buildBroadcast returns a mode 5 packet carrying the same system variables
+// as BuildResponse. Broadcast packets have no origin or receive timestamp.
+func buildBroadcast(cfg responseConfig, poll int8, transmittedAt time.Time) Packet {
+	p := Packet{
+		LI:             cfg.LeapIndicator,
+		VN:             4,
+		Mode:           ModeBroadcast,
+		Stratum:        cfg.Stratum,
+		Poll:           poll,
+		Prec:           cfg.Precision,
+		RootDelay:      cfg.RootDelay,
+		RootDispersion: cfg.RootDispersion,
+		RefID:          cfg.RefID,
+		Transmit:       timeToTimestamp(transmittedAt),
+	}
+	if !cfg.ReferenceTime.IsZero() {
+		p.Reference = timeToTimestamp(cfg.ReferenceTime)
+	}
+	return p
+}
+
+// broadcastDest is a broadcast or multicast destination and the listener
+// socket its packets are sent from.
+type broadcastDest struct {
+	addr *net.UDPAddr
+	conn net.PacketConn
+}
+
+// resolveBroadcast resolves the configured broadcast and multicast
+// destinations, defaulting to port 123, and picks a listener for each.
+func resolveBroadcast(network string, dests []string, ls []*listener) ([]broadcastDest, error) {
+	out := make([]broadcastDest, 0, len(dests))
+	for _, d := range dests {
+		if _, _, err := net.SplitHostPort(d); err != nil {
+			d = net.JoinHostPort(d, "123")
+		}
+		addr, err := net.ResolveUDPAddr(network, d)
+		if err != nil {
+			return nil, err
+		}
+		conn := broadcastConn(network, ls, addr)
+		if conn == nil {
+			return nil, fmt.Errorf("ntpserver: no listener of the address family of broadcast destination %s", addr)
+		}
+		out = append(out, broadcastDest{addr: addr, conn: conn})
+	}
+	return out, nil
+}
+
+// broadcastConn returns the first listener socket bound to an address of the
+// family of dst or, failing that, a dual-stack wildcard socket. It returns nil
+// if no listener can send to dst.
+func broadcastConn(network string, ls []*listener, dst *net.UDPAddr) net.PacketConn {
+	v4 := dst.IP.To4() != nil
+	var dual net.PacketConn
+	for _, l := range ls {
+		la, ok := l.conn.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if (la.IP.To4() != nil) == v4 {
+			return l.conn
+		}
+		if dual == nil && network == "udp" && la.IP.IsUnspecified() {
+			dual = l.conn
+		}
+	}
+	return dual
+}
+
+// checkBroadcast rejects a broadcast destination given as an IP address that
+// no listen address can send to. Host names are checked by resolveBroadcast
+// once resolved.
+func (c Config) checkBroadcast(dest string) error {
+	host := dest
+	if h, _, err := net.SplitHostPort(dest); err == nil {
+		host = h
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	v4 := ip.Unmap().Is4()
+	for _, spec := range c.listenSpecs() {
+		if listenFamilyCanSend(c.Network, spec.addr, v4) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ntpserver: no listener of the address family of broadcast destination %q", dest)
+}
+
+// listenFamilyCanSend reports whether a socket opened on network and addr can
+// send to an address of the IPv4 family, or of the IPv6 family if v4 is false.
+// Host names and the wildcard address of "udp" may be either.
+func listenFamilyCanSend(network, addr string, v4 bool) bool {
+	if network == "udp4" && !v4 || network == "udp6" && v4 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return true
+	}
+	if ip == netip.IPv6Unspecified() && network != "udp6" {
+		return true
+	}
+	return ip.Unmap().Is4() == v4
+}
+
+// runBroadcast sends a broadcast packet to every destination each
+// BroadcastInterval until stop closes.
+func (s *Server) runBroadcast(stop <-chan struct{}, dests []broadcastDest, key *keyEntry) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(s.cfg.BroadcastInterval)
+		defer t.Stop()
+		for {
+			s.sendBroadcast(dests, key)
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// sendBroadcast sends one broadcast packet to each destination, from the
+// listener picked for it.
+func (s *Server) sendBroadcast(dests []broadcastDest, key *keyEntry) {
+	s.mu.RLock()
+	running := s.conn != nil
+	s.mu.RUnlock()
+	if !running {
+		return
+	}
+	now := s.cfg.Clock.Now()
+	pkt := buildBroadcast(s.responseConfig(now), pollExponent(s.cfg.BroadcastInterval), now)
+	if key != nil {
+		pkt.MAC = key.sign(pkt.Marshal())
+	}
+	out := pkt.Marshal()
+	for _, d := range dests {
+		if _, err := d.conn.WriteTo(out, d.addr); err != nil {
+			s.metrics.incBroadcastError()
+			if s.cfg.Slog != nil {
+				s.cfg.Slog.Warn("ntp broadcast failed", "dest", d.addr.String(), "err", err)
+			} else if s.cfg.Logger != nil {
+				s.cfg.Logger.Printf("[WARN] NTP broadcast to %s failed: %v", d.addr, err)
+			}
+			continue
+		}
+		s.metrics.incBroadcastSent()
+	}
+}
@@ -0,0 +1,123 @@
+package ntpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_BroadcastSignedPackets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	keys, _ := NewKeyring(SymmetricKey{ID: 5, Type: KeyTypeSHA1, Secret: []byte("broadcast"), Trusted: true})
+	srv := New(Config{
+		ListenAddr:        "127.0.0.1:0",
+		Network:           "udp4",
+		Stratum:           3,
+		RefID:             refIDFromASCII4("GPS"),
+		Broadcast:         []string{listener.LocalAddr().String()},
+		BroadcastInterval: 50 * time.Millisecond,
+		BroadcastKeyID:    5,
+		Keys:              keys,
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	buf := make([]byte, 2048)
+	for i := 0; i < 2; i++ {
+		_ = listener.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("read broadcast %d: %v", i, err)
+		}
+		p, ok := ParsePacket(buf[:n])
+		if !ok || p.Mode != ModeBroadcast || p.Stratum != 3 || p.RefID != refIDFromASCII4("GPS") {
+			t.Fatalf("broadcast: ok=%v %+v", ok, p)
+		}
+		if p.Originate != 0 || p.Receive != 0 || p.Transmit == 0 {
+			t.Fatalf("broadcast timestamps: %+v", p)
+		}
+		if p.MAC == nil || p.MAC.KeyID != 5 {
+			t.Fatalf("broadcast MAC: %+v", p.MAC)
+		}
+		if _, ok := keys.verify(buf[:n-p.MAC.Len()], p.MAC); !ok {
+			t.Fatalf("broadcast MAC does not verify")
+		}
+	}
+	if m := srv.Metrics(); m.BroadcastsSent < 2 || m.BroadcastErrors != 0 {
+		t.Fatalf("counters: sent=%d errors=%d", m.BroadcastsSent, m.BroadcastErrors)
+	}
+}
+
+func TestServer_BroadcastUnknownKey(t *testing.T) {
+	srv := New(Config{
+		ListenAddr:     "127.0.0.1:0",
+		Network:        "udp4",
+		Broadcast:      []string{"127.0.0.1"},
+		BroadcastKeyID: 9,
+	})
+	if err := srv.Start(context.Background()); !errors.Is(err, ErrKeyMissing) {
+		_ = srv.Stop()
+		t.Fatalf("start: got=%v want=%v", err, ErrKeyMissing)
+	}
+}
+
+func TestServer_BroadcastUsesListenerOfSameFamily(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("ipv6 not available on this system: %v", err)
+	}
+	defer listener.Close()
+
+	srv := New(Config{
+		ListenAddrs:       []string{"127.0.0.1:0", "[::1]:0"},
+		Broadcast:         []string{listener.LocalAddr().String()},
+		BroadcastInterval: time.Hour,
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	buf := make([]byte, 2048)
+	_ = listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := listener.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read broadcast: %v", err)
+	}
+	if p, ok := ParsePacket(buf[:n]); !ok || p.Mode != ModeBroadcast {
+		t.Fatalf("broadcast: ok=%v %+v", ok, p)
+	}
+	if got := from.String(); got != srv.Addrs()[1] {
+		t.Fatalf("sent from %s, want the IPv6 listener %s", got, srv.Addrs()[1])
+	}
+}
+
+func TestServer_BroadcastNoListenerOfFamily(t *testing.T) {
+	for _, cfg := range []Config{
+		{ListenAddr: "127.0.0.1:0", Broadcast: []string{"ff02::101"}},
+		{ListenAddr: ":0", Network: "udp4", Broadcast: []string{"[ff02::101]:123"}},
+		{ListenAddrs: []string{"[::1]:0", "[fe80::1]:0"}, Broadcast: []string{"192.0.2.255"}},
+	} {
+		srv := New(cfg)
+		if err := srv.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "address family") {
+			_ = srv.Stop()
+			t.Fatalf("%v %v: got=%v, want an address family error", cfg.ListenAddrs, cfg.Broadcast, err)
+		}
+	}
+}
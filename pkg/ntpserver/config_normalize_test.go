@@ -1,6 +1,9 @@
 package ntpserver
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestConfig_normalize_Defaults(t *testing.T) {
 	cfg := Config{}.normalize()
@@ -31,4 +34,31 @@ func TestConfig_normalize_Defaults(t *testing.T) {
 	if cfg.RateLimitBurst != 5 {
 		t.Fatalf("RateLimitBurst default: got=%d want=%d", cfg.RateLimitBurst, 5)
 	}
+	if cfg.RateLimitClients != 65536 || cfg.RateLimitFull != RateLimitEvict {
+		t.Fatalf("RateLimit table defaults: got clients=%d full=%q", cfg.RateLimitClients, cfg.RateLimitFull)
+	}
+	if cfg.RateLimitPrefixV4 != 24 || cfg.RateLimitPrefixV6 != 64 || cfg.RateLimitPrefixPerSecond != 0 || cfg.RateLimitGlobalPerSecond != 0 {
+		t.Fatalf("RateLimit layer defaults: got v4=/%d v6=/%d prefix=%v global=%v", cfg.RateLimitPrefixV4, cfg.RateLimitPrefixV6, cfg.RateLimitPrefixPerSecond, cfg.RateLimitGlobalPerSecond)
+	}
+	if cfg.KoD {
+		t.Fatalf("KoD default: expected disabled")
+	}
+	if cfg.KoDRateLimitPerSecond != 0.1 || cfg.KoDBurst != 1 || cfg.KoDMinPoll != 10 {
+		t.Fatalf("KoD limits default: got rate=%v burst=%d minpoll=%d", cfg.KoDRateLimitPerSecond, cfg.KoDBurst, cfg.KoDMinPoll)
+	}
+	if cfg.Interleaved || cfg.InterleavedClients != 4096 || cfg.InterleavedTimeout != 20*time.Minute {
+		t.Fatalf("Interleaved defaults: got enabled=%v clients=%d timeout=%v", cfg.Interleaved, cfg.InterleavedClients, cfg.InterleavedTimeout)
+	}
+	if cfg.BroadcastInterval != 64*time.Second {
+		t.Fatalf("BroadcastInterval default: got=%v want=%v", cfg.BroadcastInterval, 64*time.Second)
+	}
+	if cfg.TopClients != 10 || cfg.TopClientsError != 0.001 || cfg.TopClientsWindow != 10*time.Minute {
+		t.Fatalf("TopClients defaults: got k=%d error=%v window=%v", cfg.TopClients, cfg.TopClientsError, cfg.TopClientsWindow)
+	}
+	if cfg.LogRequestsPerSecond != 10 || cfg.LogRequestsBurst != 10 {
+		t.Fatalf("LogRequests defaults: got rate=%v burst=%d", cfg.LogRequestsPerSecond, cfg.LogRequestsBurst)
+	}
+	if cfg.Workers != 1 || cfg.ReusePort {
+		t.Fatalf("Workers default: got=%d reuseport=%v", cfg.Workers, cfg.ReusePort)
+	}
 }
@@ -0,0 +1,616 @@
+package ntpserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode 6 control messages (RFC 1305 appendix B, RFC 9327), as spoken by ntpq.
+const (
+	ctlHeaderLen = 12
+	// ctlMaxData is the data carried by one response fragment (ntpd's CTL_MAX_DATA_LEN).
+	ctlMaxData = 468
+
+	ctlResponse = 0x80
+	ctlError    = 0x40
+	ctlMore     = 0x20
+	ctlOpMask   = 0x1f
+
+	ctlOpReadStat = 1
+	ctlOpReadVar  = 2
+	ctlOpReadMRU  = 10
+	ctlOpReqNonce = 12
+
+	// Opcodes that change state; none is implemented.
+	ctlOpWriteVar   = 3
+	ctlOpWriteClock = 5
+	ctlOpSetTrap    = 6
+	ctlOpConfigure  = 8
+	ctlOpSaveConfig = 9
+	ctlOpUnsetTrap  = 31
+
+	// Error codes carried in the high byte of the status word.
+	ctlErrPerm     = 1
+	ctlErrBadOp    = 3
+	ctlErrBadAssoc = 4
+	ctlErrBadValue = 6
+
+	// System status clock sources.
+	ctlSourceUnspec = 0
+	ctlSourceLocal  = 5
+	ctlSourceNTP    = 6
+
+	// Peer status bits and selection codes, as shown by ntpq -p.
+	ctlPeerConfig     = 0x80
+	ctlPeerReach      = 0x10
+	ctlSelFalseticker = 1
+	ctlSelOutlier     = 3
+	ctlSelCandidate   = 4
+	ctlSelSysPeer     = 6
+
+	// ctlNonceLifetime bounds how long an MRU nonce stays valid.
+	ctlNonceLifetime = 16 * time.Second
+	// ctlMRUMaxFrags caps one MRU response when the client asks for no limit.
+	ctlMRUMaxFrags = 32
+)
+
+// ctlMessage is a parsed mode 6 request.
+type ctlMessage struct {
+	vn    uint8
+	op    uint8
+	seq   uint16
+	assoc uint16
+	data  []byte
+}
+
+// parseControl parses a single-fragment mode 6 request.
+func parseControl(b []byte) (ctlMessage, bool) {
+	if len(b) < ctlHeaderLen || b[0]&0x7 != ModeControl {
+		return ctlMessage{}, false
+	}
+	if b[1]&(ctlResponse|ctlError|ctlMore) != 0 {
+		return ctlMessage{}, false
+	}
+	offset := binary.BigEndian.Uint16(b[8:10])
+	count := int(binary.BigEndian.Uint16(b[10:12]))
+	if offset != 0 || count > len(b)-ctlHeaderLen {
+		return ctlMessage{}, false
+	}
+	return ctlMessage{
+		vn:    (b[0] >> 3) & 0x7,
+		op:    b[1] & ctlOpMask,
+		seq:   binary.BigEndian.Uint16(b[2:4]),
+		assoc: binary.BigEndian.Uint16(b[6:8]),
+		data:  b[ctlHeaderLen : ctlHeaderLen+count],
+	}, true
+}
+
+// marshalControl builds the response fragments for req. An empty frags
+// produces a single fragment without data.
+func marshalControl(req ctlMessage, status, assoc uint16, frags [][]byte, errCode uint8) [][]byte {
+	if len(frags) == 0 {
+		frags = [][]byte{nil}
+	}
+	out := make([][]byte, 0, len(frags))
+	offset := 0
+	for i, data := range frags {
+		b := make([]byte, ctlHeaderLen+(len(data)+3)&^3)
+		b[0] = (req.vn&0x7)<<3 | ModeControl
+		b[1] = ctlResponse | req.op
+		if errCode != 0 {
+			b[1] |= ctlError
+			status = uint16(errCode) << 8
+		}
+		if i < len(frags)-1 {
+			b[1] |= ctlMore
+		}
+		binary.BigEndian.PutUint16(b[2:4], req.seq)
+		binary.BigEndian.PutUint16(b[4:6], status)
+		binary.BigEndian.PutUint16(b[6:8], assoc)
+		binary.BigEndian.PutUint16(b[8:10], uint16(offset))
+		binary.BigEndian.PutUint16(b[10:12], uint16(len(data)))
+		copy(b[ctlHeaderLen:], data)
+		out = append(out, b)
+		offset += len(data)
+	}
+	return out
+}
+
+// ctlPacker joins "name=value" items with commas into fragments of at most
+// ctlMaxData bytes without splitting an item.
+type ctlPacker struct {
+	frags [][]byte
+	cur   []byte
+}
+
+func (p *ctlPacker) add(items ...string) {
+	for _, it := range items {
+		if len(p.cur) > 0 && len(p.cur)+1+len(it) > ctlMaxData-1 {
+			p.frags = append(p.frags, append(p.cur, ','))
+			p.cur = nil
+		}
+		if len(p.cur) > 0 {
+			p.cur = append(p.cur, ',')
+		}
+		p.cur = append(p.cur, it...)
+	}
+}
+
+// countWith returns the number of fragments after adding items.
+func (p *ctlPacker) countWith(items ...string) int {
+	n, cur := len(p.frags), len(p.cur)
+	for _, it := range items {
+		if cur > 0 && cur+1+len(it) > ctlMaxData-1 {
+			n++
+			cur = 0
+		}
+		if cur > 0 {
+			cur++
+		}
+		cur += len(it)
+	}
+	if cur > 0 {
+		n++
+	}
+	return n
+}
+
+func (p *ctlPacker) fragments() [][]byte {
+	if len(p.cur) > 0 {
+		return append(p.frags, p.cur)
+	}
+	return p.frags
+}
+
+// ctlVar is one "name=value" pair of a readvar response.
+type ctlVar struct {
+	name  string
+	value string
+}
+
+// ctlSelectVars keeps the variables named in a readvar request, in request
+// order. An empty request selects everything; unknown names are ignored.
+func ctlSelectVars(vars []ctlVar, data []byte) []string {
+	names := ctlParams(data)
+	out := make([]string, 0, len(vars))
+	if len(names) == 0 {
+		for _, v := range vars {
+			out = append(out, v.name+"="+v.value)
+		}
+		return out
+	}
+	for _, n := range names {
+		for _, v := range vars {
+			if v.name == n.name {
+				out = append(out, v.name+"="+v.value)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// ctlParams splits request data of the form "a, b=1, c" into pairs.
+func ctlParams(data []byte) []ctlVar {
+	var out []ctlVar
+	for _, f := range strings.Split(string(data), ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(f, "=")
+		out = append(out, ctlVar{name: strings.TrimSpace(name), value: strings.TrimSpace(value)})
+	}
+	return out
+}
+
+func ctlTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return "0x00000000.00000000"
+	}
+	ts := timeToTimestamp(t)
+	return fmt.Sprintf("0x%08x.%08x", uint32(ts>>32), uint32(ts))
+}
+
+func ctlParseTimestamp(s string) (Timestamp, bool) {
+	hi, lo, ok := strings.Cut(strings.TrimPrefix(s, "0x"), ".")
+	if !ok {
+		return 0, false
+	}
+	sec, err1 := strconv.ParseUint(hi, 16, 32)
+	frac, err2 := strconv.ParseUint(lo, 16, 32)
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return Timestamp(sec<<32 | frac), true
+}
+
+// ctlMillis formats a duration in milliseconds, ntpq's unit for offsets and delays.
+func ctlMillis(d time.Duration, prec int) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', prec, 64)
+}
+
+// ctlRefID formats a RefID as ntpq shows it: ASCII for stratum 0 and 1,
+// otherwise a dotted quad.
+func ctlRefID(stratum uint8, refID uint32) string {
+	if stratum <= 1 {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, refID)
+		return strings.TrimRight(string(b), "\x00")
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", byte(refID>>24), byte(refID>>16), byte(refID>>8), byte(refID))
+}
+
+// controlAllowed reports whether ip may send mode 6 queries.
+func (s *Server) controlAllowed(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, p := range s.live.Load().cfg.ControlAllow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleControl answers a mode 6 request from raddr. It returns the error of
+// a failed write, which is also left in ev.Error.
+func (s *Server) handleControl(conn replyWriter, to remote, b []byte, flags RestrictFlags, ev *RequestEvent) error {
+	ev.Mode = ModeControl
+	ev.Version = (b[0] >> 3) & 0x7
+	from := to.ip()
+	if !s.controlAllowed(from) {
+		ev.Error = "control_denied"
+		return nil
+	}
+	req, ok := parseControl(b)
+	if !ok {
+		ev.Error = "invalid_request"
+		return nil
+	}
+	ev.PacketValid = true
+
+	var (
+		status, assoc uint16
+		frags         [][]byte
+		errCode       uint8
+	)
+	if flags&RestrictNoModify != 0 && ctlModifies(req.op) {
+		errCode = ctlErrPerm
+		ev.Error = "restricted_nomodify"
+	} else {
+		status, assoc, frags, errCode = s.controlReply(req, from)
+	}
+	for _, out := range marshalControl(req, status, assoc, frags, errCode) {
+		if err := conn.writeTo(out, to); err != nil {
+			ev.Error = err.Error()
+			return err
+		}
+	}
+	ev.Responded = true
+	if errCode != 0 && ev.Error == "" {
+		ev.Error = "control_error"
+	}
+	return nil
+}
+
+// ctlModifies reports whether op changes server state (write variables,
+// traps, configuration), which RestrictNoModify refuses.
+func ctlModifies(op uint8) bool {
+	switch op {
+	case ctlOpWriteVar, ctlOpWriteClock, ctlOpSetTrap, ctlOpConfigure, ctlOpSaveConfig, ctlOpUnsetTrap:
+		return true
+	}
+	return false
+}
+
+// ctlAssoc is an association as listed by ntpq: an upstream server polled in
+// client mode, or a symmetric peer.
+type ctlAssoc struct {
+	UpstreamStatus
+	id    uint16
+	hmode uint8
+	pmode uint8
+}
+
+func (s *Server) ctlAssociations() []ctlAssoc {
+	if s.ups == nil {
+		return nil
+	}
+	u := s.ups
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	out := make([]ctlAssoc, 0, len(u.peers)+len(u.assocs))
+	for i, p := range u.peers {
+		out = append(out, ctlAssoc{UpstreamStatus: p, id: uint16(i + 1), hmode: ModeClient, pmode: ModeServer})
+	}
+	for _, a := range u.assocs {
+		out = append(out, ctlAssoc{UpstreamStatus: a.status.UpstreamStatus, id: a.id, hmode: a.status.HostMode, pmode: a.status.PeerMode})
+	}
+	return out
+}
+
+func ctlFindAssoc(assocs []ctlAssoc, id uint16) (ctlAssoc, bool) {
+	for _, a := range assocs {
+		if a.id == id {
+			return a, true
+		}
+	}
+	return ctlAssoc{}, false
+}
+
+func (s *Server) controlReply(req ctlMessage, from netip.Addr) (status, assoc uint16, frags [][]byte, errCode uint8) {
+	now := s.cfg.Clock.Now()
+	rc := s.responseConfig(now)
+	sysStatus := s.ctlSystemStatus(rc)
+	assocs := s.ctlAssociations()
+
+	switch req.op {
+	case ctlOpReadStat:
+		if req.assoc != 0 {
+			a, ok := ctlFindAssoc(assocs, req.assoc)
+			if !ok {
+				return 0, req.assoc, nil, ctlErrBadAssoc
+			}
+			return ctlPeerStatus(a), req.assoc, nil, 0
+		}
+		data := make([]byte, 0, 4*len(assocs))
+		for _, a := range assocs {
+			data = binary.BigEndian.AppendUint16(data, a.id)
+			data = binary.BigEndian.AppendUint16(data, ctlPeerStatus(a))
+		}
+		return sysStatus, 0, [][]byte{data}, 0
+
+	case ctlOpReadVar:
+		var p ctlPacker
+		if req.assoc == 0 {
+			p.add(ctlSelectVars(s.ctlSystemVars(rc, now, assocs), req.data)...)
+			return sysStatus, 0, p.fragments(), 0
+		}
+		a, ok := ctlFindAssoc(assocs, req.assoc)
+		if !ok {
+			return 0, req.assoc, nil, ctlErrBadAssoc
+		}
+		p.add(ctlSelectVars(s.ctlPeerVars(a), req.data)...)
+		return ctlPeerStatus(a), req.assoc, p.fragments(), 0
+
+	case ctlOpReqNonce:
+		var p ctlPacker
+		p.add("nonce=" + s.ctlNonce(from, time.Now()))
+		return sysStatus, 0, p.fragments(), 0
+
+	case ctlOpReadMRU:
+		frags, errCode := s.ctlMRU(req, from)
+		return sysStatus, 0, frags, errCode
+
+	default:
+		return 0, 0, nil, ctlErrBadOp
+	}
+}
+
+// ctlSystemStatus is the system status word: leap indicator, clock source,
+// and an empty event counter.
+func (s *Server) ctlSystemStatus(rc responseConfig) uint16 {
+	src := ctlSourceLocal
+	if s.ups != nil {
+		src = ctlSourceUnspec
+		if rc.LeapIndicator != leapAlarm {
+			src = ctlSourceNTP
+		}
+	}
+	return uint16(rc.LeapIndicator&0x3)<<14 | uint16(src)<<8
+}
+
+func ctlPeerStatus(p ctlAssoc) uint16 {
+	st := uint16(ctlPeerConfig)
+	if p.Reachable() {
+		st |= ctlPeerReach
+	}
+	switch {
+	case p.Selected:
+		st |= ctlSelSysPeer
+	case p.Survivor:
+		st |= ctlSelCandidate
+	case p.Falseticker:
+		st |= ctlSelFalseticker
+	case p.Reachable():
+		st |= ctlSelOutlier
+	}
+	return st << 8
+}
+
+func (s *Server) ctlSystemVars(rc responseConfig, now time.Time, assocs []ctlAssoc) []ctlVar {
+	m := s.metrics.counters()
+	var offset, jitter time.Duration
+	if s.ups != nil {
+		sys := s.ups.system(now)
+		offset, jitter = sys.offset, sys.jitter
+	}
+	sysPeer := 0
+	for _, a := range assocs {
+		if a.Selected {
+			sysPeer = int(a.id)
+		}
+	}
+	uptime := int64(0)
+	if !m.StartedAt.IsZero() {
+		uptime = int64(time.Since(m.StartedAt) / time.Second)
+	}
+	return []ctlVar{
+		{"version", strconv.Quote(VersionInfo())},
+		{"system", strconv.Quote(runtime.GOOS + "/" + runtime.GOARCH)},
+		{"leap", strconv.Itoa(int(rc.LeapIndicator))},
+		{"stratum", strconv.Itoa(int(rc.Stratum))},
+		{"precision", strconv.Itoa(int(rc.Precision))},
+		{"rootdelay", ctlMillis(shortToDuration(rc.RootDelay), 3)},
+		{"rootdisp", ctlMillis(shortToDuration(rc.RootDispersion), 3)},
+		{"refid", ctlRefID(rc.Stratum, rc.RefID)},
+		{"reftime", ctlTimestamp(rc.ReferenceTime)},
+		{"clock", ctlTimestamp(now)},
+		{"peer", strconv.Itoa(sysPeer)},
+		{"offset", ctlMillis(offset, 6)},
+		{"sys_jitter", ctlMillis(jitter, 6)},
+		{"ss_uptime", strconv.FormatInt(uptime, 10)},
+		{"ss_received", strconv.FormatUint(m.TotalRequests, 10)},
+		{"ss_processed", strconv.FormatUint(m.TotalResponses, 10)},
+		{"ss_kodsent", strconv.FormatUint(m.KoDSent, 10)},
+	}
+}
+
+func (s *Server) ctlPeerVars(p ctlAssoc) []ctlVar {
+	addr := p.Resolved
+	if addr == "" {
+		addr = p.Address
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "123"
+	}
+	poll := int(pollExponent(s.cfg.UpstreamPollInterval))
+	return []ctlVar{
+		{"srcadr", host},
+		{"srcport", port},
+		{"srchost", strconv.Quote(p.Address)},
+		{"leap", strconv.Itoa(int(p.LeapIndicator))},
+		{"stratum", strconv.Itoa(int(p.Stratum))},
+		{"rootdelay", ctlMillis(p.RootDelay, 3)},
+		{"rootdisp", ctlMillis(p.RootDispersion, 3)},
+		{"refid", ctlRefID(p.Stratum, p.RefID)},
+		{"rec", ctlTimestamp(p.LastSample)},
+		{"reach", fmt.Sprintf("0x%02x", p.Reach)},
+		{"hmode", strconv.Itoa(int(p.hmode))},
+		{"pmode", strconv.Itoa(int(p.pmode))},
+		{"hpoll", strconv.Itoa(poll)},
+		{"ppoll", strconv.Itoa(poll)},
+		{"offset", ctlMillis(p.Offset, 6)},
+		{"delay", ctlMillis(p.Delay, 3)},
+		{"dispersion", ctlMillis(p.Dispersion, 3)},
+		{"jitter", ctlMillis(p.Jitter, 6)},
+	}
+}
+
+// ctlNonce returns an MRU nonce bound to the client address: the issue time
+// followed by a truncated HMAC of the time and address.
+func (s *Server) ctlNonce(addr netip.Addr, at time.Time) string {
+	b := make([]byte, 8, 16)
+	binary.BigEndian.PutUint64(b, uint64(at.UnixNano()))
+	mac := hmac.New(sha256.New, s.ctlSecret[:])
+	mac.Write(b)
+	ip := addr.As16()
+	mac.Write(ip[:])
+	b = append(b, mac.Sum(nil)[:8]...)
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) ctlNonceValid(nonce string, addr netip.Addr, now time.Time) bool {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 16 {
+		return false
+	}
+	at := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	if age := now.Sub(at); age < 0 || age > ctlNonceLifetime {
+		return false
+	}
+	return hmac.Equal([]byte(s.ctlNonce(addr, at)), []byte(nonce))
+}
+
+// ctlMRU answers a READ_MRU request from the per-IP request table. Entries
+// are sent least recently seen first; a client continues a truncated list by
+// echoing the last entries it received as last.N/addr.N.
+func (s *Server) ctlMRU(req ctlMessage, from netip.Addr) ([][]byte, uint8) {
+	now := time.Now()
+	params := ctlParams(req.data)
+	var (
+		nonce    string
+		maxFrags = ctlMRUMaxFrags
+		limit    = 0
+		minCount = uint64(0)
+		since    Timestamp
+		seen     = map[string]bool{}
+	)
+	for _, p := range params {
+		switch {
+		case p.name == "nonce":
+			nonce = p.value
+		case p.name == "frags":
+			n, err := strconv.Atoi(p.value)
+			if err != nil || n <= 0 {
+				return nil, ctlErrBadValue
+			}
+			maxFrags = min(n, ctlMRUMaxFrags)
+		case p.name == "limit":
+			n, err := strconv.Atoi(p.value)
+			if err != nil || n <= 0 {
+				return nil, ctlErrBadValue
+			}
+			limit = n
+		case p.name == "mincount":
+			n, err := strconv.ParseUint(p.value, 10, 64)
+			if err != nil {
+				return nil, ctlErrBadValue
+			}
+			minCount = n
+		case strings.HasPrefix(p.name, "last."):
+			ts, ok := ctlParseTimestamp(p.value)
+			if !ok {
+				return nil, ctlErrBadValue
+			}
+			if ts > since {
+				since = ts
+			}
+		case strings.HasPrefix(p.name, "addr."):
+			seen[p.value] = true
+		}
+	}
+	if !s.ctlNonceValid(nonce, from, now) {
+		return nil, ctlErrBadValue
+	}
+
+	var p ctlPacker
+	p.add("nonce=" + s.ctlNonce(from, now))
+	clients := s.metrics.clients()
+	var newest time.Time
+	if len(clients) > 0 {
+		newest = clients[len(clients)-1].last
+	}
+	trailer := []string{"now=" + ctlTimestamp(s.cfg.Clock.Now()), "last.newest=" + ctlTimestamp(newest)}
+
+	n := 0
+	complete := true
+	for _, c := range clients {
+		addr := netip.AddrPortFrom(c.ip, uint16(c.port)).String()
+		last := timeToTimestamp(c.last)
+		if last < since || (last == since && seen[addr]) || c.count < minCount {
+			continue
+		}
+		idx := strconv.Itoa(n)
+		entry := []string{
+			"addr." + idx + "=" + addr,
+			"last." + idx + "=" + ctlTimestamp(c.last),
+			"first." + idx + "=" + ctlTimestamp(c.first),
+			"ct." + idx + "=" + strconv.FormatUint(c.count, 10),
+			"mv." + idx + "=" + strconv.Itoa(int(c.mv)),
+			"rs." + idx + "=0x0",
+		}
+		if (limit > 0 && n >= limit) || p.countWith(append(entry, trailer...)...) > maxFrags {
+			complete = false
+			break
+		}
+		p.add(entry...)
+		n++
+	}
+	if complete {
+		p.add(trailer...)
+	}
+	return p.fragments(), 0
+}
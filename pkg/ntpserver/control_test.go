@@ -0,0 +1,245 @@
+package ntpserver
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func controlRequest(op uint8, seq, assoc uint16, data string) []byte {
+	b := make([]byte, ctlHeaderLen+(len(data)+3)&^3)
+	b[0] = 2<<3 | ModeControl
+	b[1] = op
+	binary.BigEndian.PutUint16(b[2:4], seq)
+	binary.BigEndian.PutUint16(b[6:8], assoc)
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(data)))
+	copy(b[ctlHeaderLen:], data)
+	return b
+}
+
+// controlQuery sends a mode 6 request and reassembles the response fragments.
+func controlQuery(t *testing.T, c *net.UDPConn, op uint8, assoc uint16, data string) (flags byte, status uint16, payload []byte, ok bool) {
+	t.Helper()
+	if _, err := c.Write(controlRequest(op, 7, assoc, data)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 2048)
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := c.Read(buf)
+		if err != nil {
+			return 0, 0, nil, false
+		}
+		if n < ctlHeaderLen || buf[0]&0x7 != ModeControl || buf[1]&ctlResponse == 0 {
+			t.Fatalf("not a control response: % x", buf[:n])
+		}
+		if seq := binary.BigEndian.Uint16(buf[2:4]); seq != 7 {
+			t.Fatalf("sequence: got=%d want=7", seq)
+		}
+		offset := int(binary.BigEndian.Uint16(buf[8:10]))
+		count := int(binary.BigEndian.Uint16(buf[10:12]))
+		if count > ctlMaxData || offset != len(payload) {
+			t.Fatalf("fragment offset=%d count=%d after %d bytes", offset, count, len(payload))
+		}
+		payload = append(payload, buf[ctlHeaderLen:ctlHeaderLen+count]...)
+		flags, status = buf[1], binary.BigEndian.Uint16(buf[4:6])
+		if flags&ctlMore == 0 {
+			return flags, status, payload, true
+		}
+	}
+}
+
+func controlVars(payload []byte) map[string]string {
+	out := map[string]string{}
+	for _, v := range ctlParams(payload) {
+		out[v.name] = v.value
+	}
+	return out
+}
+
+func startControlServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.Network = "udp4"
+	srv := New(cfg)
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { _ = srv.Stop() })
+	return srv
+}
+
+func TestServer_ControlReadVar(t *testing.T) {
+	srv := startControlServer(t, Config{
+		Stratum:      3,
+		ControlAllow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	})
+	c := dialServer(t, srv)
+	defer c.Close()
+
+	flags, status, payload, ok := controlQuery(t, c, ctlOpReadVar, 0, "")
+	if !ok || flags&ctlError != 0 {
+		t.Fatalf("readvar: ok=%v flags=%02x", ok, flags)
+	}
+	if src := (status >> 8) & 0x3f; src != ctlSourceLocal {
+		t.Fatalf("clock source: got=%d want=%d", src, ctlSourceLocal)
+	}
+	vars := controlVars(payload)
+	if vars["stratum"] != "3" || vars["refid"] != "76.79.67.76" {
+		t.Fatalf("system vars: %v", vars)
+	}
+	if vars["version"] != `"`+VersionInfo()+`"` || vars["leap"] != "0" || vars["ss_received"] != "1" {
+		t.Fatalf("system vars: %v", vars)
+	}
+
+	_, _, payload, ok = controlQuery(t, c, ctlOpReadVar, 0, "refid, stratum, bogus")
+	if !ok || string(payload) != "refid=76.79.67.76,stratum=3" {
+		t.Fatalf("selected vars: got=%q", payload)
+	}
+
+	flags, status, _, ok = controlQuery(t, c, ctlOpReadVar, 9, "")
+	if !ok || flags&ctlError == 0 || status>>8 != ctlErrBadAssoc {
+		t.Fatalf("unknown association: ok=%v flags=%02x status=%04x", ok, flags, status)
+	}
+}
+
+func TestServer_ControlDeniedOutsideAllowlist(t *testing.T) {
+	for _, allow := range [][]netip.Prefix{nil, {netip.MustParsePrefix("192.0.2.0/24")}} {
+		srv := startControlServer(t, Config{ControlAllow: allow})
+		events, unsubscribe := srv.Subscribe()
+		c := dialServer(t, srv)
+
+		if _, _, _, ok := controlQuery(t, c, ctlOpReadVar, 0, ""); ok {
+			t.Fatalf("allow=%v: expected no response", allow)
+		}
+		select {
+		case ev := <-events:
+			if ev.Error != "control_denied" || ev.Mode != ModeControl {
+				t.Fatalf("event: %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event")
+		}
+		unsubscribe()
+		c.Close()
+	}
+}
+
+func TestServer_ControlMRUList(t *testing.T) {
+	srv := startControlServer(t, Config{
+		ControlAllow: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	})
+	c := dialServer(t, srv)
+	defer c.Close()
+
+	now := time.Now()
+	srv.metrics.incRequest(nil, netip.MustParseAddr("192.0.2.1"), 123, 0x23, now.Add(-2*time.Minute))
+	srv.metrics.incRequest(nil, netip.MustParseAddr("192.0.2.1"), 123, 0x23, now.Add(-time.Minute))
+	srv.metrics.incRequest(nil, netip.MustParseAddr("192.0.2.2"), 4123, 0x1b, now.Add(-30*time.Second))
+
+	flags, _, _, ok := controlQuery(t, c, ctlOpReadMRU, 0, "nonce=00, frags=4")
+	if !ok || flags&ctlError == 0 {
+		t.Fatalf("bad nonce: expected error, ok=%v flags=%02x", ok, flags)
+	}
+
+	_, _, payload, ok := controlQuery(t, c, ctlOpReqNonce, 0, "")
+	nonce := controlVars(payload)["nonce"]
+	if !ok || nonce == "" {
+		t.Fatalf("nonce: %q", payload)
+	}
+	flags, _, payload, ok = controlQuery(t, c, ctlOpReadMRU, 0, "nonce="+nonce+", frags=4")
+	if !ok || flags&ctlError != 0 {
+		t.Fatalf("mrulist: ok=%v flags=%02x", ok, flags)
+	}
+	vars := controlVars(payload)
+	// Least recently seen first; the querying client is the newest entry.
+	if vars["addr.0"] != "192.0.2.1:123" || vars["addr.1"] != "192.0.2.2:4123" || vars["addr.2"] != c.LocalAddr().String() {
+		t.Fatalf("mru order: %s", payload)
+	}
+	if vars["ct.0"] != "2" || vars["mv.0"] != "35" || vars["first.0"] == vars["last.0"] || vars["ct.2"] != "3" || vars["mv.2"] != "22" {
+		t.Fatalf("mru entries: %v", vars)
+	}
+	if vars["now"] == "" || vars["last.newest"] != vars["last.2"] || vars["nonce"] == "" {
+		t.Fatalf("mru trailer: %v", vars)
+	}
+
+	// Continuing after an entry only returns newer ones.
+	_, _, payload, _ = controlQuery(t, c, ctlOpReadMRU, 0,
+		"nonce="+vars["nonce"]+", last.0="+vars["last.1"]+", addr.0="+vars["addr.1"])
+	vars = controlVars(payload)
+	if vars["addr.0"] != c.LocalAddr().String() || vars["addr.1"] != "" || vars["now"] == "" {
+		t.Fatalf("continuation: %s", payload)
+	}
+
+	// limit truncates the list and leaves out the trailer.
+	_, _, payload, _ = controlQuery(t, c, ctlOpReadMRU, 0, "nonce="+vars["nonce"]+", limit=1")
+	vars = controlVars(payload)
+	if vars["addr.0"] != "192.0.2.1:123" || vars["addr.1"] != "" || vars["now"] != "" {
+		t.Fatalf("limit: %s", payload)
+	}
+}
+
+func TestServer_ControlPeers(t *testing.T) {
+	primary := startControlServer(t, Config{Stratum: 1, RefID: refIDFromASCII4("GPS")})
+	srv := startControlServer(t, Config{
+		Upstreams:            []string{primary.Addr()},
+		UpstreamPollInterval: 80 * time.Millisecond,
+		ControlAllow:         []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	})
+	waitForUpstream(t, srv)
+	c := dialServer(t, srv)
+	defer c.Close()
+
+	_, status, payload, ok := controlQuery(t, c, ctlOpReadStat, 0, "")
+	if !ok || len(payload) != 4 {
+		t.Fatalf("readstat: ok=%v payload=% x", ok, payload)
+	}
+	if src := (status >> 8) & 0x3f; src != ctlSourceNTP {
+		t.Fatalf("clock source: got=%d want=%d", src, ctlSourceNTP)
+	}
+	assoc := binary.BigEndian.Uint16(payload[0:2])
+	peerStatus := binary.BigEndian.Uint16(payload[2:4])
+	if peerStatus>>8 != ctlPeerConfig|ctlPeerReach|ctlSelSysPeer {
+		t.Fatalf("peer status: got=%04x", peerStatus)
+	}
+
+	_, _, payload, ok = controlQuery(t, c, ctlOpReadVar, assoc, "")
+	vars := controlVars(payload)
+	host, port, _ := net.SplitHostPort(primary.Addr())
+	if !ok || vars["srcadr"] != host || vars["srcport"] != port || vars["refid"] != "GPS" || vars["stratum"] != "1" {
+		t.Fatalf("peer vars: %v", vars)
+	}
+
+	_, _, payload, _ = controlQuery(t, c, ctlOpReadVar, 0, "peer,stratum")
+	if got := string(payload); got != "peer=1,stratum=2" {
+		t.Fatalf("system peer: got=%q", got)
+	}
+}
+
+func TestCtlPacker_SplitsOnItemBoundaries(t *testing.T) {
+	var p ctlPacker
+	var items []string
+	for i := 0; i < 100; i++ {
+		items = append(items, "name"+strings.Repeat("x", i%7)+"=value")
+	}
+	want := p.countWith(items...)
+	p.add(items...)
+	frags := p.fragments()
+	if len(frags) != want || len(frags) < 2 {
+		t.Fatalf("fragments: got=%d countWith=%d", len(frags), want)
+	}
+	var joined []byte
+	for _, f := range frags {
+		if len(f) > ctlMaxData {
+			t.Fatalf("fragment too large: %d", len(f))
+		}
+		joined = append(joined, f...)
+	}
+	if got := strings.Split(string(joined), ","); len(got) != len(items) || got[len(got)-1] != items[len(items)-1] {
+		t.Fatalf("reassembled items: %d", len(got))
+	}
+}
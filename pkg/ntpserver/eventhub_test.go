@@ -38,3 +38,15 @@ func TestEventHub_SubscribeUnsubscribeCloses(t *testing.T) {
 		}
 	}
 }
+
+func TestEventHub_CountsDrops(t *testing.T) {
+	h := newEventHub(10)
+	_, cancel := h.subscribe(1)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		h.publish(RequestEvent{At: time.Unix(int64(i), 0)})
+	}
+	if got := h.dropped.Load(); got != 2 {
+		t.Fatalf("dropped: got=%d want=2", got)
+	}
+}
@@ -1,12 +1,18 @@
 package ntpserver
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 type eventHub struct {
 	mu          sync.RWMutex
 	subscribers map[chan RequestEvent]struct{}
-	history     []RequestEvent
+	history     []RequestEvent // ring buffer once maxHistory long
+	next        int            // oldest entry of a full history
 	maxHistory  int
+
+	dropped atomic.Uint64 // events a slow subscriber missed
 }
 
 func newEventHub(maxHistory int) *eventHub {
@@ -19,20 +25,26 @@ func newEventHub(maxHistory int) *eventHub {
 	}
 }
 
+// publish records ev in the history and sends it to subscribers. The client
+// address strings are only built when there is a subscriber, or when the
+// history is read, so publishing does not allocate.
 func (h *eventHub) publish(ev RequestEvent) {
 	h.mu.Lock()
-	if h.maxHistory > 0 {
+	if len(h.history) < h.maxHistory {
 		h.history = append(h.history, ev)
-		if len(h.history) > h.maxHistory {
-			copy(h.history, h.history[len(h.history)-h.maxHistory:])
-			h.history = h.history[:h.maxHistory]
-		}
+	} else {
+		h.history[h.next] = ev
+		h.next = (h.next + 1) % h.maxHistory
+	}
+	if len(h.subscribers) > 0 {
+		ev.fillClient()
 	}
 	for ch := range h.subscribers {
 		select {
 		case ch <- ev:
 		default:
 			// Drop if subscriber is slow.
+			h.dropped.Add(1)
 		}
 	}
 	h.mu.Unlock()
@@ -61,7 +73,11 @@ func (h *eventHub) subscribe(buffer int) (<-chan RequestEvent, func()) {
 func (h *eventHub) snapshotHistory() []RequestEvent {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	out := make([]RequestEvent, len(h.history))
-	copy(out, h.history)
+	out := make([]RequestEvent, 0, len(h.history))
+	out = append(out, h.history[h.next:]...)
+	out = append(out, h.history[:h.next]...)
+	for i := range out {
+		out[i].fillClient()
+	}
 	return out
 }
@@ -0,0 +1,132 @@
+package ntpserver
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Extension field types used by this package.
+// NTS types are defined in RFC 8915, section 5.
+const (
+	ExtUniqueIdentifier     uint16 = 0x0104
+	ExtNTSCookie            uint16 = 0x0204
+	ExtNTSCookiePlaceholder uint16 = 0x0304
+	ExtNTSAuthenticator     uint16 = 0x0404
+)
+
+const (
+	// extHeaderLen is the size of the type and length words.
+	extHeaderLen = 4
+	// extMinLen is the smallest legal extension field (RFC 7822, section 3).
+	extMinLen = 16
+	// extLastMinLen is the smallest last extension field of a packet without
+	// a MAC, so that it cannot be taken for one (RFC 7822, section 7.5).
+	extLastMinLen = 28
+	// extMaxLen is the largest field the 16-bit length word can describe
+	// that is still a multiple of 4 bytes.
+	extMaxLen = 0xfffc
+)
+
+// ErrExtensionTooLong is returned by Packet.MarshalTo for an extension field
+// whose padded length does not fit the 16-bit length word.
+var ErrExtensionTooLong = errors.New("ntpserver: extension field too long")
+
+var (
+	errExtTruncated = errors.New("ntpserver: truncated extension field")
+	errExtLength    = errors.New("ntpserver: invalid extension field length")
+)
+
+// ExtensionField is a single NTPv4 extension field (RFC 7822).
+//
+// Value holds the field body without the type/length header. When marshaled,
+// the body is zero-padded to a multiple of 4 bytes and to the 16-byte minimum
+// field size, or 28 bytes for the last field of a packet without a MAC;
+// parsed values keep any padding that was on the wire, so a parsed
+// field marshals back to the same bytes.
+type ExtensionField struct {
+	Type  uint16
+	Value []byte
+}
+
+// Len returns the on-wire length of the field, including header and padding,
+// when it is not the last field of a packet without a MAC.
+func (e ExtensionField) Len() int {
+	return e.paddedLen(extMinLen)
+}
+
+// paddedLen returns the on-wire length of the field when it is padded to at
+// least minLen bytes.
+func (e ExtensionField) paddedLen(minLen int) int {
+	n := extHeaderLen + len(e.Value)
+	if r := n % 4; r != 0 {
+		n += 4 - r
+	}
+	return max(n, minLen)
+}
+
+// appendTo appends the encoded field to b.
+func (e ExtensionField) appendTo(b []byte) []byte {
+	return e.appendPadded(b, extMinLen)
+}
+
+// appendPadded appends the encoded field to b, padded to at least minLen
+// bytes. The padded length must not exceed extMaxLen.
+func (e ExtensionField) appendPadded(b []byte, minLen int) []byte {
+	n := e.paddedLen(minLen)
+	var hdr [extHeaderLen]byte
+	binary.BigEndian.PutUint16(hdr[0:2], e.Type)
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(n))
+	b = append(b, hdr[:]...)
+	b = append(b, e.Value...)
+	for i := extHeaderLen + len(e.Value); i < n; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// isMACTrailer reports whether the remaining bytes after the header or an
+// extension field have the size of a legacy MAC (key ID plus MD5/SHA-1/CMAC
+// digest) or of a crypto-NAK, following the heuristic of RFC 7822, section 7.5.
+func isMACTrailer(n int) bool {
+	return n == 4 || n == 20 || n == 24
+}
+
+// parseExtensions splits b (the bytes following the 48-byte header) into
+// extension fields. It returns the parsed fields and the number of bytes
+// consumed; any remaining bytes form the MAC trailer.
+func parseExtensions(b []byte) ([]ExtensionField, int, error) {
+	var out []ExtensionField
+	off := 0
+	for off < len(b) {
+		rest := len(b) - off
+		if isMACTrailer(rest) {
+			break
+		}
+		if rest < extMinLen {
+			return nil, 0, errExtTruncated
+		}
+		typ := binary.BigEndian.Uint16(b[off : off+2])
+		n := int(binary.BigEndian.Uint16(b[off+2 : off+4]))
+		if n < extMinLen || n%4 != 0 {
+			return nil, 0, errExtLength
+		}
+		if n > rest {
+			return nil, 0, errExtTruncated
+		}
+		val := make([]byte, n-extHeaderLen)
+		copy(val, b[off+extHeaderLen:off+n])
+		out = append(out, ExtensionField{Type: typ, Value: val})
+		off += n
+	}
+	return out, off, nil
+}
+
+// Extension returns the first extension field of the given type.
+func (p Packet) Extension(typ uint16) (ExtensionField, bool) {
+	for _, e := range p.Extensions {
+		if e.Type == typ {
+			return e, true
+		}
+	}
+	return ExtensionField{}, false
+}
@@ -0,0 +1,38 @@
+package ntpserver
+
+import "time"
+
+// fakeWriter is the replyWriter tests hand to handlePacket. It counts the
+// replies in n and keeps a copy of each in sent; with countOnly it only
+// counts, so writing does not allocate, and with err set every write fails.
+type fakeWriter struct {
+	err       error
+	countOnly bool
+	n         int
+	sent      [][]byte
+}
+
+func (w *fakeWriter) writeTo(b []byte, to remote) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.n++
+	if !w.countOnly {
+		w.sent = append(w.sent, append([]byte(nil), b...))
+	}
+	return nil
+}
+func (w *fakeWriter) afterSend(r sentReply) {}
+func (w *fakeWriter) recycle(bp *[]byte)    { replyBufs.Put(bp) }
+
+// testWorker returns a worker of a listener on 127.0.0.1:123 that has no
+// socket, for calling handlePacket directly.
+func testWorker() *worker {
+	return &worker{l: &listener{local: "127.0.0.1:123"}}
+}
+
+// handle passes b from from to srv as a fresh testWorker that read it at now
+// would, answering through rw.
+func handle(srv *Server, rw replyWriter, b []byte, from remote, now time.Time) RequestEvent {
+	return srv.handlePacket(testWorker(), rw, b, from, now, TimestampUser)
+}
@@ -0,0 +1,125 @@
+package ntpserver
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// interleaveEntry is the state kept per client for interleaved basic mode:
+// the receive timestamp of the client's last request and the time the reply
+// to it actually left.
+type interleaveEntry struct {
+	ip    netip.Addr
+	rx    Timestamp
+	tx    Timestamp
+	txSrc string // timestamp source of tx
+	seen  time.Time
+}
+
+// interleaveTable is a bounded, least-recently-used table of interleaveEntry
+// keyed by client IP. Entries idle for longer than ttl expire.
+type interleaveTable struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	entries map[netip.Addr]*list.Element
+	lru     *list.List // front is most recently stored
+}
+
+func newInterleaveTable(max int, ttl time.Duration) *interleaveTable {
+	return &interleaveTable{
+		max:     max,
+		ttl:     ttl,
+		entries: make(map[netip.Addr]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// lookup returns the transmit time of the previous reply to ip when origin
+// echoes that reply's receive timestamp, which is how a client asks for an
+// interleaved response. The source of the transmit timestamp is returned too.
+func (t *interleaveTable) lookup(ip netip.Addr, origin Timestamp, now time.Time) (Timestamp, string, bool) {
+	if !ip.IsValid() || origin == 0 {
+		return 0, "", false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el := t.entries[ip]
+	if el == nil {
+		return 0, "", false
+	}
+	e := el.Value.(*interleaveEntry)
+	if now.Sub(e.seen) > t.ttl || e.rx != origin || e.tx == 0 {
+		return 0, "", false
+	}
+	return e.tx, e.txSrc, true
+}
+
+// store records the receive timestamp of a reply to ip and when it was sent.
+func (t *interleaveTable) store(ip netip.Addr, rx, tx Timestamp, src string, now time.Time) {
+	if !ip.IsValid() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el := t.entries[ip]; el != nil {
+		e := el.Value.(*interleaveEntry)
+		if e.rx != rx || !betterTimestampSource(e.txSrc, src) {
+			e.tx, e.txSrc = tx, src
+		}
+		e.rx, e.seen = rx, now
+		t.lru.MoveToFront(el)
+	} else {
+		t.entries[ip] = t.lru.PushFront(&interleaveEntry{ip: ip, rx: rx, tx: tx, txSrc: src, seen: now})
+	}
+	for {
+		el := t.lru.Back()
+		if el == nil {
+			return
+		}
+		e := el.Value.(*interleaveEntry)
+		if t.lru.Len() <= t.max && now.Sub(e.seen) <= t.ttl {
+			return
+		}
+		t.lru.Remove(el)
+		delete(t.entries, e.ip)
+	}
+}
+
+// updateTx replaces the transmit time of the reply to ip identified by rx
+// with a more accurate one, such as a kernel transmit timestamp.
+func (t *interleaveTable) updateTx(ip netip.Addr, rx, tx Timestamp, src string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el := t.entries[ip]
+	if el == nil {
+		return
+	}
+	e := el.Value.(*interleaveEntry)
+	if e.rx != rx || betterTimestampSource(e.txSrc, src) {
+		return
+	}
+	e.tx, e.txSrc = tx, src
+}
+
+// betterTimestampSource reports whether a is more accurate than b.
+func betterTimestampSource(a, b string) bool {
+	rank := func(s string) int {
+		switch s {
+		case TimestampKernelHW:
+			return 2
+		case TimestampKernelSW:
+			return 1
+		}
+		return 0
+	}
+	return rank(a) > rank(b)
+}
+
+func (t *interleaveTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lru.Len()
+}
@@ -0,0 +1,116 @@
+package ntpserver
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestInterleaveTable_BoundedAndExpiring(t *testing.T) {
+	tab := newInterleaveTable(2, time.Minute)
+	t0 := time.Unix(1000, 0)
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	c, d := netip.MustParseAddr("192.0.2.3"), netip.MustParseAddr("2001:db8::4")
+	tab.store(a, 1, 10, TimestampUser, t0)
+	tab.store(b, 2, 20, TimestampUser, t0)
+	tab.store(a, 3, 30, TimestampUser, t0.Add(time.Second))
+	tab.store(c, 4, 40, TimestampUser, t0.Add(2*time.Second))
+
+	if n := tab.len(); n != 2 {
+		t.Fatalf("len: got=%d want=2", n)
+	}
+	if _, _, ok := tab.lookup(b, 2, t0.Add(2*time.Second)); ok {
+		t.Fatalf("least recently used entry should have been evicted")
+	}
+	if tx, _, ok := tab.lookup(a, 3, t0.Add(2*time.Second)); !ok || tx != 30 {
+		t.Fatalf("lookup a: tx=%d ok=%v", tx, ok)
+	}
+	if _, _, ok := tab.lookup(a, 1, t0.Add(2*time.Second)); ok {
+		t.Fatalf("stale receive timestamp must not match")
+	}
+	if _, _, ok := tab.lookup(c, 4, t0.Add(2*time.Minute)); ok {
+		t.Fatalf("expired entry must not match")
+	}
+	tab.store(d, 5, 50, TimestampUser, t0.Add(3*time.Minute))
+	if n := tab.len(); n != 1 {
+		t.Fatalf("expired entries should be dropped on store: len=%d", n)
+	}
+}
+
+func TestInterleaveTable_UpdateTx(t *testing.T) {
+	tab := newInterleaveTable(4, time.Minute)
+	t0 := time.Unix(1000, 0)
+	a := netip.MustParseAddr("192.0.2.1")
+	tab.store(a, 1, 10, TimestampUser, t0)
+
+	tab.updateTx(a, 2, 99, TimestampKernelSW)
+	if tx, _, _ := tab.lookup(a, 1, t0); tx != 10 {
+		t.Fatalf("update for another reply must be ignored: tx=%d", tx)
+	}
+	tab.updateTx(a, 1, 11, TimestampKernelHW)
+	tab.updateTx(a, 1, 12, TimestampKernelSW)
+	if tx, src, _ := tab.lookup(a, 1, t0); tx != 11 || src != TimestampKernelHW {
+		t.Fatalf("hardware timestamp must not be downgraded: tx=%d src=%s", tx, src)
+	}
+	// Storing the same reply again keeps the kernel timestamp.
+	tab.store(a, 1, 13, TimestampUser, t0)
+	if tx, src, _ := tab.lookup(a, 1, t0); tx != 11 || src != TimestampKernelHW {
+		t.Fatalf("store must keep better timestamp: tx=%d src=%s", tx, src)
+	}
+}
+
+func TestServer_InterleavedResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", Interleaved: true})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	c := dialServer(t, srv)
+	defer c.Close()
+	exchange := func(req Packet) (Packet, RequestEvent) {
+		t.Helper()
+		if _, err := c.Write(req.Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		resp, ok := readPacket(t, c, time.Second)
+		if !ok {
+			t.Fatalf("no response")
+		}
+		return resp, waitForEvent(t, events, ModeClient)
+	}
+
+	first, ev := exchange(Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())})
+	if ev.Interleaved {
+		t.Fatalf("first exchange must be basic mode")
+	}
+	localRx := timeToTimestamp(time.Now())
+
+	// Echo the server's receive timestamp as origin to ask for interleaving.
+	req := Packet{VN: 4, Mode: ModeClient, Originate: first.Receive, Receive: localRx, Transmit: timeToTimestamp(time.Now())}
+	second, ev := exchange(req)
+	if !ev.Interleaved {
+		t.Fatalf("second exchange should be interleaved")
+	}
+	if second.Originate != localRx {
+		t.Fatalf("interleaved origin: got=%x want=%x", second.Originate, localRx)
+	}
+	// The transmit timestamp is when the first reply left: after the
+	// timestamp written into it, before the second request arrived.
+	if second.Transmit < first.Transmit || second.Transmit > second.Receive {
+		t.Fatalf("interleaved transmit %x not in [%x, %x]", second.Transmit, first.Transmit, second.Receive)
+	}
+
+	// A basic-mode origin (the server's transmit timestamp) gets a basic reply.
+	req = Packet{VN: 4, Mode: ModeClient, Originate: second.Transmit, Transmit: timeToTimestamp(time.Now())}
+	third, ev := exchange(req)
+	if ev.Interleaved || third.Originate != req.Transmit {
+		t.Fatalf("basic reply expected: interleaved=%v origin=%x", ev.Interleaved, third.Originate)
+	}
+}
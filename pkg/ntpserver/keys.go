@@ -0,0 +1,249 @@
+package ntpserver
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Symmetric key digest types (RFC 5905 legacy MD5, SHA-1, and AES-CMAC per RFC 8573).
+const (
+	KeyTypeMD5        = "MD5"
+	KeyTypeSHA1       = "SHA1"
+	KeyTypeAES128CMAC = "AES128CMAC"
+)
+
+var (
+	ErrKeyID      = errors.New("ntpserver: key ID must be non-zero")
+	ErrKeyType    = errors.New("ntpserver: unsupported key type")
+	ErrKeyLength  = errors.New("ntpserver: invalid key length")
+	ErrKeyMissing = errors.New("ntpserver: unknown key")
+)
+
+// SymmetricKey is a single shared secret. Only trusted keys authenticate requests.
+type SymmetricKey struct {
+	ID      uint32
+	Type    string
+	Secret  []byte
+	Trusted bool
+}
+
+// KeyStats are the per-key usage counters.
+type KeyStats struct {
+	ID       uint32 `json:"id"`
+	Type     string `json:"type"`
+	Trusted  bool   `json:"trusted"`
+	Verified uint64 `json:"verified"`
+	Failed   uint64 `json:"failed"`
+	Signed   uint64 `json:"signed"`
+}
+
+type keyEntry struct {
+	key     SymmetricKey
+	cmac    *cmac
+	trusted atomic.Bool
+
+	verified atomic.Uint64
+	failed   atomic.Uint64
+	signed   atomic.Uint64
+}
+
+// Keyring holds the symmetric keys used to verify and sign packets.
+// It is safe for concurrent use.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys map[uint32]*keyEntry
+}
+
+func NewKeyring(keys ...SymmetricKey) (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint32]*keyEntry)}
+	for _, key := range keys {
+		if err := k.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Add installs or replaces a key.
+func (k *Keyring) Add(key SymmetricKey) error {
+	if key.ID == 0 {
+		return ErrKeyID
+	}
+	e := &keyEntry{key: key}
+	e.key.Type = strings.ToUpper(key.Type)
+	e.key.Secret = append([]byte(nil), key.Secret...)
+	switch e.key.Type {
+	case KeyTypeMD5, KeyTypeSHA1:
+		if len(key.Secret) == 0 {
+			return ErrKeyLength
+		}
+	case KeyTypeAES128CMAC:
+		if len(key.Secret) != 16 {
+			return ErrKeyLength
+		}
+		c, err := newCMAC(key.Secret)
+		if err != nil {
+			return err
+		}
+		e.cmac = c
+	default:
+		return ErrKeyType
+	}
+	e.trusted.Store(key.Trusted)
+
+	k.mu.Lock()
+	k.keys[key.ID] = e
+	k.mu.Unlock()
+	return nil
+}
+
+// SetTrusted changes the trusted flag of a key.
+func (k *Keyring) SetTrusted(id uint32, trusted bool) error {
+	e := k.lookup(id)
+	if e == nil {
+		return ErrKeyMissing
+	}
+	e.trusted.Store(trusted)
+	return nil
+}
+
+// Stats returns the per-key counters ordered by key ID.
+func (k *Keyring) Stats() []KeyStats {
+	k.mu.RLock()
+	out := make([]KeyStats, 0, len(k.keys))
+	for _, e := range k.keys {
+		out = append(out, KeyStats{
+			ID:       e.key.ID,
+			Type:     e.key.Type,
+			Trusted:  e.trusted.Load(),
+			Verified: e.verified.Load(),
+			Failed:   e.failed.Load(),
+			Signed:   e.signed.Load(),
+		})
+	}
+	k.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (k *Keyring) lookup(id uint32) *keyEntry {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[id]
+}
+
+func (e *keyEntry) digest(data []byte) []byte {
+	switch e.key.Type {
+	case KeyTypeMD5:
+		h := md5.New()
+		h.Write(e.key.Secret)
+		h.Write(data)
+		return h.Sum(nil)
+	case KeyTypeSHA1:
+		h := sha1.New()
+		h.Write(e.key.Secret)
+		h.Write(data)
+		return h.Sum(nil)
+	default:
+		sum := e.cmac.sum(data)
+		return sum[:]
+	}
+}
+
+// verify checks mac over data. It returns the matching key on success.
+func (k *Keyring) verify(data []byte, mac *MAC) (*keyEntry, bool) {
+	e := k.lookup(mac.KeyID)
+	if e == nil {
+		return nil, false
+	}
+	if !e.trusted.Load() || subtle.ConstantTimeCompare(e.digest(data), mac.Digest) != 1 {
+		e.failed.Add(1)
+		return e, false
+	}
+	e.verified.Add(1)
+	return e, true
+}
+
+// sign computes the MAC trailer for data.
+func (e *keyEntry) sign(data []byte) *MAC {
+	e.signed.Add(1)
+	return &MAC{KeyID: e.key.ID, Digest: e.digest(data)}
+}
+
+// LoadKeyFile reads an ntpd-style ntp.keys file. See ParseKeys.
+func LoadKeyFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return ParseKeys(f)
+}
+
+// ParseKeys parses ntp.keys lines of the form "keyid type key", with '#'
+// comments. As in ntpd, keys of up to 20 characters are ASCII and longer keys
+// are hex; chrony-style "ASCII:" and "HEX:" prefixes are also accepted. Type
+// "M" is an alias for MD5. Keys loaded from a file are trusted.
+func ParseKeys(r io.Reader) (*Keyring, error) {
+	k, _ := NewKeyring()
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("ntpserver: keys line %d: expected \"keyid type key\"", line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("ntpserver: keys line %d: bad key ID: %w", line, err)
+		}
+		typ := strings.ToUpper(fields[1])
+		if typ == "M" {
+			typ = KeyTypeMD5
+		}
+		secret, err := decodeKeySecret(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("ntpserver: keys line %d: %w", line, err)
+		}
+		if err := k.Add(SymmetricKey{ID: uint32(id), Type: typ, Secret: secret, Trusted: true}); err != nil {
+			return nil, fmt.Errorf("ntpserver: keys line %d: %w", line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func decodeKeySecret(s string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(s, "ASCII:"):
+		return []byte(s[len("ASCII:"):]), nil
+	case strings.HasPrefix(s, "HEX:"):
+		return hex.DecodeString(s[len("HEX:"):])
+	case len(s) <= 20:
+		return []byte(s), nil
+	default:
+		return hex.DecodeString(s)
+	}
+}
@@ -0,0 +1,173 @@
+package ntpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeys_NtpdFormat(t *testing.T) {
+	kr, err := ParseKeys(strings.NewReader(`
+# ntp.keys
+1 M secret1
+2 MD5 HEX:0102030405
+3 SHA1 0123456789abcdef0123456789abcdef01234567   # 40 hex chars
+4 AES128CMAC 000102030405060708090a0b0c0d0e0f
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	stats := kr.Stats()
+	if len(stats) != 4 {
+		t.Fatalf("keys: got=%d want=4", len(stats))
+	}
+	want := []string{KeyTypeMD5, KeyTypeMD5, KeyTypeSHA1, KeyTypeAES128CMAC}
+	for i, st := range stats {
+		if st.ID != uint32(i+1) || st.Type != want[i] || !st.Trusted {
+			t.Fatalf("key %d: got=%+v", i+1, st)
+		}
+	}
+	if e := kr.lookup(1); string(e.key.Secret) != "secret1" {
+		t.Fatalf("ascii secret: got=%q", e.key.Secret)
+	}
+	if e := kr.lookup(3); len(e.key.Secret) != 20 {
+		t.Fatalf("hex secret len: got=%d want=20", len(e.key.Secret))
+	}
+}
+
+func TestParseKeys_Errors(t *testing.T) {
+	for _, in := range []string{
+		"1 MD5",
+		"x MD5 secret",
+		"0 MD5 secret",
+		"1 BLAKE secret",
+		"1 AES128CMAC short",
+	} {
+		if _, err := ParseKeys(strings.NewReader(in)); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func TestKeyring_MD5Digest(t *testing.T) {
+	kr, _ := NewKeyring(SymmetricKey{ID: 7, Type: "md5", Secret: []byte("k"), Trusted: true})
+	data := []byte("packet")
+	mac := kr.lookup(7).sign(data)
+
+	sum := md5.Sum([]byte("kpacket"))
+	if mac.KeyID != 7 || !bytes.Equal(mac.Digest, sum[:]) {
+		t.Fatalf("digest: got=%x want=%x", mac.Digest, sum)
+	}
+	if _, ok := kr.verify(data, mac); !ok {
+		t.Fatalf("expected verify ok")
+	}
+	if err := kr.SetTrusted(7, false); err != nil {
+		t.Fatalf("set trusted: %v", err)
+	}
+	if _, ok := kr.verify(data, mac); ok {
+		t.Fatalf("untrusted key must not verify")
+	}
+	st := kr.Stats()[0]
+	if st.Verified != 1 || st.Failed != 1 || st.Signed != 1 {
+		t.Fatalf("counters: %+v", st)
+	}
+}
+
+func TestServer_SymmetricKeyAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kr, err := NewKeyring(SymmetricKey{ID: 42, Type: KeyTypeAES128CMAC, Secret: bytes.Repeat([]byte{9}, 16), Trusted: true})
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", Keys: kr})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	raddr, _ := net.ResolveUDPAddr("udp4", srv.Addr())
+	c, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+
+	exchange := func(req Packet) Packet {
+		t.Helper()
+		if _, err := c.Write(req.Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		resp, ok := ParsePacket(buf[:n])
+		if !ok {
+			t.Fatalf("parse response")
+		}
+		if resp.MAC != nil && !resp.MAC.IsCryptoNAK() {
+			hdr := buf[:n-resp.MAC.Len()]
+			if _, ok := kr.verify(hdr, resp.MAC); !ok {
+				t.Fatalf("response MAC does not verify")
+			}
+		}
+		return resp
+	}
+
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}
+	req.MAC = kr.lookup(42).sign(req.Marshal())
+	resp := exchange(req)
+	if resp.MAC == nil || resp.MAC.KeyID != 42 {
+		t.Fatalf("expected signed response, got MAC=%+v", resp.MAC)
+	}
+
+	req.Transmit++
+	req.MAC = &MAC{KeyID: 42, Digest: make([]byte, 16)}
+	resp = exchange(req)
+	if !resp.MAC.IsCryptoNAK() {
+		t.Fatalf("expected crypto-NAK, got MAC=%+v", resp.MAC)
+	}
+
+	m := srv.Metrics()
+	if len(m.Keys) != 1 || m.Keys[0].Failed != 1 || m.Keys[0].Signed < 1 {
+		t.Fatalf("key metrics: %+v", m.Keys)
+	}
+}
+
+func TestServer_CryptoNAKCountedAsError(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	kr, err := NewKeyring(SymmetricKey{ID: 42, Type: KeyTypeMD5, Secret: []byte("secret"), Trusted: true})
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	srv := New(Config{Clock: fixedClock{t: now}, Keys: kr})
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}
+	req.MAC = &MAC{KeyID: 42, Digest: make([]byte, 16)}
+
+	w := testWorker()
+	rw := &fakeWriter{}
+	ev := srv.handlePacket(w, rw, req.Marshal(), remote{ap: netip.MustParseAddrPort("192.0.2.1:123")}, now, TimestampUser)
+	w.count(ev)
+	if !ev.Responded || ev.Error != "auth_failed" || len(rw.sent) != 1 {
+		t.Fatalf("event: %+v sent=%d", ev, len(rw.sent))
+	}
+	if resp, ok := ParsePacket(rw.sent[0]); !ok || !resp.MAC.IsCryptoNAK() {
+		t.Fatalf("expected crypto-NAK: ok=%v", ok)
+	}
+	m := srv.Metrics()
+	if m.TotalResponses != 0 || m.TotalErrors != 1 || m.ErrorsByReason["auth_failed"] != 1 {
+		t.Fatalf("responses=%d errors=%d by reason=%v", m.TotalResponses, m.TotalErrors, m.ErrorsByReason)
+	}
+	if ws := w.snapshot(); ws.Responses != 0 || ws.Errors != 1 {
+		t.Fatalf("worker: %+v", ws)
+	}
+}
@@ -0,0 +1,64 @@
+package ntpserver
+
+import (
+	"strings"
+	"time"
+)
+
+// Kiss codes (RFC 5905, section 7.4) sent by this server.
+const (
+	KissRATE = "RATE"
+	KissDENY = "DENY"
+	KissRSTR = "RSTR"
+)
+
+const kissDropPrefix = "kod:"
+
+// Drop reasons a PacketHook can return to have the request answered with the
+// matching Kiss-o'-Death (when Config.KoD is enabled) instead of a silent drop.
+const (
+	DropKoDRate     = kissDropPrefix + KissRATE
+	DropKoDDeny     = kissDropPrefix + KissDENY
+	DropKoDRestrict = kissDropPrefix + KissRSTR
+)
+
+// KissDrop returns a hook drop reason that asks for a Kiss-o'-Death with an
+// arbitrary four-letter code.
+func KissDrop(code string) string {
+	return kissDropPrefix + code
+}
+
+// kissCodeFromDrop extracts the kiss code from a hook drop reason.
+func kissCodeFromDrop(reason string) (string, bool) {
+	code, ok := strings.CutPrefix(reason, kissDropPrefix)
+	if !ok || code == "" || len(code) > 4 {
+		return "", false
+	}
+	return code, true
+}
+
+// sendKissOfDeath answers req with a kiss code if KoD is enabled, by
+// Config.KoD or the client's RestrictKoD, and the per-client KoD budget
+// allows it. The poll exponent is raised to at least
+// Config.KoDMinPoll so that clients back off.
+func (s *Server) sendKissOfDeath(conn replyWriter, to remote, req Packet, code string, flags RestrictFlags, ev *RequestEvent) {
+	live := s.live.Load()
+	if !live.cfg.KoD && flags&RestrictKoD == 0 {
+		return
+	}
+	if !live.kodLimiter.allow(to.ip(), time.Now()) {
+		s.metrics.incKoDSuppressed()
+		return
+	}
+	resp := BuildKissOfDeath(req, code)
+	if resp.Poll < live.cfg.KoDMinPoll {
+		resp.Poll = live.cfg.KoDMinPoll
+	}
+	if err := conn.writeTo(resp.Marshal(), to); err != nil {
+		return
+	}
+	// Like a NAK, a kiss is counted under the caller's error only.
+	s.metrics.incKoDSent()
+	ev.Responded = true
+	ev.Kiss = code
+}
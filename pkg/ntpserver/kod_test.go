@@ -0,0 +1,169 @@
+package ntpserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBuildKissOfDeath_Fields(t *testing.T) {
+	req := Packet{VN: 3, Mode: ModeClient, Poll: 6, Transmit: Timestamp(0x1122334455667788)}
+	resp := BuildKissOfDeath(req, KissRATE)
+
+	if resp.Stratum != 0 || resp.LI != 3 || resp.Mode != ModeServer || resp.VN != 3 {
+		t.Fatalf("header: got=%+v", resp)
+	}
+	if resp.RefID != refIDFromASCII4("RATE") {
+		t.Fatalf("refid: got=%08x", resp.RefID)
+	}
+	if resp.Originate != req.Transmit || resp.Receive != req.Transmit || resp.Transmit != req.Transmit {
+		t.Fatalf("timestamps must echo the client transmit time: %+v", resp)
+	}
+}
+
+func TestKissCodeFromDrop(t *testing.T) {
+	if code, ok := kissCodeFromDrop(DropKoDDeny); !ok || code != KissDENY {
+		t.Fatalf("deny: got=%q ok=%v", code, ok)
+	}
+	if code, ok := kissCodeFromDrop(KissDrop("XMPL")); !ok || code != "XMPL" {
+		t.Fatalf("custom: got=%q ok=%v", code, ok)
+	}
+	for _, r := range []string{"blocked", "kod:", "kod:TOOLONG"} {
+		if _, ok := kissCodeFromDrop(r); ok {
+			t.Fatalf("unexpected kiss code for %q", r)
+		}
+	}
+}
+
+func dialServer(t testing.TB, srv *Server) *net.UDPConn {
+	t.Helper()
+	raddr, err := net.ResolveUDPAddr("udp", srv.Addr())
+	if err != nil {
+		t.Fatalf("resolve server addr: %v", err)
+	}
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return c
+}
+
+func readPacket(t testing.TB, c *net.UDPConn, wait time.Duration) (Packet, bool) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, 2048)
+	n, err := c.Read(buf)
+	if err != nil {
+		return Packet{}, false
+	}
+	p, ok := ParsePacket(buf[:n])
+	if !ok {
+		t.Fatalf("parse response")
+	}
+	return p, true
+}
+
+func TestServer_KoDRateLimited(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{
+		ListenAddr:         "127.0.0.1:0",
+		Network:            "udp4",
+		RateLimitPerSecond: 0.001,
+		RateLimitBurst:     1,
+		KoD:                true,
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	c := dialServer(t, srv)
+	defer func() { _ = c.Close() }()
+
+	send := func(tx Timestamp) {
+		req := Packet{VN: 4, Mode: ModeClient, Poll: 4, Transmit: tx}
+		if _, err := c.Write(req.Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	send(1)
+	if resp, ok := readPacket(t, c, 2*time.Second); !ok || resp.Stratum == 0 {
+		t.Fatalf("expected a normal first response")
+	}
+
+	send(2)
+	resp, ok := readPacket(t, c, 2*time.Second)
+	if !ok {
+		t.Fatalf("expected a KoD for the rate-limited request")
+	}
+	if resp.Stratum != 0 || resp.RefID != refIDFromASCII4(KissRATE) {
+		t.Fatalf("expected RATE kiss, got stratum=%d refid=%08x", resp.Stratum, resp.RefID)
+	}
+	if resp.Originate != 2 {
+		t.Fatalf("originate: got=%d want=2", resp.Originate)
+	}
+	if resp.Poll != 10 {
+		t.Fatalf("poll: got=%d want=10", resp.Poll)
+	}
+
+	// The KoD budget (burst 1) is spent: the next limited request is dropped silently.
+	send(3)
+	if _, ok := readPacket(t, c, 250*time.Millisecond); ok {
+		t.Fatalf("expected KoD to be suppressed")
+	}
+
+	m := srv.Metrics()
+	if m.KoDSent != 1 || m.KoDSuppressed != 1 {
+		t.Fatalf("kod metrics: sent=%d suppressed=%d", m.KoDSent, m.KoDSuppressed)
+	}
+	// Like a NAK, the kiss counts as an error only.
+	if m.TotalResponses != 1 || m.TotalErrors != 2 {
+		t.Fatalf("responses=%d errors=%d, want 1 and 2", m.TotalResponses, m.TotalErrors)
+	}
+}
+
+func TestServer_HookPicksKissCode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Network:    "udp4",
+		KoD:        true,
+		Hook: func(Packet, RequestMeta) string {
+			return DropKoDDeny
+		},
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	evCh, unsub := srv.Subscribe()
+	defer unsub()
+
+	c := dialServer(t, srv)
+	defer func() { _ = c.Close() }()
+
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}
+	if _, err := c.Write(req.Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	resp, ok := readPacket(t, c, 2*time.Second)
+	if !ok || resp.RefID != refIDFromASCII4(KissDENY) {
+		t.Fatalf("expected DENY kiss, got ok=%v refid=%08x", ok, resp.RefID)
+	}
+
+	select {
+	case ev := <-evCh:
+		if ev.Error != DropKoDDeny || ev.Kiss != KissDENY || !ev.Responded {
+			t.Fatalf("event: %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for event")
+	}
+}
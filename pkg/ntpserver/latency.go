@@ -0,0 +1,189 @@
+package ntpserver
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyMetrics summarizes a latency histogram. Quantiles are the upper
+// bound of the bucket they fall in, at most 12.5% above the true value and
+// never above Max.
+type LatencyMetrics struct {
+	Count uint64        `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// Durations below histSub nanoseconds get a bucket each; above, every power
+// of two is split into histSub buckets.
+const (
+	histSubBits = 3
+	histSub     = 1 << histSubBits
+	histBuckets = (64 - histSubBits + 1) * histSub
+)
+
+// latencyHistogram is a log-linear histogram of durations that can be
+// updated from any goroutine without locks or allocation.
+//
+// Observations go to the hot one of two shards. A snapshot makes the other
+// shard hot, waits for the observations still writing to the old one and
+// then reads it, so every observation is in exactly one snapshot or reset.
+type latencyHistogram struct {
+	// hotAndCount holds the index of the hot shard in its top bit and the
+	// number of observations started in the others.
+	hotAndCount atomic.Uint64
+	shards      [2]histShard
+	mu          sync.Mutex // serializes snapshots
+
+	// clearedCount and clearedSum total the observations snapshots cleared,
+	// under mu, for cumulative.
+	clearedCount uint64
+	clearedSum   time.Duration
+}
+
+type histShard struct {
+	buckets [histBuckets]atomic.Uint64
+	sum     atomic.Int64
+	max     atomic.Int64
+	// done counts the observations finished in this shard, plus those of
+	// the other shard up to the last snapshot.
+	done atomic.Uint64
+}
+
+func histBucket(ns uint64) int {
+	if ns < histSub {
+		return int(ns)
+	}
+	e := bits.Len64(ns) - 1
+	return (e-histSubBits+1)*histSub + int(ns>>(e-histSubBits)&(histSub-1))
+}
+
+// histUpper is the largest duration, in nanoseconds, that falls in bucket i.
+func histUpper(i int) uint64 {
+	if i < histSub {
+		return uint64(i)
+	}
+	e := i/histSub + histSubBits - 1
+	lower := uint64(histSub+i%histSub) << (e - histSubBits)
+	return lower + 1<<(e-histSubBits) - 1
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	sh := &h.shards[h.hotAndCount.Add(1)>>63]
+	sh.buckets[histBucket(uint64(d))].Add(1)
+	sh.sum.Add(int64(d))
+	storeMax(&sh.max, int64(d))
+	sh.done.Add(1)
+}
+
+func storeMax(m *atomic.Int64, v int64) {
+	for {
+		old := m.Load()
+		if v <= old || m.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+// snapshot summarizes the histogram and, with reset, clears it.
+func (h *latencyHistogram) snapshot(reset bool) LatencyMetrics {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := h.snapshotLocked(reset)
+	if reset {
+		h.clearedCount += out.Count
+		h.clearedSum += out.Sum
+	}
+	return out
+}
+
+// cumulative summarizes the histogram without clearing it. Count and Sum
+// include what earlier snapshots cleared, so they only grow until reset;
+// the quantiles and Max cover the observations since the last clear.
+func (h *latencyHistogram) cumulative() LatencyMetrics {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := h.snapshotLocked(false)
+	out.Count += h.clearedCount
+	out.Sum += h.clearedSum
+	return out
+}
+
+func (h *latencyHistogram) snapshotLocked(reset bool) LatencyMetrics {
+	n := h.hotAndCount.Add(1 << 63)
+	started := n &^ (1 << 63)
+	hot, cold := &h.shards[n>>63], &h.shards[^n>>63]
+	for cold.done.Load() != started {
+		runtime.Gosched()
+	}
+
+	var counts [histBuckets]uint64
+	var out LatencyMetrics
+	for i := range cold.buckets {
+		counts[i] = cold.buckets[i].Swap(0)
+		out.Count += counts[i]
+	}
+	out.Sum, out.Max = time.Duration(cold.sum.Swap(0)), time.Duration(cold.max.Swap(0))
+	hot.done.Add(cold.done.Swap(0))
+	if !reset {
+		// Carry the observations over to the shard that is now hot.
+		for i, c := range counts {
+			if c != 0 {
+				hot.buckets[i].Add(c)
+			}
+		}
+		hot.sum.Add(int64(out.Sum))
+		storeMax(&hot.max, int64(out.Max))
+	}
+	if out.Count == 0 {
+		return out
+	}
+	quantile := func(q float64) time.Duration {
+		rank := uint64(q*float64(out.Count-1)) + 1
+		var seen uint64
+		for i, n := range counts {
+			if seen += n; seen >= rank {
+				return min(time.Duration(histUpper(i)), out.Max)
+			}
+		}
+		return out.Max
+	}
+	out.P50, out.P90, out.P99 = quantile(0.5), quantile(0.9), quantile(0.99)
+	return out
+}
+
+// reset clears the histogram and the cleared totals of cumulative.
+func (h *latencyHistogram) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.snapshotLocked(true)
+	h.clearedCount, h.clearedSum = 0, 0
+}
+
+// observeLatency records how long ev took to process and, if it was
+// answered, the time from its receive timestamp until now, just after the
+// reply was written. Now is read from the clock the receive timestamp came
+// from: Config.Clock, or the system clock for kernel timestamps.
+func (s *Server) observeLatency(ev *RequestEvent, processing time.Duration) {
+	s.metrics.processing.observe(processing)
+	if !ev.Responded {
+		return
+	}
+	var sent time.Time
+	switch ev.TimestampSource {
+	case TimestampKernelSW, TimestampKernelHW:
+		sent = time.Now()
+	default:
+		sent = s.cfg.Clock.Now()
+	}
+	s.metrics.rxToTx.observe(sent.Sub(ev.At))
+}
@@ -0,0 +1,169 @@
+package ntpserver
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram_Buckets(t *testing.T) {
+	prev := -1
+	for _, ns := range []uint64{0, 1, 7, 8, 9, 15, 16, 17, 1000, 1023, 1024, 123456789, 1 << 40, 1<<63 - 1} {
+		i := histBucket(ns)
+		if i < prev || i >= histBuckets {
+			t.Fatalf("bucket(%d): got=%d after %d", ns, i, prev)
+		}
+		prev = i
+		if up := histUpper(i); up < ns || float64(up-ns) > float64(ns)/histSub {
+			t.Fatalf("upper bound of %d: got=%d", ns, up)
+		}
+		if i > 0 && histUpper(i-1) >= ns {
+			t.Fatalf("bucket below %d ends at %d", ns, histUpper(i-1))
+		}
+	}
+}
+
+func TestLatencyHistogram_Snapshot(t *testing.T) {
+	var h latencyHistogram
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Microsecond)
+	}
+	h.observe(-time.Second) // counted as 0
+
+	s := h.snapshot(false)
+	if s.Count != 101 || s.Max != 100*time.Microsecond {
+		t.Fatalf("count/max: got=%d/%v", s.Count, s.Max)
+	}
+	for _, q := range []struct {
+		name      string
+		got, want time.Duration
+	}{{"p50", s.P50, 50 * time.Microsecond}, {"p90", s.P90, 90 * time.Microsecond}, {"p99", s.P99, 99 * time.Microsecond}} {
+		if q.got < q.want || q.got > q.want+q.want/histSub {
+			t.Fatalf("%s: got=%v want=%v", q.name, q.got, q.want)
+		}
+	}
+	if s.P99 > s.Max {
+		t.Fatalf("p99 above max: %v > %v", s.P99, s.Max)
+	}
+
+	if s := h.snapshot(true); s.Count != 101 {
+		t.Fatalf("reset read: count=%d", s.Count)
+	}
+	if s := h.snapshot(false); s != (LatencyMetrics{}) {
+		t.Fatalf("after reset: got=%+v", s)
+	}
+
+	// cumulative keeps Count and Sum of what the reset cleared.
+	h.observe(time.Millisecond)
+	if c := h.cumulative(); c.Count != 102 || c.Sum != 5050*time.Microsecond+time.Millisecond || c.Max != time.Millisecond {
+		t.Fatalf("cumulative: got=%+v", c)
+	}
+	if s := h.snapshot(false); s.Count != 1 {
+		t.Fatalf("cumulative cleared the histogram: got=%+v", s)
+	}
+	h.reset()
+	if c := h.cumulative(); c != (LatencyMetrics{}) {
+		t.Fatalf("cumulative after reset: got=%+v", c)
+	}
+}
+
+func TestLatencyHistogram_ResetDuringObserve(t *testing.T) {
+	const workers, perWorker = 4, 20000
+	var h latencyHistogram
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				h.observe(time.Microsecond)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+
+	var total uint64
+	check := func(s LatencyMetrics) uint64 {
+		// Every observation is 1µs, so the count, sum and max of each
+		// summary agree unless an observation was split between two.
+		if s.Sum != time.Duration(s.Count)*time.Microsecond || (s.Count > 0) != (s.Max == time.Microsecond) {
+			t.Fatalf("inconsistent summary: %+v", s)
+		}
+		return s.Count
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		check(h.snapshot(false))
+		total += check(h.snapshot(true))
+	}
+	total += check(h.snapshot(true))
+	if total != workers*perWorker {
+		t.Fatalf("observations: got=%d want=%d", total, workers*perWorker)
+	}
+}
+
+func TestServer_Latency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4"})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	c := dialServer(t, srv)
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Write((&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}).Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, ok := readPacket(t, c, time.Second); !ok {
+			t.Fatalf("no response")
+		}
+	}
+	if _, err := c.Write([]byte{0x23}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// Requests are measured after their reply is written.
+	deadline := time.Now().Add(time.Second)
+	m := srv.Metrics()
+	for m.Processing.Count < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		m = srv.Metrics()
+	}
+	if m.Processing.Count != 4 || m.RxToTx.Count != 3 {
+		t.Fatalf("counts: processing=%d rx_to_tx=%d", m.Processing.Count, m.RxToTx.Count)
+	}
+	if m.Processing.Max <= 0 || m.RxToTx.Max <= 0 || m.RxToTx.Max > time.Second {
+		t.Fatalf("latencies: processing=%+v rx_to_tx=%+v", m.Processing, m.RxToTx)
+	}
+
+	srv.cfg.LatencyResetOnRead = true
+	if m := srv.Metrics(); m.Processing.Count != 4 {
+		t.Fatalf("first read with reset: got=%+v", m.Processing)
+	}
+	if m := srv.Metrics(); m.Processing.Count != 0 || m.RxToTx.Count != 0 {
+		t.Fatalf("after reset: got=%+v %+v", m.Processing, m.RxToTx)
+	}
+
+	// Scrapes count what Metrics cleared and clear nothing themselves.
+	for i := 0; i < 2; i++ {
+		var b bytes.Buffer
+		srv.writePrometheus(&b, time.Now())
+		for _, want := range []string{"ntpserver_processing_seconds_count 4\n", "ntpserver_rx_to_tx_seconds_count 3\n"} {
+			if !strings.Contains(b.String(), want) {
+				t.Fatalf("scrape %d: missing %q in:\n%s", i, want, b.String())
+			}
+		}
+	}
+}
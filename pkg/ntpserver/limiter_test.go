@@ -1,6 +1,7 @@
 package ntpserver
 
 import (
+	"net/netip"
 	"testing"
 	"time"
 )
@@ -26,21 +27,149 @@ func TestTokenBucket_Allow(t *testing.T) {
 }
 
 func TestLimiter_PerIP(t *testing.T) {
-	l := newLimiter(1, 1)
+	l := newLimiter(1, 1, 16, 0, RateLimitEvict)
 	now := time.Unix(2000, 0)
 
-	if !l.allow("1.1.1.1", now) {
+	if !l.allow(netip.MustParseAddr("1.1.1.1"), now) {
 		t.Fatalf("expected first allow")
 	}
-	if l.allow("1.1.1.1", now) {
+	if l.allow(netip.MustParseAddr("1.1.1.1"), now) {
 		t.Fatalf("expected second deny for same IP")
 	}
 	// Different IP gets its own bucket.
-	if !l.allow("2.2.2.2", now) {
+	if !l.allow(netip.MustParseAddr("2.2.2.2"), now) {
 		t.Fatalf("expected allow for other IP")
 	}
-	// Empty IP bypasses limiter.
-	if !l.allow("", now) {
-		t.Fatalf("expected allow for empty IP")
+	// Requests without a client IP bypass the limiter.
+	if !l.allow(netip.Addr{}, now) {
+		t.Fatalf("expected allow for invalid IP")
+	}
+}
+
+func TestLimiter_BoundedTable(t *testing.T) {
+	now := time.Unix(2000, 0)
+	ip := func(i int) netip.Addr { return netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}) }
+
+	l := newLimiter(1, 1, 3, 0, RateLimitEvict)
+	for i := 0; i < 10; i++ {
+		l.allow(ip(i), now)
+	}
+	m := l.snapshot()
+	if m.Clients != 3 || m.MaxClients != 3 || m.Evicted != 7 {
+		t.Fatalf("evict: %+v", m)
+	}
+	// The most recent clients are still limited; evicted ones start afresh.
+	if l.allow(ip(9), now) {
+		t.Fatalf("tracked client should still be limited")
+	}
+	if !l.allow(ip(0), now) {
+		t.Fatalf("evicted client should get a new bucket")
+	}
+
+	open := newLimiter(1, 1, 2, 0, RateLimitFailOpen)
+	closed := newLimiter(1, 1, 2, 0, RateLimitFailClosed)
+	for i := 0; i < 2; i++ {
+		open.allow(ip(i), now)
+		closed.allow(ip(i), now)
+	}
+	for i := 0; i < 2; i++ {
+		if !open.allow(ip(100), now) {
+			t.Fatalf("fail-open must allow untracked clients")
+		}
+		if closed.allow(ip(100), now) {
+			t.Fatalf("fail-closed must deny new clients")
+		}
+	}
+	if m := open.snapshot(); m.Clients != 2 || m.Untracked != 2 || m.Evicted != 0 {
+		t.Fatalf("open: %+v", m)
+	}
+	if m := closed.snapshot(); m.Clients != 2 || m.Rejected != 2 {
+		t.Fatalf("closed: %+v", m)
+	}
+
+	// Idle clients are dropped before any policy applies. At 1/s with burst
+	// 1, a bucket refills within a second.
+	later := now.Add(2 * time.Second)
+	if !closed.allow(ip(100), later) {
+		t.Fatalf("idle clients should make room")
+	}
+	if m := closed.snapshot(); m.Clients != 1 || m.Expired != 2 {
+		t.Fatalf("expire: %+v", m)
+	}
+}
+
+func TestServer_RateLimitMetrics(t *testing.T) {
+	if m := New(Config{}).Metrics(); m.RateLimit != nil {
+		t.Fatalf("RateLimit without rate limiting: %+v", m.RateLimit)
+	}
+	srv := New(Config{RateLimitPerSecond: 1, RateLimitClients: 2, RateLimitFull: RateLimitFailClosed})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		srv.live.Load().limiter.allow(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), now)
+	}
+	m := srv.Metrics().RateLimit
+	if m == nil || m.Clients != 2 || m.MaxClients != 2 || m.Rejected != 1 {
+		t.Fatalf("RateLimit: %+v", m)
+	}
+}
+
+func TestPrefixKey(t *testing.T) {
+	for _, tc := range []struct{ ip, want string }{
+		{"192.0.2.77", "192.0.2.0"},
+		{"2001:db8:1:2:aaaa::1", "2001:db8:1:2::"},
+	} {
+		if got := prefixKey(netip.MustParseAddr(tc.ip), 24, 64); got.String() != tc.want {
+			t.Fatalf("prefixKey(%s): got=%s want=%s", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestServer_RateLimitLayers(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	req := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}).Marshal()
+	send := func(srv *Server, addr string) string {
+		t.Helper()
+		from := remote{ap: netip.AddrPortFrom(netip.MustParseAddr(addr), 123)}
+		return handle(srv, &fakeWriter{}, req, from, now).Error
+	}
+
+	srv := New(Config{Clock: fixedClock{t: now}, RateLimitPerSecond: 0.001, RateLimitBurst: 1})
+	if got := send(srv, "192.0.2.1"); got != "" {
+		t.Fatalf("first request: got=%q", got)
+	}
+	if got := send(srv, "192.0.2.1"); got != "rate_limited" {
+		t.Fatalf("address layer: got=%q want=rate_limited", got)
+	}
+	// Without KoD a limited request is dropped unparsed, and the event
+	// still carries the version and mode.
+	rw := &fakeWriter{}
+	ev := handle(srv, rw, req, remote{ap: netip.MustParseAddrPort("192.0.2.1:123")}, now)
+	if ev.Responded || rw.n != 0 || ev.Version != 4 || ev.Mode != ModeClient {
+		t.Fatalf("no KoD: responded=%v sent=%d version=%d mode=%d", ev.Responded, rw.n, ev.Version, ev.Mode)
+	}
+
+	srv = New(Config{Clock: fixedClock{t: now}, RateLimitPrefixPerSecond: 0.001, RateLimitPrefixBurst: 2})
+	for i, addr := range []string{"2001:db8:1:2::1", "2001:db8:1:2::2", "2001:db8:1:2::3", "2001:db8:1:3::1", "198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		want := ""
+		if i == 2 || i == 6 {
+			want = "rate_limited_prefix"
+		}
+		if got := send(srv, addr); got != want {
+			t.Fatalf("prefix layer %s: got=%q want=%q", addr, got, want)
+		}
+	}
+	if m := srv.Metrics(); m.RateLimit != nil || m.RateLimitPrefixes == nil || m.RateLimitPrefixes.Clients != 3 {
+		t.Fatalf("metrics: address=%+v prefixes=%+v", m.RateLimit, m.RateLimitPrefixes)
+	}
+
+	srv = New(Config{Clock: fixedClock{t: now}, RateLimitGlobalPerSecond: 0.001, RateLimitGlobalBurst: 1, KoD: true})
+	rw = &fakeWriter{}
+	from := remote{ap: netip.MustParseAddrPort("192.0.2.2:123")}
+	_ = handle(srv, rw, req, remote{ap: netip.MustParseAddrPort("192.0.2.1:123")}, now)
+	if ev := handle(srv, rw, req, from, now); ev.Error != "rate_limited_global" || ev.Responded {
+		t.Fatalf("global layer: got=%q responded=%v", ev.Error, ev.Responded)
+	}
+	if rw.n != 1 {
+		t.Fatalf("global rejections must not get a KoD: sent=%d", rw.n)
 	}
 }
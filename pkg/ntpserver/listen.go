@@ -0,0 +1,80 @@
+package ntpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrBindToDeviceUnsupported is returned by Start when a listener names an
+// interface on a platform without SO_BINDTODEVICE.
+var ErrBindToDeviceUnsupported = errors.New("ntpserver: binding to an interface is not supported on this platform")
+
+// ErrReusePortUnsupported is returned by Start when Config.ReusePort is set
+// on a platform where SO_REUSEPORT does not balance load (anything but Linux).
+var ErrReusePortUnsupported = errors.New("ntpserver: SO_REUSEPORT load balancing is not supported on this platform")
+
+// listener is one socket the server answers on.
+type listener struct {
+	conn  net.PacketConn
+	local string    // conn.LocalAddr().String()
+	iface string    // bound interface, if any
+	tx    *txReader // set when kernel transmit timestamps are read
+}
+
+func newListener(conn net.PacketConn, iface string) *listener {
+	return &listener{conn: conn, local: conn.LocalAddr().String(), iface: iface}
+}
+
+// listenSpec is a configured listen address and the interface to bind it to.
+type listenSpec struct {
+	addr  string
+	iface string
+}
+
+// listenSpecs returns ListenAddrs, or ListenAddr when it is empty, with each
+// "addr@iface" entry split. Entries without an interface use Interface.
+func (c Config) listenSpecs() []listenSpec {
+	addrs := c.ListenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{c.ListenAddr}
+	}
+	out := make([]listenSpec, 0, len(addrs))
+	for _, a := range addrs {
+		spec := listenSpec{addr: a, iface: c.Interface}
+		if i := strings.LastIndexByte(a, '@'); i >= 0 {
+			spec.addr, spec.iface = a[:i], a[i+1:]
+		}
+		out = append(out, spec)
+	}
+	return out
+}
+
+// listenUDP opens a UDP socket on addr, bound to iface when it is set and
+// sharing the address with other sockets when reusePort is set.
+func listenUDP(network string, spec listenSpec, reusePort bool) (*net.UDPConn, error) {
+	var lc net.ListenConfig
+	if spec.iface != "" || reusePort {
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				if reusePort {
+					serr = setReusePort(fd)
+				}
+				if serr == nil && spec.iface != "" {
+					serr = bindToDevice(fd, spec.iface)
+				}
+			}); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	pc, err := lc.ListenPacket(context.Background(), network, spec.addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
@@ -0,0 +1,113 @@
+package ntpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConfig_ListenSpecs(t *testing.T) {
+	cfg := Config{
+		ListenAddr:  "0.0.0.0:123",
+		ListenAddrs: []string{"192.0.2.1:123@vlan10", "[2001:db8::1]:1123", "[fe80::1%eth0]:123@eth0"},
+		Interface:   "eth1",
+	}
+	want := []listenSpec{
+		{addr: "192.0.2.1:123", iface: "vlan10"},
+		{addr: "[2001:db8::1]:1123", iface: "eth1"},
+		{addr: "[fe80::1%eth0]:123", iface: "eth0"},
+	}
+	got := cfg.listenSpecs()
+	if len(got) != len(want) {
+		t.Fatalf("specs: got=%v want=%v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("spec %d: got=%+v want=%+v", i, got[i], want[i])
+		}
+	}
+
+	got = Config{ListenAddr: "127.0.0.1:123"}.listenSpecs()
+	if len(got) != 1 || got[0] != (listenSpec{addr: "127.0.0.1:123"}) {
+		t.Fatalf("ListenAddr fallback: got=%v", got)
+	}
+}
+
+func TestServer_MultipleListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{ListenAddrs: []string{"127.0.0.1:0", "127.0.0.1:0"}, Network: "udp4"})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	addrs := srv.Addrs()
+	if len(addrs) != 2 || addrs[0] == addrs[1] || srv.Addr() != addrs[0] {
+		t.Fatalf("addrs: %v (Addr=%s)", addrs, srv.Addr())
+	}
+	for _, addr := range addrs {
+		raddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		c, err := net.DialUDP("udp4", nil, raddr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}
+		if _, err := c.Write(req.Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, ok := readPacket(t, c, time.Second); !ok {
+			t.Fatalf("no response on %s", addr)
+		}
+		_ = c.Close()
+		if ev := waitForEvent(t, events, ModeClient); ev.LocalAddr != addr {
+			t.Fatalf("event local addr: got=%s want=%s", ev.LocalAddr, addr)
+		}
+	}
+	if m := srv.Metrics(); m.TotalResponses != 2 {
+		t.Fatalf("shared metrics: responses=%d want=2", m.TotalResponses)
+	}
+
+	_ = srv.Stop()
+	if got := srv.Addrs(); len(got) != 2 || got[0] != "127.0.0.1:0" {
+		t.Fatalf("configured addrs after stop: %v", got)
+	}
+}
+
+func TestServer_ListenerBoundToInterface(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{ListenAddrs: []string{"127.0.0.1:0@lo"}, Network: "udp4"})
+	err := srv.Start(ctx)
+	if errors.Is(err, ErrBindToDeviceUnsupported) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("cannot bind to interface: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	c := dialServer(t, srv)
+	defer c.Close()
+	if _, err := c.Write(Packet{VN: 4, Mode: ModeClient}.Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, ok := readPacket(t, c, time.Second); !ok {
+		t.Fatalf("no response")
+	}
+	if ev := waitForEvent(t, events, ModeClient); ev.Interface != "lo" {
+		t.Fatalf("event interface: got=%q want=lo", ev.Interface)
+	}
+}
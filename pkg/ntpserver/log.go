@@ -0,0 +1,67 @@
+package ntpserver
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// logRequest logs the outcome of a request once it has been handled. Lines
+// are limited by Config.LogRequestsPerSecond; with Slog, requests at a
+// disabled level cost one Enabled call.
+func (s *Server) logRequest(ev *RequestEvent, took time.Duration) {
+	if s.cfg.Slog == nil && s.cfg.Logger == nil {
+		return
+	}
+	level := slog.LevelDebug
+	if ev.Error != "" {
+		level = slog.LevelInfo
+	}
+	ctx := context.Background()
+	if s.cfg.Slog != nil && !s.cfg.Slog.Enabled(ctx, level) {
+		return
+	}
+	if !s.logLimit.allow(time.Now()) {
+		s.logSuppressed.Add(1)
+		return
+	}
+	suppressed := s.logSuppressed.Swap(0)
+
+	if s.cfg.Slog == nil {
+		if s.cfg.Debug {
+			s.cfg.Logger.Printf("[DEBUG] NTP request from %s:%d", ipString(ev.client.Addr()), ev.ClientPort)
+		} else {
+			s.cfg.Logger.Printf("[INFO] NTP request from %s", ipString(ev.client.Addr()))
+		}
+		return
+	}
+
+	outcome := ev.Error
+	switch {
+	case outcome != "":
+	case ev.Responded:
+		outcome = "responded"
+	default:
+		outcome = "no_reply"
+	}
+	attrs := make([]slog.Attr, 0, 8)
+	if ev.client.IsValid() {
+		attrs = append(attrs, slog.String("client", ev.client.String()))
+	}
+	attrs = append(attrs,
+		slog.Int("version", int(ev.Version)),
+		slog.Int("mode", int(ev.Mode)),
+		slog.String("outcome", outcome),
+		slog.Duration("latency", took),
+	)
+	if ev.Kiss != "" {
+		attrs = append(attrs, slog.String("kiss", ev.Kiss))
+	}
+	if ev.LocalAddr != "" {
+		attrs = append(attrs, slog.String("local", ev.LocalAddr))
+	}
+	if suppressed > 0 {
+		attrs = append(attrs, slog.Uint64("suppressed", suppressed))
+	}
+	s.cfg.Slog.LogAttrs(ctx, level, "ntp request", attrs...)
+}
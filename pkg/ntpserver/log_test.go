@@ -0,0 +1,99 @@
+package ntpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_LogRequestSlog(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	srv := New(Config{
+		Clock:                fixedClock{t: now},
+		Slog:                 slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		LogRequestsPerSecond: -1,
+	})
+	from := remote{ap: netip.MustParseAddrPort("192.0.2.1:123")}
+	client := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}).Marshal()
+
+	ev := handle(srv, &fakeWriter{}, client, from, now)
+	srv.logRequest(&ev, 3*time.Microsecond)
+	ev = handle(srv, &fakeWriter{}, []byte{0x23}, from, now)
+	srv.logRequest(&ev, time.Microsecond)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines: got=%d\n%s", len(lines), buf.String())
+	}
+	var ok, bad map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &ok); err != nil {
+		t.Fatalf("line 0: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &bad); err != nil {
+		t.Fatalf("line 1: %v", err)
+	}
+	if ok["level"] != "DEBUG" || ok["msg"] != "ntp request" || ok["client"] != "192.0.2.1:123" || ok["version"] != 4.0 ||
+		ok["mode"] != 3.0 || ok["outcome"] != "responded" || ok["latency"] != 3000.0 || ok["local"] != "127.0.0.1:123" {
+		t.Fatalf("answered request: %s", lines[0])
+	}
+	if bad["level"] != "INFO" || bad["outcome"] != "invalid_request" {
+		t.Fatalf("invalid request: %s", lines[1])
+	}
+}
+
+func TestServer_LogRequestLevelAndSampling(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	srv := New(Config{
+		Clock:                fixedClock{t: now},
+		Slog:                 slog.New(slog.NewTextHandler(&buf, nil)),
+		LogRequestsPerSecond: 0.001,
+		LogRequestsBurst:     2,
+	})
+	from := remote{ap: netip.MustParseAddrPort("192.0.2.1:123")}
+	client := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}).Marshal()
+
+	// Answered requests log at Debug, below the handler's Info level, and
+	// do not use up the budget.
+	ev := handle(srv, &fakeWriter{}, client, from, now)
+	if allocs := testing.AllocsPerRun(100, func() { srv.logRequest(&ev, time.Microsecond) }); allocs != 0 {
+		t.Fatalf("disabled level: allocs=%v", allocs)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("debug line written: %s", buf.String())
+	}
+
+	bad := handle(srv, &fakeWriter{}, []byte{0x23}, from, now)
+	for i := 0; i < 5; i++ {
+		srv.logRequest(&bad, time.Microsecond)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Fatalf("sampled lines: got=%d want=2\n%s", n, buf.String())
+	}
+	srv.logLimit.mu.Lock()
+	srv.logLimit.tokens = 1
+	srv.logLimit.mu.Unlock()
+	buf.Reset()
+	srv.logRequest(&bad, time.Microsecond)
+	if !strings.Contains(buf.String(), "suppressed=3") {
+		t.Fatalf("suppressed count: %s", buf.String())
+	}
+}
+
+func TestServer_LogRequestLegacyLogger(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	srv := New(Config{Clock: fixedClock{t: now}, Logger: log.New(&buf, "", 0)})
+	from := remote{ap: netip.MustParseAddrPort("192.0.2.1:123")}
+	ev := handle(srv, &fakeWriter{}, []byte{0x23}, from, now)
+	srv.logRequest(&ev, time.Microsecond)
+	if buf.String() != "[INFO] NTP request from 192.0.2.1\n" {
+		t.Fatalf("legacy line: %q", buf.String())
+	}
+}
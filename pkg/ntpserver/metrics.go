@@ -1,31 +1,133 @@
 package ntpserver
 
 import (
+	"math"
+	"net/netip"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// maxErrorReasons bounds the hook drop reasons counted separately. They are
+// chosen by the application; past the bound they count as "other".
+const maxErrorReasons = 64
+
+// errorReasons are the RequestEvent errors the server sets itself. They are
+// counted with atomics, so that a flood of refused requests does not have
+// every worker wait on metrics.mu; only hook drop reasons take the lock.
+var errorReasons = [...]string{
+	"invalid_request", "write_failed", "auth_failed",
+	"rate_limited", "rate_limited_prefix", "rate_limited_global",
+	"restricted_ignore", "restricted_noquery", "restricted_noserve", "restricted_nomodify", "restricted_nopeer",
+	"control_denied", "control_error",
+	"no_association", "peer_limit", "peer_duplicate", "peer_bogus",
+	ntsReasonMalformed, ntsReasonCookie, ntsReasonAuth,
+	DropKoDRate, DropKoDDeny, DropKoDRestrict,
+}
+
+// errorReasonIndex maps errorReasons to their index; it is only read.
+var errorReasonIndex = func() map[string]int {
+	idx := make(map[string]int, len(errorReasons))
+	for i, r := range errorReasons {
+		idx[r] = i
+	}
+	return idx
+}()
+
 type metrics struct {
 	startedAt atomic.Value // time.Time
 
+	// Reloads are counted over the life of the Server, not reset by Start.
+	reloads    atomic.Uint64
+	lastReload atomic.Value // time.Time
+
 	totalRequests  atomic.Uint64
 	totalResponses atomic.Uint64
 	totalErrors    atomic.Uint64
+	kodSent        atomic.Uint64
+	kodSuppressed  atomic.Uint64
+	broadcasts     atomic.Uint64
+	broadcastErrs  atomic.Uint64
+
+	// Indexed by the 3-bit version and mode fields of the first byte.
+	byVersion [8]atomic.Uint64
+	byMode    [8]atomic.Uint64
+
+	processing latencyHistogram
+	rxToTx     latencyHistogram
+
+	errorsBuiltin [len(errorReasons)]atomic.Uint64
 
-	lastRequestAt atomic.Value // time.Time
-	lastRequestIP atomic.Value // string
+	mu     sync.Mutex
+	errors map[string]uint64 // hook drop reasons, at most maxErrorReasons keys
+
+	// Clients are tracked by each worker in a clientShard of its own, so
+	// that workers do not contend on a lock; snapshots merge the shards.
+	// shared is for requests not handled by a worker.
+	topK     int
+	capacity int
+	window   time.Duration
+	shared   *clientShard
+	shards   []*clientShard // of the workers, guarded by mu
+}
+
+// clientShard tracks clients in bounded memory: the heavy hitters since
+// Start (which also make up the mode 6 MRU list), those of the recent window,
+// and an estimate of how many distinct clients there were.
+type clientShard struct {
+	mu     sync.Mutex
+	lastAt time.Time
+	lastIP netip.Addr
+	top    *spaceSaving
+	recent *windowedTop
+	unique hyperLogLog
+}
+
+func (c *clientShard) observe(ip netip.Addr, port int, mv uint8, at time.Time) {
+	c.mu.Lock()
+	c.lastAt, c.lastIP = at, ip
+	if ip.IsValid() {
+		c.top.observe(ip, port, mv, at)
+		c.recent.observe(ip, at)
+		c.unique.add(ip)
+	}
+	c.mu.Unlock()
+}
+
+func (c *clientShard) reset() {
+	c.mu.Lock()
+	c.lastAt, c.lastIP = time.Time{}, netip.Addr{}
+	c.top.reset()
+	c.recent.reset()
+	c.unique = hyperLogLog{}
+	c.mu.Unlock()
+}
 
-	mu      sync.Mutex
-	byIP    map[string]uint64
+// clientStats is what is remembered about one client IP. It backs TopClients
+// and the mode 6 MRU list.
+type clientStats struct {
+	ip    netip.Addr
+	count uint64
+	err   uint64 // count may be this much too high
+	first time.Time
+	last  time.Time
+	port  int
+	mv    uint8 // version and mode of the last packet, as ntpd's VN_MODE
 }
 
-func newMetrics() *metrics {
-	m := &metrics{byIP: make(map[string]uint64)}
+// newMetrics sizes the client tracking from cfg.TopClients,
+// TopClientsError and TopClientsWindow, which must be normalized.
+func newMetrics(cfg Config) *metrics {
+	m := &metrics{
+		errors:   make(map[string]uint64),
+		topK:     cfg.TopClients,
+		capacity: max(cfg.TopClients, int(math.Ceil(1/cfg.TopClientsError))),
+		window:   cfg.TopClientsWindow,
+	}
+	m.shared = m.newClientShard()
 	m.startedAt.Store(time.Time{})
-	m.lastRequestAt.Store(time.Time{})
-	m.lastRequestIP.Store("")
+	m.lastReload.Store(time.Time{})
 	return m
 }
 
@@ -33,65 +135,221 @@ func (m *metrics) reset(startedAt time.Time) {
 	m.totalRequests.Store(0)
 	m.totalResponses.Store(0)
 	m.totalErrors.Store(0)
+	m.kodSent.Store(0)
+	m.kodSuppressed.Store(0)
+	m.broadcasts.Store(0)
+	m.broadcastErrs.Store(0)
+	for i := range m.byVersion {
+		m.byVersion[i].Store(0)
+		m.byMode[i].Store(0)
+	}
+	for i := range m.errorsBuiltin {
+		m.errorsBuiltin[i].Store(0)
+	}
+	m.processing.reset()
+	m.rxToTx.reset()
 	m.startedAt.Store(startedAt)
-	m.lastRequestAt.Store(time.Time{})
-	m.lastRequestIP.Store("")
+	m.shared.reset()
 	m.mu.Lock()
-	m.byIP = make(map[string]uint64)
+	// The workers of the previous run have stopped; Start adds new shards.
+	m.shards = nil
+	m.errors = make(map[string]uint64)
 	m.mu.Unlock()
 }
 
-func (m *metrics) incRequest(ip string, at time.Time) {
-	m.totalRequests.Add(1)
-	m.lastRequestAt.Store(at)
-	m.lastRequestIP.Store(ip)
-	if ip == "" {
-		return
-	}
+func (m *metrics) newClientShard() *clientShard {
+	return &clientShard{top: newSpaceSaving(m.capacity), recent: newWindowedTop(m.window, m.capacity)}
+}
+
+// addClientShard returns a new shard for a worker to pass to incRequest.
+func (m *metrics) addClientShard() *clientShard {
+	c := m.newClientShard()
 	m.mu.Lock()
-	m.byIP[ip]++
+	m.shards = append(m.shards, c)
 	m.mu.Unlock()
+	return c
+}
+
+// clientShards returns the shared shard and those of the workers.
+func (m *metrics) clientShards() []*clientShard {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*clientShard{m.shared}, m.shards...)
+}
+
+// incRequest counts a request from ip, which is invalid for transports that
+// are not IP, in shard c, or the shared shard if c is nil.
+func (m *metrics) incRequest(c *clientShard, ip netip.Addr, port int, mv uint8, at time.Time) {
+	m.totalRequests.Add(1)
+	m.byVersion[mv>>3&7].Add(1)
+	m.byMode[mv&7].Add(1)
+	if c == nil {
+		c = m.shared
+	}
+	c.observe(ip, port, mv, at)
+}
+
+// clients returns the tracked clients, least recently seen first.
+func (m *metrics) clients() []clientStats {
+	var tops []*spaceSaving
+	for _, c := range m.clientShards() {
+		c.mu.Lock()
+		tops = append(tops, c.top.clone())
+		c.mu.Unlock()
+	}
+	out := mergeSummaries(tops)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].last.Equal(out[j].last) {
+			return out[i].ip.Less(out[j].ip)
+		}
+		return out[i].last.Before(out[j].last)
+	})
+	return out
 }
 
 func (m *metrics) incResponse() {
 	m.totalResponses.Add(1)
 }
 
-func (m *metrics) incError() {
+// uncountResponse takes back a response counted for a reply that was queued
+// but could not be sent.
+func (m *metrics) uncountResponse() {
+	m.totalResponses.Add(^uint64(0))
+}
+
+// uncountKoD is uncountResponse for a Kiss-o'-Death.
+func (m *metrics) uncountKoD() {
+	m.kodSent.Add(^uint64(0))
+}
+
+// incError counts a request that failed for reason, the RequestEvent error
+// or, for socket errors, "write_failed".
+func (m *metrics) incError(reason string) {
 	m.totalErrors.Add(1)
+	if i, ok := errorReasonIndex[reason]; ok {
+		m.errorsBuiltin[i].Add(1)
+		return
+	}
+	m.mu.Lock()
+	if _, ok := m.errors[reason]; !ok && len(m.errors) >= maxErrorReasons {
+		reason = "other"
+	}
+	m.errors[reason]++
+	m.mu.Unlock()
 }
 
-func (m *metrics) snapshot() MetricsSnapshot {
+func (m *metrics) incKoDSent() {
+	m.kodSent.Add(1)
+}
+
+func (m *metrics) incKoDSuppressed() {
+	m.kodSuppressed.Add(1)
+}
+
+func (m *metrics) incBroadcastSent() {
+	m.broadcasts.Add(1)
+}
+
+func (m *metrics) incBroadcastError() {
+	m.broadcastErrs.Add(1)
+}
+
+func (m *metrics) incReload(at time.Time) {
+	m.reloads.Add(1)
+	m.lastReload.Store(at)
+}
+
+// counters reads the request counters and the start and reload times. It
+// does not look at the clients, so it is cheap enough for every mode 6 query.
+func (m *metrics) counters() MetricsSnapshot {
 	startedAt, _ := m.startedAt.Load().(time.Time)
-	lastAt, _ := m.lastRequestAt.Load().(time.Time)
-	lastIP, _ := m.lastRequestIP.Load().(string)
+	lastReload, _ := m.lastReload.Load().(time.Time)
 
+	var errs map[string]uint64
+	for i := range m.errorsBuiltin {
+		if n := m.errorsBuiltin[i].Load(); n > 0 {
+			if errs == nil {
+				errs = make(map[string]uint64)
+			}
+			errs[errorReasons[i]] = n
+		}
+	}
 	m.mu.Lock()
-	counts := make([]ClientCount, 0, len(m.byIP))
-	for ip, c := range m.byIP {
-		counts = append(counts, ClientCount{ClientIP: ip, Count: c})
+	for reason, n := range m.errors {
+		if errs == nil {
+			errs = make(map[string]uint64, len(m.errors))
+		}
+		errs[reason] = n
 	}
-	unique := len(m.byIP)
 	m.mu.Unlock()
 
-	sort.Slice(counts, func(i, j int) bool {
-		if counts[i].Count == counts[j].Count {
-			return counts[i].ClientIP < counts[j].ClientIP
+	snap := MetricsSnapshot{
+		StartedAt:       startedAt,
+		TotalRequests:   m.totalRequests.Load(),
+		TotalResponses:  m.totalResponses.Load(),
+		TotalErrors:     m.totalErrors.Load(),
+		KoDSent:         m.kodSent.Load(),
+		KoDSuppressed:   m.kodSuppressed.Load(),
+		BroadcastsSent:  m.broadcasts.Load(),
+		BroadcastErrors: m.broadcastErrs.Load(),
+		ErrorsByReason:  errs,
+		Reloads:         m.reloads.Load(),
+		LastReloadAt:    lastReload,
+	}
+	snap.RequestsByVersion, snap.RequestsByMode = m.versionModeCounts()
+	return snap
+}
+
+// clientTotals sets the last request and the unique client estimate of snap.
+func (m *metrics) clientTotals(snap *MetricsSnapshot) {
+	var lastAt time.Time
+	var last netip.Addr
+	var unique hyperLogLog
+	for _, c := range m.clientShards() {
+		c.mu.Lock()
+		if c.lastAt.After(lastAt) {
+			lastAt, last = c.lastAt, c.lastIP
 		}
-		return counts[i].Count > counts[j].Count
-	})
-	if len(counts) > 10 {
-		counts = counts[:10]
+		unique.merge(&c.unique)
+		c.mu.Unlock()
+	}
+	snap.LastRequestAt = lastAt
+	if last.IsValid() {
+		snap.LastRequestIP = last.String()
+	}
+	snap.UniqueClients = unique.estimate()
+}
+
+// topClients sets the TopClients and RecentTopClients of snap, merging the
+// summaries of every shard; now ends the window of RecentTopClients.
+func (m *metrics) topClients(snap *MetricsSnapshot, now time.Time) {
+	var tops, slots []*spaceSaving
+	for _, c := range m.clientShards() {
+		c.mu.Lock()
+		tops = append(tops, c.top.clone())
+		slots = append(slots, c.recent.live(now)...)
+		c.mu.Unlock()
 	}
+	snap.TopClients = topClients(mergeSummaries(tops), m.topK)
+	snap.RecentTopClients = topClients(mergeSummaries(slots), m.topK)
+}
 
-	return MetricsSnapshot{
-		StartedAt:      startedAt,
-		TotalRequests:  m.totalRequests.Load(),
-		TotalResponses: m.totalResponses.Load(),
-		TotalErrors:    m.totalErrors.Load(),
-		LastRequestAt:  lastAt,
-		LastRequestIP:  lastIP,
-		UniqueClients:  unique,
-		TopClients:     counts,
+// versionModeCounts returns the non-zero request counts by version and by
+// mode, or nil maps.
+func (m *metrics) versionModeCounts() (byVersion, byMode map[uint8]uint64) {
+	for i := range m.byVersion {
+		if n := m.byVersion[i].Load(); n > 0 {
+			if byVersion == nil {
+				byVersion = make(map[uint8]uint64)
+			}
+			byVersion[uint8(i)] = n
+		}
+		if n := m.byMode[i].Load(); n > 0 {
+			if byMode == nil {
+				byMode = make(map[uint8]uint64)
+			}
+			byMode[uint8(i)] = n
+		}
 	}
+	return byVersion, byMode
 }
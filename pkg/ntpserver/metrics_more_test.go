@@ -1,28 +1,34 @@
 package ntpserver
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
 	"testing"
 	"time"
 )
 
 func TestMetrics_TopClientsSortedAndLimited(t *testing.T) {
-	m := newMetrics()
+	m := newMetrics(Config{}.normalize())
 	started := time.Unix(1, 0).UTC()
 	m.reset(started)
 
 	// Create 12 unique clients; two of them have higher counts.
 	at := time.Unix(2, 0).UTC()
 	for i := 0; i < 10; i++ {
-		ip := "10.0.0." + string(rune('0'+i))
-		m.incRequest(ip, at)
+		ip := netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})
+		m.incRequest(nil, ip, 123, 0x23, at)
 	}
-	m.incRequest("1.1.1.1", at)
-	m.incRequest("1.1.1.1", at)
-	m.incRequest("2.2.2.2", at)
-	m.incRequest("2.2.2.2", at)
-	m.incRequest("2.2.2.2", at)
+	m.incRequest(nil, netip.MustParseAddr("1.1.1.1"), 123, 0x23, at)
+	m.incRequest(nil, netip.MustParseAddr("1.1.1.1"), 123, 0x23, at)
+	m.incRequest(nil, netip.MustParseAddr("2.2.2.2"), 123, 0x23, at)
+	m.incRequest(nil, netip.MustParseAddr("2.2.2.2"), 123, 0x23, at)
+	m.incRequest(nil, netip.MustParseAddr("2.2.2.2"), 123, 0x23, at)
 
-	s := m.snapshot()
+	s := m.counters()
+	m.clientTotals(&s)
+	m.topClients(&s, at)
 	if !s.StartedAt.Equal(started) {
 		t.Fatalf("startedAt: got=%v want=%v", s.StartedAt, started)
 	}
@@ -48,3 +54,99 @@ func TestMetrics_TopClientsSortedAndLimited(t *testing.T) {
 		t.Fatalf("LastRequestAt expected non-zero")
 	}
 }
+
+func TestMetrics_ErrorsByReasonBounded(t *testing.T) {
+	m := newMetrics(Config{}.normalize())
+	m.incError("rate_limited")
+	m.incError("rate_limited")
+	for i := 0; i < maxErrorReasons+10; i++ {
+		m.incError(fmt.Sprintf("hook_%d", i))
+	}
+	s := m.counters()
+	if s.ErrorsByReason["rate_limited"] != 2 {
+		t.Fatalf("rate_limited: got=%d want=2", s.ErrorsByReason["rate_limited"])
+	}
+	// Built-in reasons do not take up the slots of hook reasons.
+	if len(s.ErrorsByReason) != maxErrorReasons+2 || s.ErrorsByReason["other"] != 10 {
+		t.Fatalf("bound: got=%d reasons, other=%d", len(s.ErrorsByReason), s.ErrorsByReason["other"])
+	}
+	if s.TotalErrors != maxErrorReasons+12 {
+		t.Fatalf("TotalErrors: got=%d", s.TotalErrors)
+	}
+}
+
+func TestMetrics_BuiltinErrorsDoNotLock(t *testing.T) {
+	m := newMetrics(Config{}.normalize())
+	m.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		for _, reason := range errorReasons {
+			m.incError(reason)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("incError of a built-in reason waited for metrics.mu")
+	}
+	m.mu.Unlock()
+
+	s := m.counters()
+	if len(s.ErrorsByReason) != len(errorReasons) || s.TotalErrors != uint64(len(errorReasons)) {
+		t.Fatalf("got=%v total=%d", s.ErrorsByReason, s.TotalErrors)
+	}
+}
+
+func TestMetrics_RequestsByVersionAndMode(t *testing.T) {
+	m := newMetrics(Config{}.normalize())
+	at := time.Unix(2, 0).UTC()
+	ip := netip.MustParseAddr("192.0.2.1")
+	m.incRequest(nil, ip, 123, 4<<3|ModeClient, at)
+	m.incRequest(nil, ip, 123, 4<<3|ModeClient, at)
+	m.incRequest(nil, ip, 123, 3<<3|ModeClient, at)
+	m.incRequest(nil, ip, 123, 2<<3|ModeControl, at)
+	m.incRequest(nil, ip, 123, 0, at) // empty packet
+
+	s := m.counters()
+	wantVersion := map[uint8]uint64{0: 1, 2: 1, 3: 1, 4: 2}
+	wantMode := map[uint8]uint64{0: 1, ModeClient: 3, ModeControl: 1}
+	if !reflect.DeepEqual(s.RequestsByVersion, wantVersion) {
+		t.Fatalf("RequestsByVersion: got=%v want=%v", s.RequestsByVersion, wantVersion)
+	}
+	if !reflect.DeepEqual(s.RequestsByMode, wantMode) {
+		t.Fatalf("RequestsByMode: got=%v want=%v", s.RequestsByMode, wantMode)
+	}
+
+	m.reset(at)
+	if s := m.counters(); s.RequestsByVersion != nil || s.RequestsByMode != nil {
+		t.Fatalf("after reset: got=%v %v", s.RequestsByVersion, s.RequestsByMode)
+	}
+}
+
+func TestServer_ErrorsByReason(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := New(Config{
+		Clock:        fixedClock{t: now},
+		ControlAllow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		PassivePeers: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	})
+	rw := &fakeWriter{err: errors.New("sendto: no buffer space available")}
+	from := remote{ap: netip.MustParseAddrPort("192.0.2.1:123")}
+	client := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}).Marshal()
+	peer := (&Packet{VN: 4, Mode: ModeSymmetricActive, Stratum: 2, Transmit: timeToTimestamp(now)}).Marshal()
+
+	// Client, control and passive peer replies that cannot be sent all
+	// count as write_failed, not under the socket error text.
+	for _, b := range [][]byte{client, controlRequest(ctlOpReadVar, 1, 0, ""), peer} {
+		if ev := handle(srv, rw, b, from, now); ev.Error == "" || ev.Responded {
+			t.Fatalf("mode %d: expected a write error, got %+v", b[0]&7, ev)
+		}
+	}
+	handle(srv, rw, []byte{0x23}, from, now)
+
+	want := map[string]uint64{"write_failed": 3, "invalid_request": 1}
+	if got := srv.Metrics().ErrorsByReason; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ErrorsByReason: got=%v want=%v", got, want)
+	}
+}
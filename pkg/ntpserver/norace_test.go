@@ -0,0 +1,5 @@
+//go:build !race
+
+package ntpserver
+
+const raceEnabled = false
@@ -0,0 +1,380 @@
+package ntpserver
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AEADAESSIVCMAC256 is the mandatory-to-implement NTS AEAD algorithm
+// (IANA AEAD registry identifier 15, RFC 5297).
+const AEADAESSIVCMAC256 uint16 = 15
+
+var ErrNTSNoCertificate = errors.New("ntpserver: NTS requires a TLS certificate")
+
+const (
+	ntsKeyLen       = 32 // AEAD_AES_SIV_CMAC_256
+	ntsNonceLen     = 16
+	ntsMaxCookies   = 8
+	ntsMinUIDLen    = 32
+	ntsCookieHdrLen = 4 + ntsNonceLen
+)
+
+// Event reasons used for NTS failures.
+const (
+	ntsReasonMalformed = "nts_malformed"
+	ntsReasonCookie    = "nts_bad_cookie"
+	ntsReasonAuth      = "nts_auth_failed"
+)
+
+// NTSConfig enables Network Time Security (RFC 8915).
+type NTSConfig struct {
+	// KEListenAddr is the TCP address of the NTS-KE listener. Defaults to "0.0.0.0:4460".
+	KEListenAddr string
+
+	// TLSConfig must carry the server certificate. MinVersion and NextProtos
+	// are overridden to TLS 1.3 and "ntske/1".
+	TLSConfig *tls.Config
+
+	// NTPServer and NTPPort, when set, are announced to clients in the NTS-KE
+	// server and port negotiation records.
+	NTPServer string
+	NTPPort   int
+
+	// CookieKeyRotation is how often a new cookie master key is generated. Defaults to 24h.
+	CookieKeyRotation time.Duration
+
+	// CookieKeysRetained is how many previous master keys still decrypt cookies. Defaults to 7.
+	CookieKeysRetained int
+
+	// KETimeout bounds a single NTS-KE session. Defaults to 10s.
+	KETimeout time.Duration
+}
+
+func (c NTSConfig) normalize() NTSConfig {
+	out := c
+	if out.KEListenAddr == "" {
+		out.KEListenAddr = "0.0.0.0:4460"
+	}
+	if out.CookieKeyRotation <= 0 {
+		out.CookieKeyRotation = 24 * time.Hour
+	}
+	if out.CookieKeysRetained <= 0 {
+		out.CookieKeysRetained = 7
+	}
+	if out.KETimeout <= 0 {
+		out.KETimeout = 10 * time.Second
+	}
+	return out
+}
+
+// NTSMetrics reports the state of the NTS subsystem.
+type NTSMetrics struct {
+	KEConnections         uint64    `json:"ke_connections"`
+	KEErrors              uint64    `json:"ke_errors"`
+	CookiesIssued         uint64    `json:"cookies_issued"`
+	AuthenticatedRequests uint64    `json:"authenticated_requests"`
+	NAKs                  uint64    `json:"naks"`
+	CookieKeyID           uint32    `json:"cookie_key_id"`
+	CookieKeys            int       `json:"cookie_keys"`
+	CookieKeyRotations    uint64    `json:"cookie_key_rotations"`
+	LastRotation          time.Time `json:"last_rotation"`
+}
+
+type cookieKey struct {
+	id   uint32
+	aead *aesSIV
+}
+
+type ntsState struct {
+	cfg NTSConfig
+
+	mu           sync.RWMutex
+	keys         []cookieKey // newest first
+	nextID       uint32
+	lastRotation time.Time
+
+	keConnections atomic.Uint64
+	keErrors      atomic.Uint64
+	cookiesIssued atomic.Uint64
+	authenticated atomic.Uint64
+	naks          atomic.Uint64
+	rotations     atomic.Uint64
+
+	connMu sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// ntsSession is the per-request state needed to protect the response.
+type ntsSession struct {
+	uid     ExtensionField
+	s2c     *aesSIV
+	c2s     []byte
+	s2cKey  []byte
+	aeadID  uint16
+	cookies int
+}
+
+func newNTSState(cfg NTSConfig) *ntsState {
+	n := &ntsState{cfg: cfg.normalize(), conns: make(map[net.Conn]struct{})}
+	var id [4]byte
+	_, _ = rand.Read(id[:])
+	n.nextID = binary.BigEndian.Uint32(id[:])
+	n.rotate(time.Now().UTC())
+	return n
+}
+
+// rotate installs a fresh cookie master key and drops keys beyond the retention window.
+func (n *ntsState) rotate(now time.Time) {
+	key := make([]byte, ntsKeyLen)
+	_, _ = rand.Read(key)
+	aead, err := newAESSIV(key)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	k := cookieKey{id: n.nextID, aead: aead}
+	n.nextID++
+	n.keys = append([]cookieKey{k}, n.keys...)
+	if len(n.keys) > n.cfg.CookieKeysRetained+1 {
+		n.keys = n.keys[:n.cfg.CookieKeysRetained+1]
+	}
+	n.lastRotation = now
+	n.mu.Unlock()
+}
+
+func (n *ntsState) rotateLoop(stop <-chan struct{}) {
+	defer n.wg.Done()
+	t := time.NewTicker(n.cfg.CookieKeyRotation)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			n.rotate(now.UTC())
+			n.rotations.Add(1)
+		}
+	}
+}
+
+// makeCookie encrypts the session keys under the current master key:
+// key ID (4) | nonce (16) | AES-SIV(AEAD ID (2) | reserved (2) | C2S | S2C).
+// The layout keeps cookies a multiple of 4 bytes so they need no padding
+// inside an extension field.
+func (n *ntsState) makeCookie(aeadID uint16, c2s, s2c []byte) []byte {
+	n.mu.RLock()
+	k := n.keys[0]
+	n.mu.RUnlock()
+
+	plain := make([]byte, 4, 4+len(c2s)+len(s2c))
+	binary.BigEndian.PutUint16(plain, aeadID)
+	plain = append(plain, c2s...)
+	plain = append(plain, s2c...)
+
+	out := make([]byte, ntsCookieHdrLen, ntsCookieHdrLen+len(plain)+k.aead.Overhead())
+	binary.BigEndian.PutUint32(out[0:4], k.id)
+	_, _ = rand.Read(out[4:ntsCookieHdrLen])
+	out = k.aead.Seal(out, out[4:ntsCookieHdrLen], plain, out[0:4])
+	n.cookiesIssued.Add(1)
+	return out
+}
+
+func (n *ntsState) openCookie(cookie []byte) (aeadID uint16, c2s, s2c []byte, ok bool) {
+	if len(cookie) < ntsCookieHdrLen+16 {
+		return 0, nil, nil, false
+	}
+	id := binary.BigEndian.Uint32(cookie[0:4])
+	n.mu.RLock()
+	var aead *aesSIV
+	for _, k := range n.keys {
+		if k.id == id {
+			aead = k.aead
+			break
+		}
+	}
+	n.mu.RUnlock()
+	if aead == nil {
+		return 0, nil, nil, false
+	}
+	plain, err := aead.Open(nil, cookie[4:ntsCookieHdrLen], cookie[ntsCookieHdrLen:], cookie[0:4])
+	if err != nil || len(plain) != 4+2*ntsKeyLen {
+		return 0, nil, nil, false
+	}
+	aeadID = binary.BigEndian.Uint16(plain[0:2])
+	if aeadID != AEADAESSIVCMAC256 {
+		return 0, nil, nil, false
+	}
+	return aeadID, plain[4 : 4+ntsKeyLen], plain[4+ntsKeyLen:], true
+}
+
+// isNTSRequest reports whether the request carries NTS extension fields.
+func isNTSRequest(req Packet) bool {
+	for _, e := range req.Extensions {
+		switch e.Type {
+		case ExtNTSCookie, ExtNTSAuthenticator:
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate validates the cookie and the authenticator of an NTS request.
+// raw must be the exact datagram the request was parsed from. On failure the
+// returned session still carries the Unique Identifier (if any) so that an
+// NTS NAK can be sent.
+func (n *ntsState) authenticate(req Packet, raw []byte) (*ntsSession, string) {
+	sess := &ntsSession{}
+	var cookie []byte
+	authOff := -1
+	var auth ExtensionField
+	off := PacketSize
+	for _, e := range req.Extensions {
+		switch e.Type {
+		case ExtUniqueIdentifier:
+			if sess.uid.Type == 0 {
+				sess.uid = e
+			}
+		case ExtNTSCookie:
+			if cookie == nil {
+				cookie = e.Value
+			}
+		case ExtNTSAuthenticator:
+			auth = e
+			authOff = off
+		}
+		if authOff >= 0 {
+			break
+		}
+		off += e.Len()
+	}
+	if sess.uid.Type == 0 || len(sess.uid.Value) < ntsMinUIDLen || cookie == nil || authOff < 0 {
+		return nil, ntsReasonMalformed
+	}
+	// Placeholders make the reply as large as the request; one of another
+	// size than the cookie would let the reply outgrow the request, so it
+	// does not earn a cookie (RFC 8915, section 5.5).
+	for _, e := range req.Extensions {
+		if e.Type == ExtNTSAuthenticator {
+			break
+		}
+		if e.Type == ExtNTSCookiePlaceholder && len(e.Value) == len(cookie) {
+			sess.cookies++
+		}
+	}
+
+	aeadID, c2s, s2c, ok := n.openCookie(cookie)
+	if !ok {
+		return sess, ntsReasonCookie
+	}
+	c2sAEAD, err := newAESSIV(c2s)
+	if err != nil {
+		return sess, ntsReasonCookie
+	}
+	nonce, ct, ok := parseAuthenticator(auth.Value)
+	if !ok {
+		return sess, ntsReasonAuth
+	}
+	if _, err := c2sAEAD.Open(nil, nonce, ct, raw[:authOff]); err != nil {
+		return sess, ntsReasonAuth
+	}
+	s2cAEAD, err := newAESSIV(s2c)
+	if err != nil {
+		return sess, ntsReasonAuth
+	}
+
+	sess.s2c = s2cAEAD
+	sess.aeadID = aeadID
+	sess.c2s = c2s
+	sess.s2cKey = s2c
+	sess.cookies++
+	if sess.cookies > ntsMaxCookies {
+		sess.cookies = ntsMaxCookies
+	}
+	n.authenticated.Add(1)
+	return sess, ""
+}
+
+// parseAuthenticator splits the NTS Authenticator and Encrypted Extension
+// Fields body (RFC 8915, section 5.6) into nonce and ciphertext.
+func parseAuthenticator(b []byte) (nonce, ciphertext []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	nl := int(binary.BigEndian.Uint16(b[0:2]))
+	cl := int(binary.BigEndian.Uint16(b[2:4]))
+	b = b[4:]
+	np := pad4(nl)
+	if nl < ntsNonceLen || len(b) < np+cl {
+		return nil, nil, false
+	}
+	return b[:nl], b[np : np+cl], true
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// seal appends the Unique Identifier and an authenticator carrying fresh
+// cookies to resp.
+func (n *ntsState) seal(resp Packet, sess *ntsSession) Packet {
+	resp.Extensions = append(resp.Extensions[:len(resp.Extensions):len(resp.Extensions)], sess.uid)
+	ad := resp.Marshal()
+
+	var plain []byte
+	for i := 0; i < sess.cookies; i++ {
+		c := n.makeCookie(sess.aeadID, sess.c2s, sess.s2cKey)
+		plain = ExtensionField{Type: ExtNTSCookie, Value: c}.appendTo(plain)
+	}
+
+	nonce := make([]byte, ntsNonceLen)
+	_, _ = rand.Read(nonce)
+	ct := sess.s2c.Seal(nil, nonce, plain, ad)
+
+	body := make([]byte, 4, 4+len(nonce)+pad4(len(ct)))
+	binary.BigEndian.PutUint16(body[0:2], uint16(len(nonce)))
+	binary.BigEndian.PutUint16(body[2:4], uint16(len(ct)))
+	body = append(body, nonce...)
+	body = append(body, ct...)
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	resp.Extensions = append(resp.Extensions, ExtensionField{Type: ExtNTSAuthenticator, Value: body})
+	return resp
+}
+
+// nak builds an NTS NAK (RFC 8915, section 5.7): a Kiss-o'-Death with code
+// NTSN that echoes the Unique Identifier and carries nothing else.
+func (n *ntsState) nak(req Packet, sess *ntsSession) Packet {
+	resp := BuildKissOfDeath(req, "NTSN")
+	resp.Extensions = []ExtensionField{sess.uid}
+	n.naks.Add(1)
+	return resp
+}
+
+func (n *ntsState) snapshot() *NTSMetrics {
+	n.mu.RLock()
+	keyID := n.keys[0].id
+	keys := len(n.keys)
+	last := n.lastRotation
+	n.mu.RUnlock()
+	return &NTSMetrics{
+		KEConnections:         n.keConnections.Load(),
+		KEErrors:              n.keErrors.Load(),
+		CookiesIssued:         n.cookiesIssued.Load(),
+		AuthenticatedRequests: n.authenticated.Load(),
+		NAKs:                  n.naks.Load(),
+		CookieKeyID:           keyID,
+		CookieKeys:            keys,
+		CookieKeyRotations:    n.rotations.Load(),
+		LastRotation:          last,
+	}
+}
@@ -0,0 +1,291 @@
+package ntpserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// NTS-KE (RFC 8915, section 4) protocol constants.
+const (
+	ntskeALPN          = "ntske/1"
+	ntskeExporterLabel = "EXPORTER-network-time-security"
+	ntskeProtoNTPv4    = 0
+	ntskeCritical      = 0x8000
+
+	keRecEndOfMessage = 0
+	keRecNextProtocol = 1
+	keRecError        = 2
+	keRecWarning      = 3
+	keRecAEAD         = 4
+	keRecNewCookie    = 5
+	keRecServer       = 6
+	keRecPort         = 7
+
+	keErrUnrecognizedCritical = 0
+	keErrBadRequest           = 1
+
+	// keMaxRequest caps the total size of a client's NTS-KE request.
+	keMaxRequest = 16 * 1024
+)
+
+var errKEBadRequest = errors.New("ntpserver: malformed NTS-KE request")
+
+type keRecord struct {
+	critical bool
+	typ      uint16
+	body     []byte
+}
+
+func appendKERecord(b []byte, critical bool, typ uint16, body []byte) []byte {
+	var hdr [4]byte
+	if critical {
+		typ |= ntskeCritical
+	}
+	binary.BigEndian.PutUint16(hdr[0:2], typ)
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(body)))
+	b = append(b, hdr[:]...)
+	return append(b, body...)
+}
+
+func appendKEUint16s(b []byte, critical bool, typ uint16, vals ...uint16) []byte {
+	body := make([]byte, 2*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint16(body[2*i:], v)
+	}
+	return appendKERecord(b, critical, typ, body)
+}
+
+// readKERequest reads records up to and including End of Message.
+func readKERequest(r io.Reader) ([]keRecord, error) {
+	var recs []keRecord
+	total := 0
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		typ := binary.BigEndian.Uint16(hdr[0:2])
+		n := int(binary.BigEndian.Uint16(hdr[2:4]))
+		total += 4 + n
+		if total > keMaxRequest {
+			return nil, errKEBadRequest
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		rec := keRecord{critical: typ&ntskeCritical != 0, typ: typ &^ ntskeCritical, body: body}
+		recs = append(recs, rec)
+		if rec.typ == keRecEndOfMessage {
+			return recs, nil
+		}
+	}
+}
+
+func keUint16s(body []byte) ([]uint16, bool) {
+	if len(body)%2 != 0 {
+		return nil, false
+	}
+	out := make([]uint16, len(body)/2)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint16(body[2*i:])
+	}
+	return out, true
+}
+
+// listenKE starts the NTS-KE TLS listener.
+func (n *ntsState) listenKE(stop <-chan struct{}) error {
+	if n.cfg.TLSConfig == nil || (len(n.cfg.TLSConfig.Certificates) == 0 && n.cfg.TLSConfig.GetCertificate == nil) {
+		return ErrNTSNoCertificate
+	}
+	tcfg := n.cfg.TLSConfig.Clone()
+	tcfg.MinVersion = tls.VersionTLS13
+	tcfg.NextProtos = []string{ntskeALPN}
+
+	ln, err := net.Listen("tcp", n.cfg.KEListenAddr)
+	if err != nil {
+		return err
+	}
+	n.connMu.Lock()
+	n.ln = ln
+	n.connMu.Unlock()
+
+	n.wg.Add(2)
+	go n.acceptLoop(tls.NewListener(ln, tcfg))
+	go n.rotateLoop(stop)
+	return nil
+}
+
+// keAddr returns the bound NTS-KE address, or "" if the listener is not running.
+func (n *ntsState) keAddr() string {
+	n.connMu.Lock()
+	defer n.connMu.Unlock()
+	if n.ln == nil {
+		return ""
+	}
+	return n.ln.Addr().String()
+}
+
+// closeKE stops the listener, aborts in-flight sessions and waits for the
+// NTS goroutines to exit.
+func (n *ntsState) closeKE() {
+	n.connMu.Lock()
+	if n.ln != nil {
+		_ = n.ln.Close()
+		n.ln = nil
+	}
+	for c := range n.conns {
+		_ = c.Close()
+	}
+	n.connMu.Unlock()
+	n.wg.Wait()
+}
+
+func (n *ntsState) acceptLoop(ln net.Listener) {
+	defer n.wg.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		n.connMu.Lock()
+		if n.ln == nil {
+			n.connMu.Unlock()
+			_ = c.Close()
+			return
+		}
+		n.conns[c] = struct{}{}
+		n.connMu.Unlock()
+
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.keConnections.Add(1)
+			if err := n.serveKE(c.(*tls.Conn)); err != nil {
+				n.keErrors.Add(1)
+			}
+			_ = c.Close()
+			n.connMu.Lock()
+			delete(n.conns, c)
+			n.connMu.Unlock()
+		}()
+	}
+}
+
+// serveKE runs a single NTS-KE session: negotiate protocol and AEAD, export
+// the C2S/S2C keys and reply with a batch of cookies.
+func (n *ntsState) serveKE(c *tls.Conn) error {
+	_ = c.SetDeadline(time.Now().Add(n.cfg.KETimeout))
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	cs := c.ConnectionState()
+	if cs.NegotiatedProtocol != ntskeALPN {
+		return errKEBadRequest
+	}
+
+	recs, err := readKERequest(bufio.NewReader(c))
+	if err != nil {
+		return err
+	}
+
+	var protos, aeads []uint16
+	sawProto, sawAEAD := false, false
+	for _, r := range recs {
+		switch r.typ {
+		case keRecEndOfMessage, keRecServer, keRecPort, keRecWarning:
+		case keRecNextProtocol:
+			v, ok := keUint16s(r.body)
+			if !ok || sawProto {
+				return n.keError(c, keErrBadRequest)
+			}
+			protos, sawProto = v, true
+		case keRecAEAD:
+			v, ok := keUint16s(r.body)
+			if !ok || sawAEAD {
+				return n.keError(c, keErrBadRequest)
+			}
+			aeads, sawAEAD = v, true
+		default:
+			if r.critical {
+				return n.keError(c, keErrUnrecognizedCritical)
+			}
+		}
+	}
+	if !sawProto || !sawAEAD {
+		return n.keError(c, keErrBadRequest)
+	}
+
+	var out []byte
+	if !containsUint16(protos, ntskeProtoNTPv4) {
+		// Decline: an empty Next Protocol record means no supported protocol.
+		out = appendKERecord(out, true, keRecNextProtocol, nil)
+		out = appendKERecord(out, true, keRecEndOfMessage, nil)
+		_, err := c.Write(out)
+		return err
+	}
+	if !containsUint16(aeads, AEADAESSIVCMAC256) {
+		out = appendKEUint16s(out, true, keRecNextProtocol, ntskeProtoNTPv4)
+		out = appendKERecord(out, false, keRecAEAD, nil)
+		out = appendKERecord(out, true, keRecEndOfMessage, nil)
+		_, err := c.Write(out)
+		return err
+	}
+
+	c2s, err := exportNTSKey(cs, AEADAESSIVCMAC256, 0x00)
+	if err != nil {
+		return n.keError(c, keErrBadRequest)
+	}
+	s2c, err := exportNTSKey(cs, AEADAESSIVCMAC256, 0x01)
+	if err != nil {
+		return n.keError(c, keErrBadRequest)
+	}
+
+	out = appendKEUint16s(out, true, keRecNextProtocol, ntskeProtoNTPv4)
+	out = appendKEUint16s(out, false, keRecAEAD, AEADAESSIVCMAC256)
+	for i := 0; i < ntsMaxCookies; i++ {
+		out = appendKERecord(out, false, keRecNewCookie, n.makeCookie(AEADAESSIVCMAC256, c2s, s2c))
+	}
+	if n.cfg.NTPServer != "" {
+		out = appendKERecord(out, false, keRecServer, []byte(n.cfg.NTPServer))
+	}
+	if n.cfg.NTPPort > 0 {
+		out = appendKEUint16s(out, false, keRecPort, uint16(n.cfg.NTPPort))
+	}
+	out = appendKERecord(out, true, keRecEndOfMessage, nil)
+	_, err = c.Write(out)
+	return err
+}
+
+func (n *ntsState) keError(c *tls.Conn, code uint16) error {
+	var out []byte
+	out = appendKEUint16s(out, true, keRecError, code)
+	out = appendKERecord(out, true, keRecEndOfMessage, nil)
+	_, _ = c.Write(out)
+	return errors.New("ntpserver: NTS-KE error " + strconv.Itoa(int(code)))
+}
+
+// exportNTSKey derives the C2S (dir 0) or S2C (dir 1) key, RFC 8915 section 5.1.
+func exportNTSKey(cs tls.ConnectionState, aeadID uint16, dir byte) ([]byte, error) {
+	ctx := []byte{byte(ntskeProtoNTPv4 >> 8), byte(ntskeProtoNTPv4), byte(aeadID >> 8), byte(aeadID), dir}
+	return cs.ExportKeyingMaterial(ntskeExporterLabel, ctx, ntsKeyLen)
+}
+
+func containsUint16(vals []uint16, v uint16) bool {
+	for _, x := range vals {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
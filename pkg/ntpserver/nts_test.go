@@ -0,0 +1,353 @@
+package ntpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+type ntsClientState struct {
+	c2s, s2c []byte
+	cookies  [][]byte
+}
+
+// ntsKE performs a client NTS-KE exchange against addr.
+func ntsKE(t *testing.T, addr string, pool *x509.CertPool) ntsClientState {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", NextProtos: []string{ntskeALPN}, MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatalf("tls dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var req []byte
+	req = appendKEUint16s(req, true, keRecNextProtocol, ntskeProtoNTPv4)
+	req = appendKEUint16s(req, false, keRecAEAD, AEADAESSIVCMAC256)
+	req = appendKERecord(req, true, keRecEndOfMessage, nil)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write ke request: %v", err)
+	}
+	recs, err := readKERequest(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatalf("read ke response: %v", err)
+	}
+
+	var st ntsClientState
+	for _, r := range recs {
+		switch r.typ {
+		case keRecError:
+			t.Fatalf("ke error record: %x", r.body)
+		case keRecNewCookie:
+			st.cookies = append(st.cookies, r.body)
+		}
+	}
+	cs := conn.ConnectionState()
+	if st.c2s, err = exportNTSKey(cs, AEADAESSIVCMAC256, 0x00); err != nil {
+		t.Fatalf("export c2s: %v", err)
+	}
+	if st.s2c, err = exportNTSKey(cs, AEADAESSIVCMAC256, 0x01); err != nil {
+		t.Fatalf("export s2c: %v", err)
+	}
+	return st
+}
+
+// ntsRequest builds an authenticated client request using the given cookie;
+// extra fields go between the cookie and the authenticator. The last of them
+// must be at least 28 bytes long, as it is marshalled as the last field.
+func ntsRequest(t *testing.T, st ntsClientState, cookie []byte, uid []byte, extra ...ExtensionField) []byte {
+	t.Helper()
+	p := Packet{
+		VN:       4,
+		Mode:     ModeClient,
+		Transmit: timeToTimestamp(time.Now()),
+		Extensions: append([]ExtensionField{
+			{Type: ExtUniqueIdentifier, Value: uid},
+			{Type: ExtNTSCookie, Value: cookie},
+		}, extra...),
+	}
+	ad := p.Marshal()
+	aead, err := newAESSIV(st.c2s)
+	if err != nil {
+		t.Fatalf("c2s aead: %v", err)
+	}
+	nonce := make([]byte, ntsNonceLen)
+	_, _ = rand.Read(nonce)
+	ct := aead.Seal(nil, nonce, nil, ad)
+	body := make([]byte, 4, 4+len(nonce)+len(ct))
+	binary.BigEndian.PutUint16(body[0:2], uint16(len(nonce)))
+	binary.BigEndian.PutUint16(body[2:4], uint16(len(ct)))
+	body = append(append(body, nonce...), ct...)
+	auth := ExtensionField{Type: ExtNTSAuthenticator, Value: body}
+	return auth.appendTo(ad)
+}
+
+func TestNTS_KEAndAuthenticatedExchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cert, pool := testCertificate(t)
+	srv := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Network:    "udp4",
+		NTS: &NTSConfig{
+			KEListenAddr: "127.0.0.1:0",
+			TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		},
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	st := ntsKE(t, srv.NTSKEAddr(), pool)
+	if len(st.cookies) != ntsMaxCookies {
+		t.Fatalf("cookies: got=%d want=%d", len(st.cookies), ntsMaxCookies)
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp4", srv.Addr())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	c, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+
+	uid := make([]byte, 32)
+	_, _ = rand.Read(uid)
+	if _, err := c.Write(ntsRequest(t, st, st.cookies[0], uid)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	resp, ok := ParsePacket(buf[:n])
+	if !ok {
+		t.Fatalf("parse response")
+	}
+	if resp.Stratum == 0 {
+		t.Fatalf("unexpected kiss-o'-death: refid=%08x", resp.RefID)
+	}
+	if len(resp.Extensions) != 2 || resp.Extensions[0].Type != ExtUniqueIdentifier || resp.Extensions[1].Type != ExtNTSAuthenticator {
+		t.Fatalf("response extensions: %+v", resp.Extensions)
+	}
+	if string(resp.Extensions[0].Value) != string(uid) {
+		t.Fatalf("unique identifier not echoed")
+	}
+
+	authOff := PacketSize + resp.Extensions[0].Len()
+	nonce, ct, ok := parseAuthenticator(resp.Extensions[1].Value)
+	if !ok {
+		t.Fatalf("parse authenticator")
+	}
+	s2c, _ := newAESSIV(st.s2c)
+	plain, err := s2c.Open(nil, nonce, ct, buf[:authOff])
+	if err != nil {
+		t.Fatalf("response authentication: %v", err)
+	}
+	exts, _, err := parseExtensions(plain)
+	if err != nil || len(exts) != 1 || exts[0].Type != ExtNTSCookie {
+		t.Fatalf("encrypted cookies: exts=%+v err=%v", exts, err)
+	}
+
+	m := srv.Metrics()
+	if m.NTS == nil || m.NTS.AuthenticatedRequests != 1 || m.NTS.KEConnections != 1 {
+		t.Fatalf("nts metrics: %+v", m.NTS)
+	}
+}
+
+func TestNTS_PlaceholdersMustMatchCookieSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cert, pool := testCertificate(t)
+	srv := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Network:    "udp4",
+		NTS: &NTSConfig{
+			KEListenAddr: "127.0.0.1:0",
+			TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		},
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	st := ntsKE(t, srv.NTSKEAddr(), pool)
+	c, err := net.Dial("udp4", srv.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+
+	// Only the two placeholders as large as the cookie earn a cookie each.
+	cookie := st.cookies[0]
+	uid := make([]byte, 32)
+	_, _ = rand.Read(uid)
+	req := ntsRequest(t, st, cookie, uid,
+		ExtensionField{Type: ExtNTSCookiePlaceholder, Value: make([]byte, 12)},
+		ExtensionField{Type: ExtNTSCookiePlaceholder, Value: make([]byte, len(cookie))},
+		ExtensionField{Type: ExtNTSCookiePlaceholder, Value: make([]byte, len(cookie)-4)},
+		ExtensionField{Type: ExtNTSCookiePlaceholder, Value: make([]byte, len(cookie))},
+	)
+	if _, err := c.Write(req); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if n > len(req) {
+		t.Fatalf("reply larger than request: got=%d request=%d", n, len(req))
+	}
+	resp, ok := ParsePacket(buf[:n])
+	if !ok || len(resp.Extensions) != 2 {
+		t.Fatalf("response: ok=%v extensions=%+v", ok, resp.Extensions)
+	}
+	nonce, ct, ok := parseAuthenticator(resp.Extensions[1].Value)
+	if !ok {
+		t.Fatalf("parse authenticator")
+	}
+	s2c, _ := newAESSIV(st.s2c)
+	plain, err := s2c.Open(nil, nonce, ct, buf[:PacketSize+resp.Extensions[0].Len()])
+	if err != nil {
+		t.Fatalf("response authentication: %v", err)
+	}
+	exts, _, err := parseExtensions(plain)
+	if err != nil || len(exts) != 3 {
+		t.Fatalf("cookies: got=%d want=3 err=%v", len(exts), err)
+	}
+}
+
+func TestNTS_BadCookieGetsNAK(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cert, pool := testCertificate(t)
+	srv := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Network:    "udp4",
+		NTS: &NTSConfig{
+			KEListenAddr: "127.0.0.1:0",
+			TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		},
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	st := ntsKE(t, srv.NTSKEAddr(), pool)
+	cookie := append([]byte(nil), st.cookies[0]...)
+	cookie[len(cookie)-1] ^= 0xff
+
+	raddr, _ := net.ResolveUDPAddr("udp4", srv.Addr())
+	c, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+
+	uid := make([]byte, 32)
+	if _, err := c.Write(ntsRequest(t, st, cookie, uid)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	resp, ok := ParsePacket(buf[:n])
+	if !ok {
+		t.Fatalf("parse response")
+	}
+	if resp.Stratum != 0 || resp.RefID != refIDFromASCII4("NTSN") {
+		t.Fatalf("expected NTSN kiss, got stratum=%d refid=%08x", resp.Stratum, resp.RefID)
+	}
+	if len(resp.Extensions) != 1 || resp.Extensions[0].Type != ExtUniqueIdentifier {
+		t.Fatalf("nak extensions: %+v", resp.Extensions)
+	}
+	if m := srv.Metrics(); m.NTS.NAKs != 1 {
+		t.Fatalf("naks: got=%d want=1", m.NTS.NAKs)
+	}
+
+	// The NAK is counted as an error only; the event is published after the
+	// counters are updated.
+	if ev := waitForEvent(t, events, ModeClient); !ev.Responded || ev.Error == "" {
+		t.Fatalf("event: %+v", ev)
+	}
+	m := srv.Metrics()
+	if m.TotalResponses != 0 || m.TotalErrors != 1 || len(m.ErrorsByReason) != 1 {
+		t.Fatalf("responses=%d errors=%d by reason=%v", m.TotalResponses, m.TotalErrors, m.ErrorsByReason)
+	}
+}
+
+func TestNTS_CookieKeyRotationKeepsOldKeys(t *testing.T) {
+	n := newNTSState(NTSConfig{CookieKeysRetained: 1})
+	c2s := make([]byte, ntsKeyLen)
+	s2c := make([]byte, ntsKeyLen)
+	old := n.makeCookie(AEADAESSIVCMAC256, c2s, s2c)
+
+	n.rotate(time.Now())
+	if _, _, _, ok := n.openCookie(old); !ok {
+		t.Fatalf("cookie from previous key should still open")
+	}
+	n.rotate(time.Now())
+	if _, _, _, ok := n.openCookie(old); ok {
+		t.Fatalf("cookie from expired key should be rejected")
+	}
+}
+
+func TestNTS_StartWithoutCertificateFails(t *testing.T) {
+	srv := New(Config{ListenAddr: "127.0.0.1:0", NTS: &NTSConfig{KEListenAddr: "127.0.0.1:0"}})
+	if err := srv.Start(context.Background()); err != ErrNTSNoCertificate {
+		t.Fatalf("expected ErrNTSNoCertificate, got=%v", err)
+	}
+}
@@ -2,14 +2,19 @@ package ntpserver
 
 import (
 	"encoding/binary"
+	"io"
 	"time"
 )
 
 const (
 	PacketSize = 48
 
-	ModeClient = 3
-	ModeServer = 4
+	ModeSymmetricActive  = 1
+	ModeSymmetricPassive = 2
+	ModeClient           = 3
+	ModeServer           = 4
+	ModeBroadcast        = 5
+	ModeControl          = 6
 )
 
 // Timestamp is the 64-bit NTP timestamp (32-bit seconds, 32-bit fraction).
@@ -25,8 +30,7 @@ func timeToTimestamp(t time.Time) Timestamp {
 	return Timestamp((seconds << 32) | (fraction & 0xffffffff))
 }
 
-// Packet is the base NTPv4 (RFC 5905) header.
-// Extension fields are intentionally not parsed in this initial version.
+// Packet is an NTPv4 (RFC 5905) header followed by optional extension fields (RFC 7822).
 type Packet struct {
 	LI      uint8
 	VN      uint8
@@ -43,6 +47,32 @@ type Packet struct {
 	Originate Timestamp
 	Receive   Timestamp
 	Transmit  Timestamp
+
+	// Extensions are the extension fields following the header, in wire order.
+	Extensions []ExtensionField
+
+	// MAC is the optional symmetric-key authentication trailer.
+	MAC *MAC
+}
+
+// MAC is the legacy message authentication code trailer (RFC 5905, section 7.3):
+// a key ID followed by a digest. A crypto-NAK is a MAC with key ID 0 and no digest.
+type MAC struct {
+	KeyID  uint32
+	Digest []byte
+}
+
+// Len returns the on-wire length of the trailer.
+func (m *MAC) Len() int {
+	if m == nil {
+		return 0
+	}
+	return 4 + len(m.Digest)
+}
+
+// IsCryptoNAK reports whether the trailer is a crypto-NAK.
+func (m *MAC) IsCryptoNAK() bool {
+	return m != nil && m.KeyID == 0 && len(m.Digest) == 0
 }
 
 func ParsePacket(b []byte) (Packet, bool) {
@@ -66,11 +96,67 @@ func ParsePacket(b []byte) (Packet, bool) {
 		Receive:        Timestamp(binary.BigEndian.Uint64(b[32:40])),
 		Transmit:       Timestamp(binary.BigEndian.Uint64(b[40:48])),
 	}
+	rest := b[PacketSize:]
+	if p.VN == 4 && len(rest) > 0 {
+		exts, n, err := parseExtensions(rest)
+		if err != nil {
+			return Packet{}, false
+		}
+		p.Extensions = exts
+		rest = rest[n:]
+	}
+	if isMACTrailer(len(rest)) {
+		p.MAC = &MAC{KeyID: binary.BigEndian.Uint32(rest[0:4])}
+		if len(rest) > 4 {
+			p.MAC.Digest = append([]byte(nil), rest[4:]...)
+		}
+	}
 	return p, true
 }
 
+// Marshal returns the encoded packet, or nil if MarshalTo rejects it.
 func (p Packet) Marshal() []byte {
-	b := make([]byte, PacketSize)
+	b := make([]byte, p.Len())
+	if _, err := p.MarshalTo(b); err != nil {
+		return nil
+	}
+	return b
+}
+
+// Len returns the size of the marshalled packet.
+func (p Packet) Len() int {
+	size := PacketSize + p.MAC.Len()
+	for i, e := range p.Extensions {
+		size += e.paddedLen(p.extMinLen(i))
+	}
+	return size
+}
+
+// extMinLen returns the size extension field i is padded to. Without a MAC
+// the last field is padded to 28 bytes, so that a receiver does not read a
+// 16- or 20-byte field as a MAC.
+func (p Packet) extMinLen(i int) int {
+	if p.MAC == nil && i == len(p.Extensions)-1 {
+		return extLastMinLen
+	}
+	return extMinLen
+}
+
+// MarshalTo writes the packet to the start of dst and returns the number of
+// bytes written. It returns ErrExtensionTooLong if an extension field is
+// longer than its length word allows, or io.ErrShortBuffer if dst is shorter
+// than p.Len(). It does not allocate.
+func (p Packet) MarshalTo(dst []byte) (int, error) {
+	for i, e := range p.Extensions {
+		if e.paddedLen(p.extMinLen(i)) > extMaxLen {
+			return 0, ErrExtensionTooLong
+		}
+	}
+	size := p.Len()
+	if len(dst) < size {
+		return 0, io.ErrShortBuffer
+	}
+	b := dst[:PacketSize]
 	b[0] = ((p.LI & 0x3) << 6) | ((p.VN & 0x7) << 3) | (p.Mode & 0x7)
 	b[1] = p.Stratum
 	b[2] = byte(p.Poll)
@@ -82,7 +168,15 @@ func (p Packet) Marshal() []byte {
 	binary.BigEndian.PutUint64(b[24:32], uint64(p.Originate))
 	binary.BigEndian.PutUint64(b[32:40], uint64(p.Receive))
 	binary.BigEndian.PutUint64(b[40:48], uint64(p.Transmit))
-	return b
+	// dst has room for everything, so the appends stay in place.
+	for i, e := range p.Extensions {
+		b = e.appendPadded(b, p.extMinLen(i))
+	}
+	if p.MAC != nil {
+		b = binary.BigEndian.AppendUint32(b, p.MAC.KeyID)
+		b = append(b, p.MAC.Digest...)
+	}
+	return len(b), nil
 }
 
 func refIDFromASCII4(s string) uint32 {
@@ -114,15 +208,40 @@ func BuildResponse(req Packet, cfg responseConfig, receivedAt time.Time, transmi
 		Receive:   timeToTimestamp(receivedAt),
 		Transmit:  timeToTimestamp(transmittedAt),
 	}
+	if cfg.ReferenceTime.IsZero() {
+		// Never synchronized.
+		resp.Reference = 0
+	}
 	return resp
 }
 
+// BuildKissOfDeath returns a Kiss-o'-Death reply (RFC 5905, section 7.4) with
+// the given four-letter code as RefID. Like ntpd, the client's transmit
+// timestamp is copied into every timestamp so the reply carries no time.
+func BuildKissOfDeath(req Packet, code string) Packet {
+	vn := req.VN
+	if vn == 0 {
+		vn = 4
+	}
+	return Packet{
+		LI:        3,
+		VN:        vn,
+		Mode:      ModeServer,
+		Stratum:   0,
+		Poll:      req.Poll,
+		RefID:     refIDFromASCII4(code),
+		Originate: req.Transmit,
+		Receive:   req.Transmit,
+		Transmit:  req.Transmit,
+	}
+}
+
 type responseConfig struct {
-	LeapIndicator uint8
-	Stratum       uint8
-	Precision     int8
-	RootDelay     uint32
+	LeapIndicator  uint8
+	Stratum        uint8
+	Precision      int8
+	RootDelay      uint32
 	RootDispersion uint32
-	RefID         uint32
-	ReferenceTime time.Time
+	RefID          uint32
+	ReferenceTime  time.Time
 }
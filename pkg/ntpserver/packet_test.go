@@ -1,6 +1,9 @@
 package ntpserver
 
 import (
+	"bytes"
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -40,7 +43,7 @@ func TestPacket_MarshalParse_RoundTrip(t *testing.T) {
 	if !ok {
 		t.Fatalf("expected parse ok")
 	}
-	if p2 != p {
+	if !reflect.DeepEqual(p2, p) {
 		t.Fatalf("packet mismatch after roundtrip:\n got=%+v\nwant=%+v", p2, p)
 	}
 }
@@ -81,3 +84,131 @@ func TestBuildResponse_BasicFields(t *testing.T) {
 		t.Fatalf("unexpected transmit timestamp")
 	}
 }
+
+func TestPacket_Extensions_RoundTrip(t *testing.T) {
+	p := Packet{
+		VN:       4,
+		Mode:     ModeClient,
+		Transmit: Timestamp(0x0102030405060708),
+		Extensions: []ExtensionField{
+			{Type: ExtUniqueIdentifier, Value: bytes.Repeat([]byte{0xab}, 32)},
+			// 5-byte body pads to the 28-byte minimum size of a last field
+			// without a MAC.
+			{Type: 0x2005, Value: []byte{1, 2, 3, 4, 5}},
+		},
+	}
+
+	b := p.Marshal()
+	if want := PacketSize + 36 + 28; len(b) != want {
+		t.Fatalf("marshal size: got=%d want=%d", len(b), want)
+	}
+
+	p2, ok := ParsePacket(b)
+	if !ok {
+		t.Fatalf("expected parse ok")
+	}
+	if len(p2.Extensions) != 2 {
+		t.Fatalf("extensions: got=%d want=%d", len(p2.Extensions), 2)
+	}
+	uid, ok := p2.Extension(ExtUniqueIdentifier)
+	if !ok || !bytes.Equal(uid.Value, p.Extensions[0].Value) {
+		t.Fatalf("unique identifier mismatch: %+v", uid)
+	}
+	// Padding is preserved on parse so the packet re-marshals identically.
+	if got := p2.Extensions[1].Value; len(got) != 24 || !bytes.Equal(got[:5], []byte{1, 2, 3, 4, 5}) {
+		t.Fatalf("padded value: got=%x", got)
+	}
+	if !bytes.Equal(p2.Marshal(), b) {
+		t.Fatalf("re-marshal mismatch")
+	}
+}
+
+func TestPacket_LastExtensionNotTakenForMAC(t *testing.T) {
+	for _, n := range []int{16, 20} {
+		p := Packet{VN: 4, Mode: ModeClient, Extensions: []ExtensionField{
+			{Type: ExtUniqueIdentifier, Value: bytes.Repeat([]byte{0xab}, 32)},
+			{Type: 0x2005, Value: bytes.Repeat([]byte{0xcd}, n)},
+		}}
+		b := p.Marshal()
+		if want := PacketSize + 36 + 28; len(b) != want {
+			t.Fatalf("body %d: marshal size: got=%d want=%d", n, len(b), want)
+		}
+		p2, ok := ParsePacket(b)
+		if !ok || p2.MAC != nil || len(p2.Extensions) != 2 {
+			t.Fatalf("body %d: parse ok=%v mac=%v extensions=%d", n, ok, p2.MAC, len(p2.Extensions))
+		}
+		if got := p2.Extensions[1].Value; len(got) != 24 || !bytes.Equal(got[:n], p.Extensions[1].Value) {
+			t.Fatalf("body %d: value: got=%x", n, got)
+		}
+
+		// With a MAC the field keeps its size.
+		p.MAC = &MAC{KeyID: 1, Digest: make([]byte, 16)}
+		b = p.Marshal()
+		if want := PacketSize + 36 + 4 + n + 20; len(b) != want {
+			t.Fatalf("body %d with MAC: marshal size: got=%d want=%d", n, len(b), want)
+		}
+		if p2, ok := ParsePacket(b); !ok || p2.MAC == nil || p2.MAC.KeyID != 1 || len(p2.Extensions) != 2 {
+			t.Fatalf("body %d with MAC: parse ok=%v mac=%v extensions=%d", n, ok, p2.MAC, len(p2.Extensions))
+		}
+	}
+}
+
+func TestParsePacket_ExtensionLengthChecks(t *testing.T) {
+	hdr := Packet{VN: 4, Mode: ModeClient}.Marshal()
+
+	cases := []struct {
+		name string
+		ext  []byte
+		ok   bool
+	}{
+		{"mac trailer ignored", make([]byte, 20), true},
+		{"crypto-nak ignored", make([]byte, 4), true},
+		{"length below minimum", []byte{0x01, 0x04, 0x00, 0x0c, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, false},
+		{"length not multiple of 4", []byte{0x01, 0x04, 0x00, 0x12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, false},
+		{"length past end", []byte{0x01, 0x04, 0x00, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, false},
+		{"short trailing bytes", make([]byte, 8), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := append(append([]byte(nil), hdr...), tc.ext...)
+			p, ok := ParsePacket(b)
+			if ok != tc.ok {
+				t.Fatalf("parse ok: got=%v want=%v", ok, tc.ok)
+			}
+			if ok && len(p.Extensions) != 0 {
+				t.Fatalf("expected no extensions, got=%d", len(p.Extensions))
+			}
+		})
+	}
+}
+
+func TestPacket_MarshalRejectsOversizedExtension(t *testing.T) {
+	buf := make([]byte, 1<<17)
+	for _, tc := range []struct {
+		body int
+		ok   bool
+	}{
+		{extMaxLen - extHeaderLen, true},
+		{extMaxLen - extHeaderLen + 1, false}, // padded to 0x10000, which wraps to 0
+		{0x10000, false},
+	} {
+		p := Packet{VN: 4, Mode: ModeClient, Extensions: []ExtensionField{{Type: ExtUniqueIdentifier, Value: make([]byte, tc.body)}}}
+		n, err := p.MarshalTo(buf)
+		if !tc.ok {
+			if !errors.Is(err, ErrExtensionTooLong) || n != 0 {
+				t.Fatalf("body %d: n=%d err=%v want=%v", tc.body, n, err, ErrExtensionTooLong)
+			}
+			if b := p.Marshal(); b != nil {
+				t.Fatalf("body %d: Marshal returned %d bytes", tc.body, len(b))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("body %d: %v", tc.body, err)
+		}
+		p2, ok := ParsePacket(buf[:n])
+		if !ok || len(p2.Extensions) != 1 || len(p2.Extensions[0].Value) != tc.body {
+			t.Fatalf("body %d: parse ok=%v extensions=%d", tc.body, ok, len(p2.Extensions))
+		}
+	}
+}
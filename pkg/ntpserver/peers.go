@@ -0,0 +1,344 @@
+package ntpserver
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/marcuoli/go-ntpserver/pkg/clockselect"
+)
+
+const (
+	// maxPassivePeers bounds the associations mobilized by incoming mode 1 packets.
+	maxPassivePeers = 64
+	// passivePeerPolls is how many poll intervals a passive association may
+	// stay silent before it is demobilized.
+	passivePeerPolls = 8
+)
+
+var errPeerUnsync = errors.New("ntpserver: peer is not synchronized")
+
+// PeerStatus describes one symmetric (mode 1/2) association. The embedded
+// UpstreamStatus carries the same per-source state as for an upstream server.
+type PeerStatus struct {
+	UpstreamStatus
+
+	// HostMode is ModeSymmetricActive for configured peers and
+	// ModeSymmetricPassive for associations mobilized by the remote peer.
+	HostMode uint8 `json:"host_mode"`
+	// PeerMode is the mode of the last valid packet from the peer.
+	PeerMode uint8 `json:"peer_mode"`
+
+	// Org, Rec and Xmt are the RFC 5905 peer timestamps: the peer's last
+	// transmit timestamp, when that packet was received, and the transmit
+	// timestamp of the last packet sent to the peer.
+	Org Timestamp `json:"org"`
+	Rec Timestamp `json:"rec"`
+	Xmt Timestamp `json:"xmt"`
+
+	// Duplicates and Bogus count packets rejected by the timestamp checks.
+	Duplicates uint64 `json:"duplicates"`
+	Bogus      uint64 `json:"bogus"`
+}
+
+type association struct {
+	id     uint16 // mode 6 association ID
+	status PeerStatus
+	filter clockselect.Filter
+	addr   netip.AddrPort
+	lastRx time.Time
+}
+
+// addrPortOf returns raddr with IPv4-mapped addresses unmapped, so the same
+// peer matches on udp and udp4 sockets. Addresses of other transports are
+// parsed from their string form; the result is invalid if that fails.
+func addrPortOf(raddr net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	switch a := raddr.(type) {
+	case nil:
+		return ap
+	case *net.UDPAddr:
+		if a == nil {
+			return ap
+		}
+		ap = a.AddrPort()
+	default:
+		ap, _ = netip.ParseAddrPort(raddr.String())
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+func (u *upstreamSet) lookupAssocLocked(from netip.AddrPort) *association {
+	for _, a := range u.assocs {
+		if a.addr == from {
+			return a
+		}
+	}
+	return nil
+}
+
+func (u *upstreamSet) passiveAllowed(addr netip.Addr) bool {
+	for _, p := range u.passive {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// expirePassiveLocked demobilizes passive associations that went silent.
+func (u *upstreamSet) expirePassiveLocked(now time.Time) {
+	timeout := passivePeerPolls * u.interval
+	kept := u.assocs[:0]
+	for _, a := range u.assocs {
+		if a.status.HostMode == ModeSymmetricPassive && now.Sub(a.lastRx) > timeout {
+			continue
+		}
+		kept = append(kept, a)
+	}
+	for i := len(kept); i < len(u.assocs); i++ {
+		u.assocs[i] = nil
+	}
+	u.assocs = kept
+}
+
+// receivePeer runs the RFC 5905 receive and packet processes for a mode 1 or
+// 2 packet. It returns the association, whether a passive reply is due, and
+// a non-empty reason when the packet was rejected. Without mobilize, no new
+// passive association is created.
+func (u *upstreamSet) receivePeer(req Packet, from netip.AddrPort, rx time.Time, mobilize bool) (*association, bool, string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.expirePassiveLocked(rx)
+	a := u.lookupAssocLocked(from)
+	if a == nil {
+		if req.Mode == ModeSymmetricActive && !mobilize {
+			return nil, false, "restricted_nopeer"
+		}
+		if req.Mode != ModeSymmetricActive || !u.passiveAllowed(from.Addr()) {
+			return nil, false, "no_association"
+		}
+		n := 0
+		for _, x := range u.assocs {
+			if x.status.HostMode == ModeSymmetricPassive {
+				n++
+			}
+		}
+		if n >= maxPassivePeers {
+			return nil, false, "peer_limit"
+		}
+		a = &association{id: u.nextAssocID, addr: from}
+		u.nextAssocID++
+		a.status.Address = from.String()
+		a.status.HostMode = ModeSymmetricPassive
+		a.filter.Precision = precisionToDuration(u.precision)
+		u.assocs = append(u.assocs, a)
+	}
+	if a.status.HostMode == ModeSymmetricPassive && req.Mode != ModeSymmetricActive {
+		// Two passive ends never exchange packets.
+		return a, false, "invalid_request"
+	}
+	if req.Transmit == 0 {
+		return a, false, "invalid_request"
+	}
+	if req.Transmit == a.status.Org {
+		a.status.Duplicates++
+		return a, false, "peer_duplicate"
+	}
+
+	// The origin timestamp must echo our last transmit; either way the
+	// peer's timestamps are saved so the next exchange can resynchronize.
+	bogus := req.Originate != a.status.Xmt
+	a.status.Org = req.Transmit
+	a.status.Rec = timeToTimestamp(rx)
+	a.lastRx = rx
+	reply := a.status.HostMode == ModeSymmetricPassive
+	if bogus {
+		a.status.Bogus++
+		return a, reply, "peer_bogus"
+	}
+
+	if a.status.HostMode == ModeSymmetricPassive {
+		a.status.Reach <<= 1
+	}
+	a.status.Reach |= 1
+	a.status.PeerMode = req.Mode
+	a.status.Resolved = from.String()
+	a.status.Stratum = req.Stratum
+	a.status.RefID = req.RefID
+	a.status.LeapIndicator = req.LI
+	a.status.RootDelay = shortToDuration(req.RootDelay)
+	a.status.RootDispersion = shortToDuration(req.RootDispersion)
+	if req.Originate == 0 || req.Receive == 0 {
+		// The peer has not heard from us yet: nothing to measure.
+		return a, reply, ""
+	}
+	if req.LI == leapAlarm || req.Stratum == 0 || req.Stratum >= stratumUnsync {
+		a.status.LastError = errPeerUnsync.Error()
+		u.updateSystemLocked()
+		return a, reply, ""
+	}
+
+	t1 := timestampToTime(req.Originate)
+	t2 := timestampToTime(req.Receive)
+	t3 := timestampToTime(req.Transmit)
+	offset := (t2.Sub(t1) + t3.Sub(rx)) / 2
+	delay := rx.Sub(t1) - t3.Sub(t2)
+	if delay < 0 {
+		delay = 0
+	}
+	disp := precisionToDuration(u.precision) + precisionToDuration(req.Prec) + time.Duration(float64(rx.Sub(t1))*phi)
+	if res, ok := a.filter.Add(clockselect.Sample{Offset: offset, Delay: delay, Dispersion: disp, At: rx}); ok {
+		a.status.Offset = res.Offset
+		a.status.Delay = res.Delay
+		a.status.Dispersion = res.Dispersion
+		a.status.Jitter = res.Jitter
+		a.status.LastSample = res.At
+	}
+	a.status.LastError = ""
+	u.updateSystemLocked()
+	return a, reply, ""
+}
+
+// peerPacket builds the next packet for a from the system variables in rc
+// and records its transmit timestamp. poll marks a timer-driven transmission,
+// which shifts the reach register.
+func (u *upstreamSet) peerPacket(a *association, rc responseConfig, now time.Time, poll bool) Packet {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if poll {
+		a.status.Reach <<= 1
+		if a.status.Reach == 0 {
+			a.filter.Reset()
+		}
+	}
+	p := Packet{
+		LI:             rc.LeapIndicator,
+		VN:             4,
+		Mode:           a.status.HostMode,
+		Stratum:        rc.Stratum,
+		Poll:           pollExponent(u.interval),
+		Prec:           rc.Precision,
+		RootDelay:      rc.RootDelay,
+		RootDispersion: rc.RootDispersion,
+		RefID:          rc.RefID,
+		Originate:      a.status.Org,
+		Receive:        a.status.Rec,
+		Transmit:       timeToTimestamp(now),
+	}
+	if !rc.ReferenceTime.IsZero() {
+		p.Reference = timeToTimestamp(rc.ReferenceTime)
+	}
+	a.status.Xmt = p.Transmit
+	return p
+}
+
+func (u *upstreamSet) peerStatus() []PeerStatus {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	out := make([]PeerStatus, len(u.assocs))
+	for i, a := range u.assocs {
+		out[i] = a.status
+	}
+	return out
+}
+
+// Peers returns the state of the symmetric associations, configured ones first.
+func (s *Server) Peers() []PeerStatus {
+	if s.ups == nil {
+		return nil
+	}
+	return s.ups.peerStatus()
+}
+
+// runPeers polls every configured symmetric peer in active mode from the
+// server socket until stop closes.
+func (s *Server) runPeers(stop <-chan struct{}) {
+	s.ups.mu.RLock()
+	var active []*association
+	for _, a := range s.ups.assocs {
+		if a.status.HostMode == ModeSymmetricActive {
+			active = append(active, a)
+		}
+	}
+	s.ups.mu.RUnlock()
+
+	for _, a := range active {
+		s.wg.Add(1)
+		go func(a *association) {
+			defer s.wg.Done()
+			t := time.NewTicker(s.cfg.UpstreamPollInterval)
+			defer t.Stop()
+			for {
+				s.pollPeer(a)
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+				}
+			}
+		}(a)
+	}
+}
+
+func (s *Server) pollPeer(a *association) {
+	s.ups.mu.Lock()
+	if !a.addr.IsValid() {
+		addr := a.status.Address
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "123")
+		}
+		raddr, err := net.ResolveUDPAddr(s.cfg.Network, addr)
+		if err != nil {
+			a.status.LastError = err.Error()
+			s.ups.mu.Unlock()
+			return
+		}
+		a.addr = addrPortOf(raddr)
+	}
+	to := a.addr
+	s.ups.mu.Unlock()
+
+	now := s.cfg.Clock.Now()
+	pkt := s.ups.peerPacket(a, s.responseConfig(now), now, true)
+	s.mu.RLock()
+	conn := s.conn
+	s.mu.RUnlock()
+	if conn == nil {
+		return
+	}
+	if _, err := conn.WriteTo(pkt.Marshal(), net.UDPAddrFromAddrPort(to)); err != nil {
+		s.ups.mu.Lock()
+		a.status.LastError = err.Error()
+		s.ups.mu.Unlock()
+	}
+}
+
+// handlePeer processes a mode 1 or 2 packet and answers passive associations.
+// It returns the error of a failed write that left ev.Error set to it; a
+// write failing after the packet was rejected keeps the rejection reason.
+func (s *Server) handlePeer(conn replyWriter, to remote, req Packet, receivedAt time.Time, flags RestrictFlags, ev *RequestEvent) error {
+	from := to.addrPort()
+	if s.ups == nil || !from.IsValid() {
+		ev.Error = "no_association"
+		return nil
+	}
+	a, reply, reason := s.ups.receivePeer(req, from, receivedAt, flags&RestrictNoPeer == 0)
+	ev.Error = reason
+	if !reply {
+		return nil
+	}
+	now := s.cfg.Clock.Now()
+	pkt := s.ups.peerPacket(a, s.responseConfig(now), now, false)
+	if err := conn.writeTo(pkt.Marshal(), to); err != nil {
+		if ev.Error != "" {
+			return nil
+		}
+		ev.Error = err.Error()
+		return err
+	}
+	ev.Responded = true
+	return nil
+}
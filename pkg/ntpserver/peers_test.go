@@ -0,0 +1,248 @@
+package ntpserver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func waitForEvent(t *testing.T, events <-chan RequestEvent, mode uint8) RequestEvent {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Mode == mode {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no mode %d event", mode)
+			return RequestEvent{}
+		}
+	}
+}
+
+func TestServer_SymmetricPassivePeerSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := New(Config{
+		ListenAddr:     "127.0.0.1:0",
+		Network:        "udp4",
+		Stratum:        1,
+		RefID:          refIDFromASCII4("GPS"),
+		RootDispersion: durationToShort(time.Millisecond),
+		PassivePeers:   []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	})
+	if err := a.Start(ctx); err != nil {
+		t.Fatalf("start a: %v", err)
+	}
+	defer func() { _ = a.Stop() }()
+
+	b := New(Config{
+		ListenAddr:           "127.0.0.1:0",
+		Network:              "udp4",
+		Peers:                []string{a.Addr()},
+		UpstreamPollInterval: 50 * time.Millisecond,
+	})
+	if err := b.Start(ctx); err != nil {
+		t.Fatalf("start b: %v", err)
+	}
+	defer func() { _ = b.Stop() }()
+
+	var st PeerStatus
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if ps := b.Peers(); len(ps) == 1 && ps[0].Selected {
+			st = ps[0]
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !st.Selected {
+		t.Fatalf("peer never selected: %+v", b.Peers())
+	}
+	if st.HostMode != ModeSymmetricActive || st.PeerMode != ModeSymmetricPassive || st.Stratum != 1 || st.Xmt == 0 || st.Org == 0 {
+		t.Fatalf("active side: %+v", st)
+	}
+
+	passive := a.Peers()
+	if len(passive) != 1 || passive[0].HostMode != ModeSymmetricPassive || passive[0].PeerMode != ModeSymmetricActive || !passive[0].Reachable() {
+		t.Fatalf("passive side: %+v", passive)
+	}
+	if passive[0].Address != b.Addr() {
+		t.Fatalf("passive address: got=%q want=%q", passive[0].Address, b.Addr())
+	}
+
+	// The active side now serves stratum 2; the passive side keeps its static config.
+	c := dialServer(t, b)
+	defer c.Close()
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}
+	if _, err := c.Write(req.Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	resp, ok := readPacket(t, c, time.Second)
+	if !ok || resp.Stratum != 2 || resp.RefID != 0x7f000001 {
+		t.Fatalf("response: ok=%v stratum=%d refid=%08x", ok, resp.Stratum, resp.RefID)
+	}
+}
+
+func TestServer_PeerRejectsDuplicateAndBogus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer remote.Close()
+
+	srv := New(Config{
+		ListenAddr:           "127.0.0.1:0",
+		Network:              "udp4",
+		Peers:                []string{remote.LocalAddr().String()},
+		UpstreamPollInterval: time.Hour,
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	// The server polls its configured peer right away.
+	buf := make([]byte, 2048)
+	_ = remote.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := remote.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read poll: %v", err)
+	}
+	poll, ok := ParsePacket(buf[:n])
+	if !ok || poll.Mode != ModeSymmetricActive || poll.Transmit == 0 || poll.Originate != 0 {
+		t.Fatalf("poll: ok=%v %+v", ok, poll)
+	}
+
+	now := time.Now()
+	reply := Packet{
+		VN:        4,
+		Mode:      ModeSymmetricActive,
+		Stratum:   1,
+		Prec:      -20,
+		RefID:     refIDFromASCII4("GPS"),
+		Originate: poll.Transmit,
+		Receive:   timeToTimestamp(now),
+		Transmit:  timeToTimestamp(now.Add(time.Millisecond)),
+	}
+	send := func(p Packet) RequestEvent {
+		t.Helper()
+		if _, err := remote.WriteToUDP(p.Marshal(), from); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return waitForEvent(t, events, ModeSymmetricActive)
+	}
+
+	if ev := send(reply); ev.Error != "" {
+		t.Fatalf("valid packet rejected: %q", ev.Error)
+	}
+	st := srv.Peers()[0]
+	if st.Org != reply.Transmit || st.Reach != 1 || st.LastSample.IsZero() {
+		t.Fatalf("after valid packet: %+v", st)
+	}
+
+	if ev := send(reply); ev.Error != "peer_duplicate" {
+		t.Fatalf("replay: got=%q want=%q", ev.Error, "peer_duplicate")
+	}
+
+	bogus := reply
+	bogus.Originate = poll.Transmit + 1
+	bogus.Transmit = timeToTimestamp(now.Add(2 * time.Millisecond))
+	if ev := send(bogus); ev.Error != "peer_bogus" {
+		t.Fatalf("bogus: got=%q want=%q", ev.Error, "peer_bogus")
+	}
+	st = srv.Peers()[0]
+	if st.Duplicates != 1 || st.Bogus != 1 || st.Org != bogus.Transmit {
+		t.Fatalf("counters: %+v", st)
+	}
+
+	// Mode 1 from an address without an association is dropped.
+	other := dialServer(t, srv)
+	defer other.Close()
+	if _, err := other.Write(reply.Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if ev := waitForEvent(t, events, ModeSymmetricActive); ev.Error != "no_association" || ev.Responded {
+		t.Fatalf("unknown peer: %+v", ev)
+	}
+}
+
+func TestServer_PeersDoNotFormTimingLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Distinct loopback addresses give each server its own RefID.
+	upstream := New(Config{ListenAddr: "127.0.0.3:0", Network: "udp4", Stratum: 1, RefID: refIDFromASCII4("GPS")})
+	if err := upstream.Start(ctx); err != nil {
+		t.Skipf("127.0.0.3 unavailable: %v", err)
+	}
+	defer func() { _ = upstream.Stop() }()
+
+	// a polls the upstream and b, which a answers as a passive peer.
+	a := New(Config{
+		ListenAddr:           "127.0.0.1:0",
+		Network:              "udp4",
+		Upstreams:            []string{upstream.Addr()},
+		PassivePeers:         []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")},
+		UpstreamPollInterval: 50 * time.Millisecond,
+		UpstreamTimeout:      20 * time.Millisecond,
+	})
+	if err := a.Start(ctx); err != nil {
+		t.Fatalf("start a: %v", err)
+	}
+	defer func() { _ = a.Stop() }()
+	b := New(Config{
+		ListenAddr:           "127.0.0.2:0",
+		Network:              "udp4",
+		Peers:                []string{a.Addr()},
+		UpstreamPollInterval: 50 * time.Millisecond,
+	})
+	if err := b.Start(ctx); err != nil {
+		t.Fatalf("start b: %v", err)
+	}
+	defer func() { _ = b.Stop() }()
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s: a=%+v b=%+v", what, a.Peers(), b.Peers())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// b selects a and from then on reports a's address as its RefID.
+	waitFor("b to select a", func() bool { return b.Peers()[0].Selected })
+	waitFor("a to hear from b", func() bool {
+		ps := a.Peers()
+		return len(ps) == 1 && ps[0].RefID == refIDForAddr(a.Addr()) && !ps[0].LastSample.IsZero()
+	})
+	if st := a.Peers()[0]; st.Selected || st.Survivor {
+		t.Fatalf("a accepted a peer synchronized to it: %+v", st)
+	}
+
+	// Without its upstream a must not fall back to b, nor b to a.
+	_ = upstream.Stop()
+	waitFor("a to lose its upstream", func() bool { return !a.Upstreams()[0].Reachable() })
+	time.Sleep(200 * time.Millisecond)
+	if st := a.Peers()[0]; st.Selected || st.Survivor {
+		t.Fatalf("a selected b after losing its upstream: %+v", st)
+	}
+	if st := b.Peers()[0]; st.Selected {
+		t.Fatalf("b still selects a: %+v", st)
+	}
+	if a.ups.system(time.Now()).synced || b.ups.system(time.Now()).synced {
+		t.Fatal("a timing loop kept the pair synchronized")
+	}
+}
@@ -0,0 +1,183 @@
+package ntpserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsHandler returns an http.Handler that serves the server's metrics in
+// the Prometheus text exposition format, for mounting at /metrics:
+//
+//	http.Handle("/metrics", srv.MetricsHandler())
+//
+// Metric names start with ntpserver_. Per-client counts are not exported,
+// to keep the number of series bounded.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		s.writePrometheus(&b, time.Now())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write(b.Bytes())
+	})
+}
+
+func (s *Server) writePrometheus(b *bytes.Buffer, now time.Time) {
+	// Per-client counts are not exported, so the top clients are not merged.
+	// The histograms are read without clearing them, so that _sum and
+	// _count only go up.
+	m := s.snapshot(false)
+	m.Processing = s.metrics.processing.cumulative()
+	m.RxToTx = s.metrics.rxToTx.cumulative()
+	p := promWriter{b: b}
+
+	p.header("ntpserver_build_info", "gauge", "Library version.")
+	p.sample("ntpserver_build_info", 1, "version", Version)
+	uptime := 0.0
+	if !m.StartedAt.IsZero() {
+		uptime = now.Sub(m.StartedAt).Seconds()
+	}
+	p.gauge("ntpserver_uptime_seconds", "Seconds since the server started.", uptime)
+
+	p.counter("ntpserver_requests_total", "Packets received.", m.TotalRequests)
+	p.byNumber("ntpserver_requests_by_version_total", "Packets received, by NTP version.", "version", m.RequestsByVersion)
+	p.byNumber("ntpserver_requests_by_mode_total", "Packets received, by NTP mode.", "mode", m.RequestsByMode)
+	p.counter("ntpserver_responses_total", "Replies sent.", m.TotalResponses)
+	p.header("ntpserver_errors_total", "counter", "Requests dropped or failed, by reason.")
+	reasons := make([]string, 0, len(m.ErrorsByReason))
+	for reason := range m.ErrorsByReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		p.sample("ntpserver_errors_total", float64(m.ErrorsByReason[reason]), "reason", reason)
+	}
+	p.counter("ntpserver_kod_sent_total", "Kiss-o'-Death packets sent.", m.KoDSent)
+	p.counter("ntpserver_kod_suppressed_total", "Kiss-o'-Death packets withheld by the KoD rate limit.", m.KoDSuppressed)
+	p.counter("ntpserver_broadcasts_sent_total", "Broadcast packets sent.", m.BroadcastsSent)
+	p.counter("ntpserver_broadcast_errors_total", "Broadcast packets that failed to send.", m.BroadcastErrors)
+	p.gauge("ntpserver_unique_clients", "Estimated distinct client addresses seen since start.", float64(m.UniqueClients))
+	p.counter("ntpserver_events_dropped_total", "Events not delivered to a slow subscriber.", m.EventsDropped)
+	p.counter("ntpserver_reloads_total", "Configuration reloads.", m.Reloads)
+
+	if len(m.Workers) > 0 {
+		p.header("ntpserver_worker_requests_total", "counter", "Packets received, by worker.")
+		for _, w := range m.Workers {
+			p.sample("ntpserver_worker_requests_total", float64(w.Requests), "worker", strconv.Itoa(w.ID), "local_addr", w.LocalAddr)
+		}
+	}
+
+	if m.RateLimit != nil || m.RateLimitPrefixes != nil {
+		p.rateLimit(m.RateLimit, m.RateLimitPrefixes)
+	}
+
+	p.latency("ntpserver_processing_seconds", "Time spent on each request.", m.Processing)
+	p.latency("ntpserver_rx_to_tx_seconds", "Time from the receive timestamp of a request to its reply being sent.", m.RxToTx)
+
+	rc := s.responseConfig(s.cfg.Clock.Now())
+	p.gauge("ntpserver_stratum", "Stratum served to clients.", float64(rc.Stratum))
+	p.gauge("ntpserver_leap_indicator", "Leap indicator served to clients (3 = unsynchronized).", float64(rc.LeapIndicator))
+	// Stratum 16 RefIDs are ASCII codes such as INIT, like kiss codes.
+	stratum := rc.Stratum
+	if stratum >= stratumUnsync {
+		stratum = 0
+	}
+	p.header("ntpserver_refid_info", "gauge", "RefID served to clients.")
+	p.sample("ntpserver_refid_info", 1, "refid", ctlRefID(stratum, rc.RefID))
+}
+
+// rateLimit writes the table metrics of the per-address and per-prefix
+// limiters, labelled table="address" and table="prefix"; either may be nil.
+func (p promWriter) rateLimit(address, prefix *RateLimitMetrics) {
+	tables := []struct {
+		name string
+		m    *RateLimitMetrics
+	}{{"address", address}, {"prefix", prefix}}
+	for _, f := range []struct {
+		name, typ, help string
+		value           func(*RateLimitMetrics) uint64
+	}{
+		{"ntpserver_rate_limit_clients", "gauge", "Entries in the rate limiter table.", func(r *RateLimitMetrics) uint64 { return uint64(r.Clients) }},
+		{"ntpserver_rate_limit_max_clients", "gauge", "Capacity of the rate limiter table.", func(r *RateLimitMetrics) uint64 { return uint64(r.MaxClients) }},
+		{"ntpserver_rate_limit_expired_total", "counter", "Idle rate limiter entries forgotten.", func(r *RateLimitMetrics) uint64 { return r.Expired }},
+		{"ntpserver_rate_limit_evicted_total", "counter", "Active rate limiter entries evicted from a full table.", func(r *RateLimitMetrics) uint64 { return r.Evicted }},
+		{"ntpserver_rate_limit_untracked_total", "counter", "Requests served without limiting because the table was full.", func(r *RateLimitMetrics) uint64 { return r.Untracked }},
+		{"ntpserver_rate_limit_rejected_total", "counter", "Requests dropped because the table was full.", func(r *RateLimitMetrics) uint64 { return r.Rejected }},
+	} {
+		p.header(f.name, f.typ, f.help)
+		for _, t := range tables {
+			if t.m != nil {
+				p.sample(f.name, float64(f.value(t.m)), "table", t.name)
+			}
+		}
+	}
+}
+
+// promWriter writes metrics in the Prometheus text format.
+type promWriter struct{ b *bytes.Buffer }
+
+func (p promWriter) header(name, typ, help string) {
+	fmt.Fprintf(p.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample; labels are name, value pairs.
+func (p promWriter) sample(name string, v float64, labels ...string) {
+	p.b.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			p.b.WriteByte('{')
+		} else {
+			p.b.WriteByte(',')
+		}
+		p.b.WriteString(labels[i])
+		p.b.WriteString(`="`)
+		p.b.WriteString(promLabelEscaper.Replace(strings.ToValidUTF8(labels[i+1], "\uFFFD")))
+		p.b.WriteByte('"')
+	}
+	if len(labels) > 1 {
+		p.b.WriteByte('}')
+	}
+	p.b.WriteByte(' ')
+	p.b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	p.b.WriteByte('\n')
+}
+
+// byNumber writes a counter with one sample per key of counts, in order.
+func (p promWriter) byNumber(name, help, label string, counts map[uint8]uint64) {
+	p.header(name, "counter", help)
+	for k := 0; k < 8; k++ {
+		if n, ok := counts[uint8(k)]; ok {
+			p.sample(name, float64(n), label, strconv.Itoa(k))
+		}
+	}
+}
+
+// latency writes l as a summary, plus its maximum as name_max.
+func (p promWriter) latency(name, help string, l LatencyMetrics) {
+	p.header(name, "summary", help)
+	for _, q := range []struct {
+		label string
+		v     time.Duration
+	}{{"0.5", l.P50}, {"0.9", l.P90}, {"0.99", l.P99}} {
+		p.sample(name, q.v.Seconds(), "quantile", q.label)
+	}
+	p.sample(name+"_sum", l.Sum.Seconds())
+	p.sample(name+"_count", float64(l.Count))
+	p.gauge(name+"_max", "Maximum of "+name+".", l.Max.Seconds())
+}
+
+func (p promWriter) counter(name, help string, v uint64) {
+	p.header(name, "counter", help)
+	p.sample(name, float64(v))
+}
+
+func (p promWriter) gauge(name, help string, v float64) {
+	p.header(name, "gauge", help)
+	p.sample(name, v)
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
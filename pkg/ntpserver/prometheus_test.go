@@ -0,0 +1,70 @@
+package ntpserver
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_MetricsHandler(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := New(Config{
+		Clock:              fixedClock{t: now},
+		Stratum:            1,
+		RefID:              refIDFromASCII4("GPS"),
+		RateLimitPerSecond: 0.001,
+		RateLimitBurst:     1,
+		Hook: func(req Packet, meta RequestMeta) string {
+			if meta.ClientPort == 999 {
+				return `bad "client"`
+			}
+			return ""
+		},
+	})
+	client := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}).Marshal()
+	send := func(addr string, port uint16, b []byte) {
+		from := remote{ap: netip.AddrPortFrom(netip.MustParseAddr(addr), port)}
+		handle(srv, &fakeWriter{}, b, from, now)
+	}
+	send("192.0.2.1", 123, client)
+	send("192.0.2.1", 123, client)
+	send("192.0.2.2", 123, []byte{0x23})
+	send("192.0.2.3", 999, client)
+
+	rec := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type: got=%q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE ntpserver_requests_total counter\nntpserver_requests_total 4\n",
+		"ntpserver_responses_total 1\n",
+		`ntpserver_requests_by_version_total{version="4"} 4` + "\n",
+		`ntpserver_requests_by_mode_total{mode="3"} 4` + "\n",
+		`ntpserver_errors_total{reason="bad \"client\""} 1` + "\n",
+		`ntpserver_errors_total{reason="invalid_request"} 1` + "\n",
+		`ntpserver_errors_total{reason="rate_limited"} 1` + "\n",
+		"ntpserver_unique_clients 3\n",
+		`ntpserver_rate_limit_clients{table="address"} 3` + "\n",
+		`ntpserver_rate_limit_max_clients{table="address"} 65536` + "\n",
+		"ntpserver_events_dropped_total 0\n",
+		"ntpserver_uptime_seconds 0\n",
+		"# TYPE ntpserver_processing_seconds summary\n",
+		`ntpserver_processing_seconds{quantile="0.99"} 0` + "\n",
+		"ntpserver_rx_to_tx_seconds_count 0\n",
+		"ntpserver_stratum 1\n",
+		"ntpserver_leap_indicator 0\n",
+		`ntpserver_refid_info{refid="GPS"} 1` + "\n",
+		`ntpserver_build_info{version="` + Version + `"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "table=\"prefix\"") {
+		t.Fatalf("prefix limiter is disabled:\n%s", body)
+	}
+}
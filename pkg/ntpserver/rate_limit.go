@@ -1,6 +1,8 @@
 package ntpserver
 
 import (
+	"container/list"
+	"net/netip"
 	"sync"
 	"time"
 )
@@ -52,37 +54,175 @@ func (b *tokenBucket) allow(now time.Time) bool {
 	return true
 }
 
+// RateLimitFullPolicy decides what the rate limiter does with a request
+// from a new client when its table is full of clients that are still active.
+type RateLimitFullPolicy string
+
+const (
+	// RateLimitEvict forgets the least recently seen client to make room.
+	RateLimitEvict RateLimitFullPolicy = "evict"
+	// RateLimitFailOpen serves the new client without rate limiting it.
+	RateLimitFailOpen RateLimitFullPolicy = "open"
+	// RateLimitFailClosed drops the request as rate limited.
+	RateLimitFailClosed RateLimitFullPolicy = "closed"
+)
+
+// RateLimitMetrics describes the rate limiter's table of clients.
+type RateLimitMetrics struct {
+	Clients    int    `json:"clients"`
+	MaxClients int    `json:"max_clients"`
+	Expired    uint64 `json:"expired"`   // forgotten after being idle
+	Evicted    uint64 `json:"evicted"`   // forgotten to make room (RateLimitEvict)
+	Untracked  uint64 `json:"untracked"` // served untracked (RateLimitFailOpen)
+	Rejected   uint64 `json:"rejected"`  // dropped (RateLimitFailClosed)
+}
+
+// limiterEntry is the bucket of one client in the limiter's LRU list.
+type limiterEntry struct {
+	ip     netip.Addr
+	bucket *tokenBucket
+	seen   time.Time
+}
+
+// limiter is a per-IP token bucket limiter. It tracks at most max clients in
+// least-recently-used order; clients idle for longer than idle are dropped.
 type limiter struct {
-	mu    sync.Mutex
-	perIP map[string]*tokenBucket
+	mu      sync.Mutex
+	entries map[netip.Addr]*list.Element
+	lru     *list.List // front is most recently seen
 
 	ratePerSec float64
 	burst      int
+	max        int
+	idle       time.Duration
+	full       RateLimitFullPolicy
+
+	expired, evicted, untracked, rejected uint64
 }
 
-func newLimiter(ratePerSec float64, burst int) *limiter {
+// newLimiter returns a limiter of ratePerSec with the given burst, or one
+// that allows everything if ratePerSec is not positive. An idle of 0 forgets
+// clients once their bucket has refilled, which does not change any decision.
+func newLimiter(ratePerSec float64, burst, max int, idle time.Duration, full RateLimitFullPolicy) *limiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	if max <= 0 {
+		max = 1
+	}
+	if idle <= 0 && ratePerSec > 0 {
+		idle = time.Duration(float64(burst) / ratePerSec * float64(time.Second))
+		if idle < time.Second {
+			idle = time.Second
+		}
+	}
 	return &limiter{
-		perIP:       make(map[string]*tokenBucket),
-		ratePerSec:  ratePerSec,
-		burst:       burst,
+		entries:    make(map[netip.Addr]*list.Element),
+		lru:        list.New(),
+		ratePerSec: ratePerSec,
+		burst:      burst,
+		max:        max,
+		idle:       idle,
+		full:       full,
 	}
 }
 
-func (l *limiter) allow(ip string, now time.Time) bool {
+func (l *limiter) allow(ip netip.Addr, now time.Time) bool {
 	if l.ratePerSec <= 0 {
 		return true
 	}
-	if ip == "" {
+	if !ip.IsValid() {
 		return true
 	}
 
 	l.mu.Lock()
-	b := l.perIP[ip]
-	if b == nil {
-		b = newTokenBucket(l.ratePerSec, l.burst)
-		l.perIP[ip] = b
+	defer l.mu.Unlock()
+	if el := l.entries[ip]; el != nil {
+		e := el.Value.(*limiterEntry)
+		e.seen = now
+		l.lru.MoveToFront(el)
+		return e.bucket.allow(now)
 	}
-	l.mu.Unlock()
 
+	l.expire(now)
+	if l.lru.Len() >= l.max {
+		switch l.full {
+		case RateLimitFailOpen:
+			l.untracked++
+			return true
+		case RateLimitFailClosed:
+			l.rejected++
+			return false
+		}
+		el := l.lru.Back()
+		l.lru.Remove(el)
+		delete(l.entries, el.Value.(*limiterEntry).ip)
+		l.evicted++
+	}
+	b := newTokenBucket(l.ratePerSec, l.burst)
+	b.last = now
+	l.entries[ip] = l.lru.PushFront(&limiterEntry{ip: ip, bucket: b, seen: now})
 	return b.allow(now)
 }
+
+// expire drops the clients idle for longer than l.idle. l.mu must be held.
+func (l *limiter) expire(now time.Time) {
+	for {
+		el := l.lru.Back()
+		if el == nil {
+			return
+		}
+		e := el.Value.(*limiterEntry)
+		if now.Sub(e.seen) <= l.idle {
+			return
+		}
+		l.lru.Remove(el)
+		delete(l.entries, e.ip)
+		l.expired++
+	}
+}
+
+func (l *limiter) snapshot() *RateLimitMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &RateLimitMetrics{
+		Clients:    l.lru.Len(),
+		MaxClients: l.max,
+		Expired:    l.expired,
+		Evicted:    l.evicted,
+		Untracked:  l.untracked,
+		Rejected:   l.rejected,
+	}
+}
+
+// prefixKey returns the network of ip's prefix of v4Bits or v6Bits, which
+// keys the per-prefix limiter.
+func prefixKey(ip netip.Addr, v4Bits, v6Bits int) netip.Addr {
+	bits := v6Bits
+	if ip.Is4() {
+		bits = v4Bits
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return p.Addr()
+}
+
+// rateLimited applies the per-address, per-prefix and global limits in that
+// order, and returns the RequestEvent error of the layer that rejects a
+// request from ip, or "". Without perClient only the global limit applies.
+func (c *liveConfig) rateLimited(ip netip.Addr, now time.Time, perClient bool) string {
+	if perClient && !c.limiter.allow(ip, now) {
+		return "rate_limited"
+	}
+	if perClient && c.prefixLimiter.ratePerSec > 0 && ip.IsValid() {
+		if !c.prefixLimiter.allow(prefixKey(ip, c.cfg.RateLimitPrefixV4, c.cfg.RateLimitPrefixV6), now) {
+			return "rate_limited_prefix"
+		}
+	}
+	if !c.globalLimiter.allow(now) {
+		return "rate_limited_global"
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package ntpserver
+
+import (
+	"fmt"
+	"slices"
+)
+
+// EventReload is the RequestEvent.Kind of a configuration reload.
+const EventReload = "reload"
+
+// liveConfig is the part of the server that Reconfigure replaces while it
+// runs. Of cfg, only the fields listed on Reconfigure are read.
+type liveConfig struct {
+	cfg Config
+
+	limiter       *limiter
+	prefixLimiter *limiter
+	globalLimiter *tokenBucket
+	kodLimiter    *limiter
+	restrict      *restrictTable
+}
+
+// newLiveConfig builds the live state for cfg. Limiters whose settings did
+// not change are taken over from old, so clients keep their buckets.
+func newLiveConfig(cfg Config, old *liveConfig) *liveConfig {
+	c := &liveConfig{
+		cfg:           cfg,
+		limiter:       newLimiter(cfg.RateLimitPerSecond, cfg.RateLimitBurst, cfg.RateLimitClients, cfg.RateLimitIdleTimeout, cfg.RateLimitFull),
+		prefixLimiter: newLimiter(cfg.RateLimitPrefixPerSecond, cfg.RateLimitPrefixBurst, cfg.RateLimitClients, cfg.RateLimitIdleTimeout, cfg.RateLimitFull),
+		globalLimiter: newTokenBucket(cfg.RateLimitGlobalPerSecond, cfg.RateLimitGlobalBurst),
+		kodLimiter:    newLimiter(cfg.KoDRateLimitPerSecond, cfg.KoDBurst, cfg.RateLimitClients, 0, RateLimitEvict),
+		restrict:      newRestrictTable(cfg.Restrict),
+	}
+	if old != nil {
+		// Rules set with SetRestrictions stay until Restrict itself changes.
+		if slices.Equal(old.cfg.Restrict, cfg.Restrict) {
+			c.restrict = old.restrict
+		}
+		c.limiter = old.limiter.keepIfSame(c.limiter)
+		c.prefixLimiter = old.prefixLimiter.keepIfSame(c.prefixLimiter)
+		c.kodLimiter = old.kodLimiter.keepIfSame(c.kodLimiter)
+		if old.globalLimiter.rate == c.globalLimiter.rate && old.globalLimiter.burst == c.globalLimiter.burst {
+			c.globalLimiter = old.globalLimiter
+		}
+	}
+	return c
+}
+
+// validate reports settings that normalize cannot default, for New (through
+// Start and Serve) and Reconfigure.
+func (c Config) validate() error {
+	switch c.RateLimitFull {
+	case "", RateLimitEvict, RateLimitFailOpen, RateLimitFailClosed:
+	default:
+		return fmt.Errorf("ntpserver: unknown RateLimitFull policy %q", c.RateLimitFull)
+	}
+	for _, d := range c.Broadcast {
+		if err := c.checkBroadcast(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepIfSame returns l if it has the settings of n, and n otherwise.
+func (l *limiter) keepIfSame(n *limiter) *limiter {
+	if l.ratePerSec == n.ratePerSec && l.burst == n.burst && l.max == n.max && l.idle == n.idle && l.full == n.full {
+		return l
+	}
+	return n
+}
+
+// Reconfigure applies cfg to the running server without touching its
+// sockets, metrics or other state: Stratum, RefID, LeapIndicator,
+// Precision, RootDelay, RootDispersion, Hook, the KoD and RateLimit
+// settings, Restrict and ControlAllow. Other fields are ignored; changing
+// them takes Stop and Start. Rate limiters whose settings are unchanged keep
+// their clients, and rules set with SetRestrictions are kept unless Restrict
+// differs from the previous configuration. Each reload is counted in
+// MetricsSnapshot.Reloads and published as an event of Kind EventReload.
+func (s *Server) Reconfigure(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	cfg = cfg.normalize()
+
+	s.liveMu.Lock()
+	s.live.Store(newLiveConfig(cfg, s.live.Load()))
+	s.liveMu.Unlock()
+
+	now := s.cfg.Clock.Now()
+	s.metrics.incReload(now)
+	s.hub.publish(RequestEvent{At: now, Kind: EventReload})
+	return nil
+}
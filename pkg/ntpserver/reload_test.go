@@ -0,0 +1,116 @@
+package ntpserver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServer_Reconfigure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", Stratum: 2, RateLimitPerSecond: 100})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+	addr := srv.Addr()
+
+	c := dialServer(t, srv)
+	defer c.Close()
+	exchange := func() Packet {
+		t.Helper()
+		if _, err := c.Write((&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}).Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		resp, ok := readPacket(t, c, time.Second)
+		if !ok {
+			t.Fatalf("no response")
+		}
+		return resp
+	}
+	if resp := exchange(); resp.Stratum != 2 {
+		t.Fatalf("stratum before reload: got=%d want=2", resp.Stratum)
+	}
+	limiter := srv.live.Load().limiter
+
+	refID := refIDFromASCII4("GPS")
+	if err := srv.Reconfigure(Config{Stratum: 1, RefID: refID, LeapIndicator: 1, RateLimitPerSecond: 100}); err != nil {
+		t.Fatalf("reconfigure: %v", err)
+	}
+	if resp := exchange(); resp.Stratum != 1 || resp.RefID != refID || resp.LI != 1 {
+		t.Fatalf("after reload: stratum=%d refid=%x li=%d", resp.Stratum, resp.RefID, resp.LI)
+	}
+	if srv.Addr() != addr {
+		t.Fatalf("socket changed: got=%s want=%s", srv.Addr(), addr)
+	}
+	if srv.live.Load().limiter != limiter {
+		t.Fatalf("unchanged rate limit settings should keep the limiter")
+	}
+
+	timeout := time.After(time.Second)
+	for reload := false; !reload; {
+		select {
+		case ev := <-events:
+			reload = ev.Kind == EventReload
+		case <-timeout:
+			t.Fatalf("no reload event")
+		}
+	}
+	m := srv.Metrics()
+	if m.Reloads != 1 || m.LastReloadAt.IsZero() || m.TotalRequests != 2 {
+		t.Fatalf("metrics: reloads=%d last=%v requests=%d", m.Reloads, m.LastReloadAt, m.TotalRequests)
+	}
+
+	// Rules set at runtime survive a reload with the same Restrict...
+	runtime := []RestrictRule{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Flags: RestrictIgnore}}
+	srv.SetRestrictions(runtime)
+	if err := srv.Reconfigure(Config{Stratum: 3, RateLimitPerSecond: 50}); err != nil {
+		t.Fatalf("reconfigure: %v", err)
+	}
+	if resp := exchange(); resp.Stratum != 3 {
+		t.Fatalf("after second reload: stratum=%d", resp.Stratum)
+	}
+	if srv.live.Load().limiter == limiter {
+		t.Fatalf("new rate limit settings need a new limiter")
+	}
+	if got := srv.Restrictions(); !slices.Equal(got, runtime) {
+		t.Fatalf("runtime rules after reload: got=%v want=%v", got, runtime)
+	}
+	// ...and are replaced when Restrict changes.
+	configured := []RestrictRule{{Flags: RestrictKoD}}
+	if err := srv.Reconfigure(Config{Stratum: 3, RateLimitPerSecond: 50, Restrict: configured}); err != nil {
+		t.Fatalf("reconfigure: %v", err)
+	}
+	if got := srv.Restrictions(); !slices.Equal(got, configured) {
+		t.Fatalf("rules after Restrict changed: got=%v want=%v", got, configured)
+	}
+
+	if err := srv.Reconfigure(Config{RateLimitFull: "sometimes"}); err == nil {
+		t.Fatalf("expected error for unknown RateLimitFull")
+	}
+	if m := srv.Metrics(); m.Reloads != 3 {
+		t.Fatalf("failed reload must not count: reloads=%d", m.Reloads)
+	}
+}
+
+func TestServer_InvalidConfigFailsStart(t *testing.T) {
+	srv := New(Config{ListenAddr: "127.0.0.1:0", RateLimitFull: "sometimes"})
+	if err := srv.Start(context.Background()); err == nil {
+		_ = srv.Stop()
+		t.Fatalf("expected error for unknown RateLimitFull")
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if err := srv.Serve(context.Background(), conn); err == nil {
+		t.Fatalf("Serve: expected error for unknown RateLimitFull")
+	}
+}
@@ -0,0 +1,93 @@
+package ntpserver
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// remote is the sender of a request. Requests read from a UDP socket only
+// carry ap, as returned by the socket; other transports also keep the
+// net.Addr they returned, which replies are sent to.
+type remote struct {
+	ap   netip.AddrPort // invalid for transports that are not IP
+	addr net.Addr
+}
+
+func remoteOf(addr net.Addr) remote {
+	return remote{ap: addrPortOf(addr), addr: addr}
+}
+
+// addrPort returns the sender with IPv4-mapped addresses unmapped, so the
+// same client matches on udp and udp4 sockets.
+func (r remote) addrPort() netip.AddrPort {
+	return netip.AddrPortFrom(r.ap.Addr().Unmap(), r.ap.Port())
+}
+
+// ip returns the sender's address without zone, the key of per-client state.
+func (r remote) ip() netip.Addr {
+	return r.ap.Addr().Unmap().WithZone("")
+}
+
+// netAddr returns the address to pass to net.PacketConn.WriteTo.
+func (r remote) netAddr() net.Addr {
+	if r.addr != nil {
+		return r.addr
+	}
+	return net.UDPAddrFromAddrPort(r.ap)
+}
+
+// replyBufs holds reply buffers, so that marshalling a reply does not
+// allocate.
+var replyBufs = sync.Pool{New: func() any {
+	b := make([]byte, maxDatagramSize)
+	return &b
+}}
+
+// sentReply is an interleaved-mode reply whose send time is stored once it
+// has left.
+type sentReply struct {
+	ip netip.Addr
+	rx Timestamp // receive timestamp written into the reply; identifies it
+	n  int       // reply length
+	at time.Time // when the request was received
+}
+
+// replyWriter sends replies for handlePacket: the socket itself, or a
+// batchWriter that sends them together after a read batch is handled.
+type replyWriter interface {
+	writeTo(b []byte, to remote) error
+	// afterSend passes r to the writer's sent function once the last reply
+	// written has been sent, and drops it if that reply could not be.
+	afterSend(r sentReply)
+	// recycle returns bp to replyBufs once the reply in it has been sent.
+	recycle(bp *[]byte)
+}
+
+// connWriter writes replies straight to the socket.
+type connWriter struct {
+	conn net.PacketConn
+	uc   *net.UDPConn // conn, if it is a UDP socket
+	sent func(sentReply)
+}
+
+func newConnWriter(conn net.PacketConn, sent func(sentReply)) *connWriter {
+	uc, _ := conn.(*net.UDPConn)
+	return &connWriter{conn: conn, uc: uc, sent: sent}
+}
+
+func (w *connWriter) writeTo(b []byte, to remote) error {
+	if w.uc != nil && to.addr == nil {
+		_, err := w.uc.WriteToUDPAddrPort(b, to.ap)
+		return err
+	}
+	_, err := w.conn.WriteTo(b, to.netAddr())
+	return err
+}
+
+// afterSend records r right away: handlePacket only calls it once the reply
+// was written.
+func (w *connWriter) afterSend(r sentReply) { w.sent(r) }
+
+func (*connWriter) recycle(bp *[]byte) { replyBufs.Put(bp) }
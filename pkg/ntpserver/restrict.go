@@ -0,0 +1,262 @@
+package ntpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// modePrivate is mode 7, the private requests of ntpdc.
+const modePrivate = 7
+
+// RestrictFlags are the ntpd-style access restrictions of a RestrictRule.
+type RestrictFlags uint16
+
+const (
+	// RestrictIgnore drops every packet.
+	RestrictIgnore RestrictFlags = 1 << iota
+	// RestrictNoQuery drops mode 6 and 7 queries (ntpq, ntpdc).
+	RestrictNoQuery
+	// RestrictNoModify refuses mode 6 requests that would change state.
+	RestrictNoModify
+	// RestrictNoServe drops everything except queries: no time service and
+	// no peering.
+	RestrictNoServe
+	// RestrictNoPeer refuses symmetric active packets that would mobilize a
+	// new passive association.
+	RestrictNoPeer
+	// RestrictKoD answers requests refused by RestrictLimited or
+	// RestrictNoServe with a Kiss-o'-Death (RATE or RSTR), even without
+	// Config.KoD.
+	RestrictKoD
+	// RestrictLimited subjects the client to the per-address and per-prefix
+	// rate limits.
+	RestrictLimited
+)
+
+var restrictFlagNames = []struct {
+	flag RestrictFlags
+	name string
+}{
+	{RestrictIgnore, "ignore"},
+	{RestrictNoQuery, "noquery"},
+	{RestrictNoModify, "nomodify"},
+	{RestrictNoServe, "noserve"},
+	{RestrictNoPeer, "nopeer"},
+	{RestrictKoD, "kod"},
+	{RestrictLimited, "limited"},
+}
+
+// ignoredRestrictFlags are ntpd flags without meaning for this server: there
+// are no traps, no trust levels and no MS-SNTP. They are accepted as no flag
+// so that ntp.conf lines can be used as they are.
+var ignoredRestrictFlags = []string{"notrap", "lowpriotrap", "notrust", "version", "ntpport", "mssntp"}
+
+// ParseRestrictFlag returns the flag named name, as written in ntp.conf. The
+// ntpd flags notrap, lowpriotrap, notrust, version, ntpport and mssntp have
+// no meaning here and parse as 0.
+func ParseRestrictFlag(name string) (RestrictFlags, error) {
+	for _, f := range restrictFlagNames {
+		if f.name == name {
+			return f.flag, nil
+		}
+	}
+	if slices.Contains(ignoredRestrictFlags, name) {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("ntpserver: unknown restrict flag %q", name)
+}
+
+// String returns the names of the flags separated by spaces.
+func (f RestrictFlags) String() string {
+	var names []string
+	for _, n := range restrictFlagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func (f RestrictFlags) MarshalText() ([]byte, error) { return []byte(f.String()), nil }
+
+func (f *RestrictFlags) UnmarshalText(b []byte) error {
+	var out RestrictFlags
+	for _, name := range strings.Fields(string(b)) {
+		flag, err := ParseRestrictFlag(name)
+		if err != nil {
+			return err
+		}
+		out |= flag
+	}
+	*f = out
+	return nil
+}
+
+// RestrictRule restricts the clients in Prefix. The rule with the longest
+// prefix containing a client applies; the zero Prefix is the default rule,
+// for clients no other rule matches.
+type RestrictRule struct {
+	Prefix netip.Prefix  `json:"prefix"`
+	Flags  RestrictFlags `json:"flags"`
+}
+
+// ParseRestrictRule parses an ntp.conf restrict line: "default kod limited",
+// "192.0.2.0/24 noquery", "restrict 192.0.2.0 mask 255.255.255.0 nomodify"
+// or "restrict -6 default ignore". An address without a prefix length or mask
+// restricts only that address; "default" covers both address families unless
+// -4 or -6 limits it to one.
+func ParseRestrictRule(s string) (RestrictRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) > 0 && fields[0] == "restrict" {
+		fields = fields[1:]
+	}
+	family := ""
+	if len(fields) > 0 && (fields[0] == "-4" || fields[0] == "-6") {
+		family, fields = fields[0], fields[1:]
+	}
+	if len(fields) == 0 {
+		return RestrictRule{}, errors.New("ntpserver: empty restrict rule")
+	}
+	var r RestrictRule
+	switch target := fields[0]; {
+	case target == "default" && family == "-4":
+		r.Prefix = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	case target == "default" && family == "-6":
+		r.Prefix = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	case target == "default":
+	case len(fields) >= 3 && fields[1] == "mask":
+		p, err := parseMasked(target, fields[2])
+		if err != nil {
+			return RestrictRule{}, fmt.Errorf("ntpserver: restrict %q: %w", s, err)
+		}
+		r.Prefix = p
+		fields = fields[2:]
+	case strings.Contains(target, "/"):
+		p, err := netip.ParsePrefix(target)
+		if err != nil {
+			return RestrictRule{}, fmt.Errorf("ntpserver: restrict %q: %w", s, err)
+		}
+		r.Prefix = p.Masked()
+	default:
+		ip, err := netip.ParseAddr(target)
+		if err != nil {
+			return RestrictRule{}, fmt.Errorf("ntpserver: restrict %q: %w", s, err)
+		}
+		ip = ip.Unmap().WithZone("")
+		r.Prefix = netip.PrefixFrom(ip, ip.BitLen())
+	}
+	if err := r.Flags.UnmarshalText([]byte(strings.Join(fields[1:], " "))); err != nil {
+		return RestrictRule{}, err
+	}
+	return r, nil
+}
+
+// parseMasked returns the prefix of addr with the netmask mask.
+func parseMasked(addr, mask string) (netip.Prefix, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	m, err := netip.ParseAddr(mask)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip, m = ip.Unmap().WithZone(""), m.Unmap()
+	bits, size := net.IPMask(m.AsSlice()).Size()
+	if size == 0 || size != ip.BitLen() {
+		return netip.Prefix{}, fmt.Errorf("invalid mask %s for %s", mask, addr)
+	}
+	return netip.PrefixFrom(ip, bits).Masked(), nil
+}
+
+// restrictTable is an immutable set of rules, replaced as a whole by
+// Server.SetRestrictions.
+type restrictTable struct {
+	rules  []RestrictRule // longest prefix first, without the default rule
+	def    RestrictFlags
+	hasDef bool
+	all    []RestrictRule // as configured
+}
+
+// newRestrictTable returns nil for no rules. Of rules with the same prefix,
+// the last one wins.
+func newRestrictTable(rules []RestrictRule) *restrictTable {
+	if len(rules) == 0 {
+		return nil
+	}
+	t := &restrictTable{all: append([]RestrictRule(nil), rules...)}
+	byPrefix := make(map[netip.Prefix]RestrictFlags)
+	for _, r := range rules {
+		if !r.Prefix.IsValid() {
+			t.def, t.hasDef = r.Flags, true
+			continue
+		}
+		p := r.Prefix.Masked()
+		if _, ok := byPrefix[p]; !ok {
+			t.rules = append(t.rules, RestrictRule{Prefix: p})
+		}
+		byPrefix[p] = r.Flags
+	}
+	for i := range t.rules {
+		t.rules[i].Flags = byPrefix[t.rules[i].Prefix]
+	}
+	sort.SliceStable(t.rules, func(i, j int) bool { return t.rules[i].Prefix.Bits() > t.rules[j].Prefix.Bits() })
+	return t
+}
+
+// match returns the flags of the rule for ip, and false if no rule applies.
+func (t *restrictTable) match(ip netip.Addr) (RestrictFlags, bool) {
+	if t == nil {
+		return 0, false
+	}
+	if ip.IsValid() {
+		for _, r := range t.rules {
+			if r.Prefix.Contains(ip) {
+				return r.Flags, true
+			}
+		}
+	}
+	return t.def, t.hasDef
+}
+
+// restrictReason returns the RequestEvent error for a packet of mode that
+// flags refuse before it is parsed, or "".
+func restrictReason(flags RestrictFlags, mode uint8) string {
+	switch {
+	case flags&RestrictIgnore != 0:
+		return "restricted_ignore"
+	case mode == ModeControl || mode == modePrivate:
+		if flags&RestrictNoQuery != 0 {
+			return "restricted_noquery"
+		}
+	case flags&RestrictNoServe != 0:
+		return "restricted_noserve"
+	}
+	return ""
+}
+
+// SetRestrictions replaces the restrict rules of Config.Restrict. It takes
+// effect for the next packet and may be called while the server runs. A
+// Reconfigure whose Restrict differs from the previous one replaces the
+// rules again.
+func (s *Server) SetRestrictions(rules []RestrictRule) {
+	s.liveMu.Lock()
+	defer s.liveMu.Unlock()
+	live := *s.live.Load()
+	live.restrict = newRestrictTable(rules)
+	s.live.Store(&live)
+}
+
+// Restrictions returns the restrict rules in effect.
+func (s *Server) Restrictions() []RestrictRule {
+	t := s.live.Load().restrict
+	if t == nil {
+		return nil
+	}
+	return append([]RestrictRule(nil), t.all...)
+}
@@ -0,0 +1,177 @@
+package ntpserver
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseRestrictRule(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		prefix string
+		flags  RestrictFlags
+	}{
+		{"default kod limited", "invalid Prefix", RestrictKoD | RestrictLimited},
+		{"restrict 192.0.2.77/24 noquery nomodify", "192.0.2.0/24", RestrictNoQuery | RestrictNoModify},
+		{"2001:db8::1 ignore", "2001:db8::1/128", RestrictIgnore},
+		{"::ffff:192.0.2.1 noserve nopeer", "192.0.2.1/32", RestrictNoServe | RestrictNoPeer},
+		{"10.0.0.0/8", "10.0.0.0/8", 0},
+		// Real ntp.conf lines, with flags that have no meaning here.
+		{"restrict default kod limited nomodify notrap nopeer noquery", "invalid Prefix", RestrictKoD | RestrictLimited | RestrictNoModify | RestrictNoPeer | RestrictNoQuery},
+		{"restrict 127.0.0.1 notrust version lowpriotrap ntpport mssntp", "127.0.0.1/32", 0},
+		{"restrict 192.168.1.17 mask 255.255.255.0 nomodify notrap", "192.168.1.0/24", RestrictNoModify},
+		{"restrict 2001:db8:: mask ffff:ffff:: noquery", "2001:db8::/32", RestrictNoQuery},
+		{"restrict 10.1.2.3 mask 255.255.255.255", "10.1.2.3/32", 0},
+		{"restrict -4 default kod notrap nomodify nopeer noquery limited", "0.0.0.0/0", RestrictKoD | RestrictNoModify | RestrictNoPeer | RestrictNoQuery | RestrictLimited},
+		{"restrict -6 default ignore", "::/0", RestrictIgnore},
+	} {
+		r, err := ParseRestrictRule(tc.in)
+		if err != nil {
+			t.Fatalf("ParseRestrictRule(%q): %v", tc.in, err)
+		}
+		if r.Prefix.String() != tc.prefix || r.Flags != tc.flags {
+			t.Fatalf("ParseRestrictRule(%q): got=%s %q want=%s %q", tc.in, r.Prefix, r.Flags, tc.prefix, tc.flags)
+		}
+	}
+	for _, in := range []string{
+		"", "restrict", "192.0.2.0/33 kod", "host.example kod", "default nosuchflag",
+		"192.0.2.0 mask 255.0.255.0", "192.0.2.0 mask ffff::", "192.0.2.0 mask", "-4",
+	} {
+		if _, err := ParseRestrictRule(in); err == nil {
+			t.Fatalf("ParseRestrictRule(%q): expected error", in)
+		}
+	}
+}
+
+func TestRestrictRule_JSON(t *testing.T) {
+	in := RestrictRule{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Flags: RestrictKoD | RestrictLimited}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(b) != `{"prefix":"192.0.2.0/24","flags":"kod limited"}` {
+		t.Fatalf("json: got=%s", b)
+	}
+	var out RestrictRule
+	if err := json.Unmarshal(b, &out); err != nil || out != in {
+		t.Fatalf("round trip: got=%+v err=%v", out, err)
+	}
+}
+
+func TestRestrictTable_LongestPrefix(t *testing.T) {
+	tab := newRestrictTable([]RestrictRule{
+		{Flags: RestrictNoQuery},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Flags: RestrictLimited},
+		{Prefix: netip.MustParsePrefix("192.0.2.128/25"), Flags: RestrictNoServe},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Flags: RestrictIgnore}, // replaces the first /24
+	})
+	for _, tc := range []struct {
+		ip    string
+		flags RestrictFlags
+	}{
+		{"192.0.2.200", RestrictNoServe},
+		{"192.0.2.1", RestrictIgnore},
+		{"198.51.100.1", RestrictNoQuery},
+		{"2001:db8::1", RestrictNoQuery},
+	} {
+		if f, ok := tab.match(netip.MustParseAddr(tc.ip)); !ok || f != tc.flags {
+			t.Fatalf("match(%s): got=%q,%v want=%q", tc.ip, f, ok, tc.flags)
+		}
+	}
+	if f, ok := tab.match(netip.Addr{}); !ok || f != RestrictNoQuery {
+		t.Fatalf("non-IP clients get the default rule: got=%q,%v", f, ok)
+	}
+	if _, ok := newRestrictTable([]RestrictRule{{Prefix: netip.MustParsePrefix("10.0.0.0/8")}}).match(netip.MustParseAddr("192.0.2.1")); ok {
+		t.Fatalf("no rule should match without a default")
+	}
+}
+
+func TestServer_Restrict(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	rule := func(s string) RestrictRule {
+		r, err := ParseRestrictRule(s)
+		if err != nil {
+			t.Fatalf("rule %q: %v", s, err)
+		}
+		return r
+	}
+	srv := New(Config{
+		Clock:              fixedClock{t: now},
+		RateLimitPerSecond: 0.001,
+		RateLimitBurst:     1,
+		ControlAllow:       []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+		PassivePeers:       []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+		Restrict: []RestrictRule{
+			rule("default"),
+			rule("192.0.2.1 ignore"),
+			rule("192.0.2.2 noserve kod"),
+			rule("192.0.2.3 noquery"),
+			rule("192.0.2.4 nomodify"),
+			rule("192.0.2.5 nopeer"),
+			rule("192.0.2.6 limited"),
+		},
+	})
+	client := (&Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}).Marshal()
+	peer := (&Packet{VN: 4, Mode: ModeSymmetricActive, Transmit: timeToTimestamp(now)}).Marshal()
+	send := func(addr string, b []byte) (RequestEvent, *fakeWriter) {
+		t.Helper()
+		rw := &fakeWriter{}
+		from := remote{ap: netip.AddrPortFrom(netip.MustParseAddr(addr), 123)}
+		return handle(srv, rw, b, from, now), rw
+	}
+
+	if ev, rw := send("192.0.2.1", client); ev.Error != "restricted_ignore" || len(rw.sent) != 0 {
+		t.Fatalf("ignore: error=%q sent=%d", ev.Error, len(rw.sent))
+	}
+	ev, rw := send("192.0.2.2", client)
+	if ev.Error != "restricted_noserve" || ev.Kiss != KissRSTR || len(rw.sent) != 1 {
+		t.Fatalf("noserve kod: error=%q kiss=%q sent=%d", ev.Error, ev.Kiss, len(rw.sent))
+	}
+	if ev, _ := send("192.0.2.2", controlRequest(ctlOpReadVar, 1, 0, "")); ev.Error != "" || !ev.Responded {
+		t.Fatalf("noserve must still answer queries: error=%q", ev.Error)
+	}
+	if ev, _ := send("192.0.2.3", controlRequest(ctlOpReadVar, 1, 0, "")); ev.Error != "restricted_noquery" || ev.Mode != ModeControl {
+		t.Fatalf("noquery: error=%q mode=%d", ev.Error, ev.Mode)
+	}
+	if ev, _ := send("192.0.2.3", client); ev.Error != "" {
+		t.Fatalf("noquery must serve time: error=%q", ev.Error)
+	}
+	ev, rw = send("192.0.2.4", controlRequest(ctlOpWriteVar, 1, 0, "x=1"))
+	if ev.Error != "restricted_nomodify" || len(rw.sent) != 1 || rw.sent[0][1]&ctlError == 0 || rw.sent[0][4] != ctlErrPerm {
+		t.Fatalf("nomodify: error=%q sent=%x", ev.Error, rw.sent)
+	}
+	if ev, _ := send("192.0.2.5", peer); ev.Error != "restricted_nopeer" {
+		t.Fatalf("nopeer: error=%q", ev.Error)
+	}
+	if ev, _ := send("192.0.2.7", peer); ev.Error != "" || !ev.Responded {
+		t.Fatalf("peer without nopeer: error=%q", ev.Error)
+	}
+
+	// Only clients whose rule has limited are rate limited.
+	for i := 0; i < 2; i++ {
+		if ev, _ := send("192.0.2.7", client); ev.Error != "" {
+			t.Fatalf("unlimited client: error=%q", ev.Error)
+		}
+	}
+	send("192.0.2.6", client)
+	if ev, _ := send("192.0.2.6", client); ev.Error != "rate_limited" {
+		t.Fatalf("limited client: error=%q", ev.Error)
+	}
+
+	srv.SetRestrictions(nil)
+	if ev, _ := send("192.0.2.1", client); ev.Error != "" {
+		t.Fatalf("after SetRestrictions(nil): error=%q", ev.Error)
+	}
+	if got := srv.Restrictions(); got != nil {
+		t.Fatalf("Restrictions: got=%v", got)
+	}
+	srv.SetRestrictions([]RestrictRule{rule("192.0.2.0/24 ignore")})
+	if ev, _ := send("192.0.2.1", client); ev.Error != "restricted_ignore" {
+		t.Fatalf("after SetRestrictions: error=%q", ev.Error)
+	}
+	if got := srv.Restrictions(); len(got) != 1 || got[0].Flags != RestrictIgnore {
+		t.Fatalf("Restrictions: got=%v", got)
+	}
+}
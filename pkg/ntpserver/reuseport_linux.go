@@ -0,0 +1,11 @@
+//go:build linux
+
+package ntpserver
+
+import "golang.org/x/sys/unix"
+
+// setReusePort lets several sockets bind the same address, with the kernel
+// spreading incoming datagrams across them.
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
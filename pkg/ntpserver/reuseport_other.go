@@ -0,0 +1,9 @@
+//go:build !linux
+
+package ntpserver
+
+// setReusePort fails outside Linux: the BSDs accept SO_REUSEPORT, but hand
+// every datagram to the last socket bound instead of spreading them.
+func setReusePort(fd uintptr) error {
+	return ErrReusePortUnsupported
+}
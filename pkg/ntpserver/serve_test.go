@@ -0,0 +1,182 @@
+package ntpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memDatagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// memPacketConn is an in-memory net.PacketConn: datagrams pushed with
+// deliver are read by the server and its writes appear on sent.
+type memPacketConn struct {
+	in   chan memDatagram
+	sent chan memDatagram
+	done chan struct{}
+
+	mu       sync.Mutex
+	deadline time.Time
+	once     sync.Once
+}
+
+func newMemPacketConn() *memPacketConn {
+	return &memPacketConn{
+		in:   make(chan memDatagram, 16),
+		sent: make(chan memDatagram, 16),
+		done: make(chan struct{}),
+	}
+}
+
+func (c *memPacketConn) deliver(b []byte, from net.Addr) { c.in <- memDatagram{b: b, addr: from} }
+
+func (c *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case d := <-c.in:
+		return copy(p, d.b), d.addr, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.sent <- memDatagram{b: append([]byte(nil), p...), addr: addr}
+	return len(p), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr { return memAddr("server") }
+
+func (c *memPacketConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *memPacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memPacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+// memAddr is an address of a non-IP transport.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+func TestServer_ServeInMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := New(Config{Clock: fixedClock{t: now}, Stratum: 2})
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	conn := newMemPacketConn()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, conn) }()
+
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 40123}
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(now)}
+	conn.deliver(req.Marshal(), client)
+
+	select {
+	case d := <-conn.sent:
+		resp, ok := ParsePacket(d.b)
+		if !ok || resp.Mode != ModeServer || resp.Originate != req.Transmit {
+			t.Fatalf("bad response: ok=%v %+v", ok, resp)
+		}
+		if d.addr.String() != client.String() {
+			t.Fatalf("reply addr: got=%s want=%s", d.addr, client)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no response")
+	}
+	ev := waitForEvent(t, events, ModeClient)
+	if ev.ClientIP != "192.0.2.7" || ev.ClientPort != 40123 || !ev.Responded {
+		t.Fatalf("event: %+v", ev)
+	}
+
+	// Addresses of other transports are not IP endpoints: the request is
+	// still processed but has no client IP.
+	conn.deliver(req.Marshal(), memAddr("peer-1"))
+	select {
+	case d := <-conn.sent:
+		if d.addr.String() != "peer-1" {
+			t.Fatalf("reply addr: got=%s", d.addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no response to non-IP address")
+	}
+
+	if err := srv.Serve(ctx, newMemPacketConn()); !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("second Serve: got=%v want=%v", err, ErrAlreadyRunning)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Serve did not return after cancel")
+	}
+	select {
+	case <-conn.done:
+	default:
+		t.Fatalf("Serve must close conn")
+	}
+}
+
+func TestServer_StartStopsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := New(Config{ListenAddr: "127.0.0.1:0"})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		_ = srv.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Stop hung after context cancel")
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	_ = srv.Stop()
+}
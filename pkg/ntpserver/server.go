@@ -2,18 +2,52 @@ package ntpserver
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
+	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var ErrAlreadyRunning = errors.New("ntpserver: already running")
 
+// maxDatagramSize bounds a single request, including extension fields.
+const maxDatagramSize = 2048
+
 type Config struct {
 	ListenAddr string
 
+	// ListenAddrs, when set, replaces ListenAddr with several addresses
+	// served by one Server with shared metrics, limiter and events. An entry
+	// may name the interface to bind to: "192.0.2.1:123@vlan10".
+	ListenAddrs []string
+
+	// Interface binds listeners without their own "@iface" to this network
+	// interface (SO_BINDTODEVICE, Linux only; needs CAP_NET_RAW).
+	Interface string
+
+	// Workers is the number of goroutines answering requests on each listen
+	// address (default 1). They share one socket unless ReusePort is set, in
+	// which case each worker gets its own SO_REUSEPORT socket and the kernel
+	// spreads clients across them. ReusePort is Linux only, as other kernels
+	// do not balance SO_REUSEPORT sockets; Start fails elsewhere.
+	Workers   int
+	ReusePort bool
+
+	// BatchSize, when above 1, reads up to that many requests per system
+	// call and sends their replies together (recvmmsg/sendmmsg, Linux only;
+	// other platforms keep one read and one write per request). Each request
+	// keeps its own receive timestamp, taken by the kernel as with
+	// KernelTimestamps (software only, unless KernelTimestamps is set), so
+	// Clock does not supply it; Start fails if the socket cannot provide them.
+	BatchSize int
+
 	// Network specifies the network type: "udp" (both IPv4/IPv6), "udp4" (IPv4 only), or "udp6" (IPv6 only).
 	// Defaults to "udp" for dual-stack.
 	Network string
@@ -34,28 +68,179 @@ type Config struct {
 	Precision int8
 
 	// RootDelay and RootDispersion are optional fixed-point values.
-	RootDelay uint32
+	RootDelay      uint32
 	RootDispersion uint32
 
+	// Upstreams are NTP servers ("host" or "host:port") polled to derive the
+	// served stratum, RefID, leap indicator, root delay and root dispersion.
+	// When set, Stratum, RefID, LeapIndicator, RootDelay and RootDispersion
+	// are ignored; until an upstream answers the server reports itself as
+	// unsynchronized (stratum 16, leap alarm).
+	Upstreams []string
+
+	// Peers are symmetric active peers ("host" or "host:port"), polled in
+	// mode 1 from the server socket. Like upstreams they take part in source
+	// selection, so paired servers can back each other up. A source whose
+	// RefID is one of our listen addresses, or our own RefID at our stratum
+	// or above, is synchronized to us and is never selected.
+	Peers []string
+
+	// PassivePeers lists the prefixes allowed to mobilize a symmetric passive
+	// association by sending mode 1 packets; they are answered in mode 2.
+	// Mode 1 packets from other unconfigured addresses are dropped.
+	PassivePeers []netip.Prefix
+
+	// UpstreamPollInterval defaults to 64s. While an upstream is unreachable
+	// each poll is a burst of eight packets (like ntpd's iburst), spaced 2s
+	// apart or an eighth of the interval, whichever is shorter. Symmetric
+	// peers are polled at the same interval, without bursts.
+	UpstreamPollInterval time.Duration
+
+	// UpstreamTimeout bounds a single upstream exchange. Defaults to 2s.
+	UpstreamTimeout time.Duration
+
+	// Interleaved enables interleaved basic mode (as implemented by chrony).
+	// A client that echoes the receive timestamp of the previous reply as its
+	// origin timestamp gets the time that reply actually left, captured after
+	// the send, instead of a transmit timestamp taken before it.
+	Interleaved bool
+
+	// InterleavedClients bounds the per-client interleaved state (default
+	// 4096, least recently used first out); entries idle for longer than
+	// InterleavedTimeout (default 20m) expire.
+	InterleavedClients int
+	InterleavedTimeout time.Duration
+
+	// KernelTimestamps takes receive timestamps from the kernel
+	// (SO_TIMESTAMPING) instead of Clock, using the NIC's hardware timestamp
+	// when it provides one, and with Interleaved also the transmit timestamps
+	// of replies. Hardware timestamps assume the NIC clock is kept in UTC (for
+	// example by phc2sys). Linux only: Start fails with
+	// ErrKernelTimestampsUnsupported elsewhere.
+	KernelTimestamps bool
+
 	// RateLimitPerSecond enables a basic per-IP token bucket limiter.
 	// Set to 0 to disable.
 	RateLimitPerSecond float64
 	RateLimitBurst     int
 
+	// RateLimitClients caps the clients the limiter tracks (default 65536),
+	// so that a flood from spoofed sources cannot exhaust memory. Clients idle
+	// for RateLimitIdleTimeout are forgotten first; by default that is the
+	// time their bucket takes to refill, after which forgetting them changes
+	// nothing. RateLimitFull decides what happens to a new client when all
+	// tracked clients are still active (default RateLimitEvict).
+	RateLimitClients     int
+	RateLimitIdleTimeout time.Duration
+	RateLimitFull        RateLimitFullPolicy
+
+	// RateLimitPrefixPerSecond and RateLimitPrefixBurst limit each IPv4
+	// /RateLimitPrefixV4 (default 24) and IPv6 /RateLimitPrefixV6 (default 64)
+	// as a whole, so a client cannot escape the per-address limit by rotating
+	// through the addresses of its network. RateLimitGlobalPerSecond and
+	// RateLimitGlobalBurst limit all requests together. Each layer is off at 0;
+	// a burst of 0 allows one second's worth of requests. Prefixes are tracked
+	// in a table bounded like the per-address one.
+	RateLimitPrefixPerSecond float64
+	RateLimitPrefixBurst     int
+	RateLimitPrefixV4        int
+	RateLimitPrefixV6        int
+	RateLimitGlobalPerSecond float64
+	RateLimitGlobalBurst     int
+
+	// KoD answers rate-limited requests, and hook drops that pick a kiss code
+	// (see DropKoDRate), with a Kiss-o'-Death instead of dropping them silently.
+	KoD bool
+
+	// KoDRateLimitPerSecond and KoDBurst bound Kiss-o'-Death replies per client
+	// IP so they cannot be used for reflection. Defaults to 0.1/s with burst 1.
+	KoDRateLimitPerSecond float64
+	KoDBurst              int
+
+	// KoDMinPoll is the minimum poll exponent advertised in KoD replies. Defaults to 10 (1024s).
+	KoDMinPoll int8
+
+	// Broadcast lists broadcast or multicast destinations ("224.0.1.1",
+	// "192.0.2.255:123") that get an unsolicited mode 5 packet every
+	// BroadcastInterval, carrying the same stratum, RefID and leap indicator
+	// as client replies. Each destination is sent from a listener of its
+	// address family; Start fails if there is none.
+	Broadcast []string
+
+	// BroadcastInterval defaults to 64s.
+	BroadcastInterval time.Duration
+
+	// BroadcastKeyID signs broadcast packets with this key from Keys. Zero
+	// sends them unauthenticated.
+	BroadcastKeyID uint32
+
 	// EventBuffer is the buffer size per subscriber.
 	EventBuffer int
 	// HistorySize is how many recent events are kept.
 	HistorySize int
 
+	// TopClients is how many clients MetricsSnapshot.TopClients and
+	// RecentTopClients list (default 10). Clients are counted with the
+	// Space-Saving algorithm in 1/TopClientsError entries per worker
+	// (default 0.001, so 1000): every client that sent more than that share of the requests
+	// is tracked, and no count is more than that share too high. The same
+	// entries make up the ntpq MRU list. RecentTopClients covers the last
+	// TopClientsWindow (default 10m).
+	TopClients       int
+	TopClientsError  float64
+	TopClientsWindow time.Duration
+
+	// LatencyResetOnRead clears the latency histograms on every Metrics
+	// call, so that each MetricsSnapshot covers the time since the previous
+	// one. MetricsHandler never clears them: its _sum and _count keep
+	// counting from Start, and its quantiles cover the time since the last
+	// Metrics call.
+	LatencyResetOnRead bool
+
 	// Hook is called after parsing and basic checks, before responding.
 	// If it returns a non-empty string, the request is dropped.
 	Hook PacketHook
 
+	// Keys enables symmetric-key MAC authentication (MD5, SHA-1, AES-CMAC).
+	// Requests with a valid MAC from a trusted key get a reply signed with the
+	// same key; any other MAC gets a crypto-NAK. See LoadKeyFile.
+	Keys *Keyring
+
+	// NTS enables Network Time Security (RFC 8915): an NTS-KE listener and
+	// authenticated responses to requests carrying NTS extension fields.
+	NTS *NTSConfig
+
+	// ControlAllow lists the client prefixes allowed to send mode 6 control
+	// queries (ntpq -c rv, -p, mrulist). Mode 6 is disabled when empty.
+	ControlAllow []netip.Prefix
+
+	// Restrict are ntpd-style access rules, checked before a packet is parsed.
+	// The rule with the longest matching prefix applies. When a client's rule
+	// lacks RestrictLimited, only the global rate limit applies to it; clients
+	// that match no rule are rate limited as usual. Server.SetRestrictions
+	// replaces the rules at runtime.
+	Restrict []RestrictRule
+
 	// Logger for debug/info messages. If nil, no logging is performed.
 	Logger *log.Logger
 
 	// Debug enables verbose debug logging.
 	Debug bool
+
+	// Slog, when set, is used instead of Logger, with structured attributes
+	// and levels. Each request is logged once handled, with its client,
+	// version, mode, outcome and latency: at LevelDebug when it was answered
+	// and at LevelInfo when it was refused or failed. Debug has no effect;
+	// the handler's level decides.
+	Slog *slog.Logger
+
+	// LogRequestsPerSecond and LogRequestsBurst cap the request lines written
+	// to Slog or Logger (default 10 per second, burst one second's worth), so
+	// that logging cannot slow the server under load. Lines over the cap are
+	// counted in the "suppressed" attribute of the next Slog line. Negative
+	// logs every request.
+	LogRequestsPerSecond float64
+	LogRequestsBurst     int
 }
 
 func (c Config) normalize() Config {
@@ -66,6 +251,9 @@ func (c Config) normalize() Config {
 	if out.Network == "" {
 		out.Network = "udp"
 	}
+	if out.Workers <= 0 {
+		out.Workers = 1
+	}
 	if out.Clock == nil {
 		out.Clock = systemClock{}
 	}
@@ -84,108 +272,424 @@ func (c Config) normalize() Config {
 	if out.HistorySize <= 0 {
 		out.HistorySize = 500
 	}
+	if out.TopClients <= 0 {
+		out.TopClients = 10
+	}
+	if out.TopClientsError <= 0 || out.TopClientsError > 1 {
+		out.TopClientsError = 0.001
+	}
+	if out.TopClientsWindow <= 0 {
+		out.TopClientsWindow = 10 * time.Minute
+	}
 	if out.RateLimitBurst <= 0 {
 		out.RateLimitBurst = 5
 	}
+	if out.RateLimitClients <= 0 {
+		out.RateLimitClients = 65536
+	}
+	if out.RateLimitFull == "" {
+		out.RateLimitFull = RateLimitEvict
+	}
+	if out.RateLimitPrefixBurst <= 0 {
+		out.RateLimitPrefixBurst = int(math.Ceil(out.RateLimitPrefixPerSecond))
+	}
+	if out.RateLimitPrefixV4 <= 0 || out.RateLimitPrefixV4 > 32 {
+		out.RateLimitPrefixV4 = 24
+	}
+	if out.RateLimitPrefixV6 <= 0 || out.RateLimitPrefixV6 > 128 {
+		out.RateLimitPrefixV6 = 64
+	}
+	if out.RateLimitGlobalBurst <= 0 {
+		out.RateLimitGlobalBurst = int(math.Ceil(out.RateLimitGlobalPerSecond))
+	}
+	if out.UpstreamPollInterval <= 0 {
+		out.UpstreamPollInterval = 64 * time.Second
+	}
+	if out.UpstreamTimeout <= 0 {
+		out.UpstreamTimeout = 2 * time.Second
+	}
+	if out.KoDRateLimitPerSecond <= 0 {
+		out.KoDRateLimitPerSecond = 0.1
+	}
+	if out.KoDBurst <= 0 {
+		out.KoDBurst = 1
+	}
+	if out.KoDMinPoll == 0 {
+		out.KoDMinPoll = 10
+	}
+	if out.InterleavedClients <= 0 {
+		out.InterleavedClients = 4096
+	}
+	if out.InterleavedTimeout <= 0 {
+		out.InterleavedTimeout = 20 * time.Minute
+	}
+	if out.BroadcastInterval <= 0 {
+		out.BroadcastInterval = 64 * time.Second
+	}
+	if out.LogRequestsPerSecond == 0 {
+		out.LogRequestsPerSecond = 10
+	}
+	if out.LogRequestsBurst <= 0 && out.LogRequestsPerSecond > 0 {
+		out.LogRequestsBurst = int(math.Ceil(out.LogRequestsPerSecond))
+	}
 	return out
 }
 
 type Server struct {
 	cfg Config
 
-	mu      sync.RWMutex
-	conn    *net.UDPConn
-	running bool
+	mu        sync.RWMutex
+	conn      net.PacketConn // first listener; used for peers
+	listeners []*listener
+	workers   []*worker // of the current or last run
+	running   bool
 
 	hub     *eventHub
 	metrics *metrics
-	limiter *limiter
+	nts     *ntsState
+	ups     *upstreamSet
+	il      *interleaveTable
+
+	kernelTS  bool
+	txPending txPending
+
+	ctlSecret [32]byte
 
-	wg sync.WaitGroup
-	stopOnce sync.Once
+	// cfgErr is what Config.validate found wrong with the configuration
+	// passed to New; Start and Serve return it.
+	cfgErr error
+
+	// live holds what Reconfigure changes; liveMu serializes its writers.
+	live   atomic.Pointer[liveConfig]
+	liveMu sync.Mutex
+
+	// logLimit samples request log lines; logSuppressed counts the rest.
+	logLimit      *tokenBucket
+	logSuppressed atomic.Uint64
+
+	wg     sync.WaitGroup
 	stopCh chan struct{}
 }
 
 func New(cfg Config) *Server {
+	cfgErr := cfg.validate()
 	cfg = cfg.normalize()
-	return &Server{
+	s := &Server{
 		cfg:     cfg,
+		cfgErr:  cfgErr,
 		hub:     newEventHub(cfg.HistorySize),
-		metrics: newMetrics(),
-		limiter: newLimiter(cfg.RateLimitPerSecond, cfg.RateLimitBurst),
+		metrics: newMetrics(cfg),
 		stopCh:  make(chan struct{}),
 	}
+	_, _ = rand.Read(s.ctlSecret[:])
+	s.live.Store(newLiveConfig(cfg, nil))
+	s.logLimit = newTokenBucket(cfg.LogRequestsPerSecond, cfg.LogRequestsBurst)
+	if cfg.NTS != nil {
+		s.nts = newNTSState(*cfg.NTS)
+	}
+	if cfg.Interleaved {
+		s.il = newInterleaveTable(cfg.InterleavedClients, cfg.InterleavedTimeout)
+	}
+	if len(cfg.Upstreams) > 0 || len(cfg.Peers) > 0 || len(cfg.PassivePeers) > 0 {
+		s.ups = newUpstreamSet(cfg)
+	}
+	return s
 }
 
+// Start listens on Config.ListenAddr (or ListenAddrs) and serves in the
+// background until ctx is cancelled or Stop is called.
 func (s *Server) Start(ctx context.Context) error {
+	stop, err := s.begin()
+	if err != nil {
+		return err
+	}
+
+	var ls []*listener
+	closeAll := func() {
+		for _, l := range ls {
+			_ = l.conn.Close()
+		}
+	}
+	sockets, perListener := 1, s.cfg.Workers
+	if s.cfg.ReusePort {
+		sockets, perListener = s.cfg.Workers, 1
+	}
+	for _, spec := range s.cfg.listenSpecs() {
+		for i := 0; i < sockets; i++ {
+			conn, err := listenUDP(s.cfg.Network, spec, s.cfg.ReusePort)
+			if err != nil {
+				closeAll()
+				s.abort()
+				return err
+			}
+			ls = append(ls, newListener(conn, spec.iface))
+			// The other sockets join the port the first one was given.
+			spec.addr = conn.LocalAddr().String()
+		}
+	}
+	ws, err := s.setup(ctx, ls, perListener, stop)
+	if err != nil {
+		closeAll()
+		return err
+	}
+
+	for _, w := range ws {
+		go func(w *worker) {
+			defer s.wg.Done()
+			err := s.serveLoop(w, stop)
+			switch {
+			case err == nil:
+			case s.cfg.Slog != nil:
+				s.cfg.Slog.Error("ntp worker stopped", "worker", w.id, "addr", w.l.local, "err", err)
+			case s.cfg.Logger != nil:
+				s.cfg.Logger.Printf("[ERROR] NTP worker %d stopped on %s: %v", w.id, w.l.local, err)
+			}
+		}(w)
+	}
+	return nil
+}
+
+// Serve answers requests on conn, which may be any packet transport, until
+// ctx is cancelled or Stop is called. It blocks, takes ownership of conn and
+// closes it before returning. Serve returns nil once stopped, or the error
+// that made reading from conn fail. Broadcast and kernel timestamps need
+// conn to be a *net.UDPConn; the listen settings (ListenAddr, ListenAddrs,
+// Interface) are not used.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	stop, err := s.begin()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	ws, err := s.setup(ctx, []*listener{newListener(conn, "")}, s.cfg.Workers, stop)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	for _, w := range ws[1:] {
+		go func(w *worker) {
+			defer s.wg.Done()
+			_ = s.serveLoop(w, stop)
+		}(w)
+	}
+	err = s.serveLoop(ws[0], stop)
+	s.wg.Done()
+	// Closes conn if the loop ended on a read error rather than through Stop.
+	s.shutdown(stop)
+	s.wg.Wait()
+	return err
+}
+
+// begin marks the server running and returns the stop channel of this run.
+func (s *Server) begin() (chan struct{}, error) {
+	if s.cfgErr != nil {
+		return nil, s.cfgErr
+	}
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.running {
-		s.mu.Unlock()
-		return ErrAlreadyRunning
+		return nil, ErrAlreadyRunning
 	}
 	s.running = true
 	s.stopCh = make(chan struct{})
-	s.stopOnce = sync.Once{}
+	return s.stopCh, nil
+}
+
+// abort undoes begin when starting fails.
+func (s *Server) abort() {
+	s.mu.Lock()
+	s.running = false
 	s.mu.Unlock()
+}
 
-	udpAddr, err := net.ResolveUDPAddr(s.cfg.Network, s.cfg.ListenAddr)
-	if err != nil {
-		s.mu.Lock()
-		s.running = false
-		s.mu.Unlock()
-		return err
+// setup prepares the listeners, starts the background goroutines and returns
+// perListener workers for each listener. The caller owns one s.wg count per
+// worker for its serve loop. On failure the server is no longer running and
+// the listeners are left open.
+func (s *Server) setup(ctx context.Context, ls []*listener, perListener int, stop chan struct{}) ([]*worker, error) {
+	var (
+		broadcastDests []broadcastDest
+		broadcastKey   *keyEntry
+		err            error
+	)
+	if len(s.cfg.Broadcast) > 0 {
+		broadcastDests, err = resolveBroadcast(s.cfg.Network, s.cfg.Broadcast, ls)
+		if err == nil && s.cfg.BroadcastKeyID != 0 {
+			if s.cfg.Keys != nil {
+				broadcastKey = s.cfg.Keys.lookup(s.cfg.BroadcastKeyID)
+			}
+			if broadcastKey == nil {
+				err = ErrKeyMissing
+			}
+		}
+		if err != nil {
+			s.abort()
+			return nil, err
+		}
 	}
 
-	conn, err := net.ListenUDP(s.cfg.Network, udpAddr)
-	if err != nil {
-		s.mu.Lock()
-		s.running = false
-		s.mu.Unlock()
-		return err
+	if s.cfg.KernelTimestamps {
+		for _, l := range ls {
+			err := ErrKernelTimestampsUnsupported
+			if uc, ok := l.conn.(*net.UDPConn); ok {
+				err = enableKernelTimestamps(uc, s.il != nil)
+				if err == nil && s.il != nil {
+					l.tx, err = newTxReader(s, uc)
+				}
+			}
+			if err != nil {
+				s.abort()
+				return nil, err
+			}
+		}
+	}
+
+	if s.cfg.BatchSize > 1 && !s.cfg.KernelTimestamps {
+		// A batched read returns several requests at once; the kernel's
+		// receive timestamps keep each one's arrival time.
+		for _, l := range ls {
+			uc, ok := l.conn.(*net.UDPConn)
+			if !ok || newBatchConn(uc) == nil {
+				continue
+			}
+			if err := enableRxTimestamps(uc); err != nil {
+				s.abort()
+				return nil, err
+			}
+		}
+	}
+
+	for _, d := range broadcastDests {
+		if uc, ok := d.conn.(*net.UDPConn); ok {
+			if err := setBroadcast(uc); err != nil {
+				s.abort()
+				return nil, err
+			}
+		}
+	}
+
+	if s.nts != nil {
+		if err := s.nts.listenKE(stop); err != nil {
+			s.abort()
+			return nil, err
+		}
 	}
 
 	s.mu.Lock()
-	s.conn = conn
+	s.conn = ls[0].conn
+	s.listeners = ls
+	s.workers = newWorkers(ls, perListener)
+	ws := s.workers
+	s.kernelTS = s.cfg.KernelTimestamps
 	s.metrics.reset(time.Now().UTC())
+	for _, w := range ws {
+		w.clients = s.metrics.addClientShard()
+	}
+	s.wg.Add(len(ws))
 	s.mu.Unlock()
 
-	if s.cfg.Logger != nil {
-		s.cfg.Logger.Printf("[INFO] NTP server started on %s (stratum %d)", s.cfg.ListenAddr, s.cfg.Stratum)
+	for _, l := range ls {
+		if s.cfg.Slog != nil {
+			s.cfg.Slog.Info("ntp server started", "addr", l.local, "stratum", s.live.Load().cfg.Stratum)
+		} else if s.cfg.Logger != nil {
+			s.cfg.Logger.Printf("[INFO] NTP server started on %s (stratum %d)", l.local, s.live.Load().cfg.Stratum)
+		}
 	}
 
-	s.wg.Add(1)
-	go s.serveLoop(ctx)
-	return nil
+	if s.ups != nil {
+		s.ups.setLocal(localRefIDs(ls))
+		s.ups.run(stop, &s.wg)
+		s.runPeers(stop)
+	}
+	if len(broadcastDests) > 0 {
+		s.runBroadcast(stop, broadcastDests, broadcastKey)
+	}
+
+	// Not part of s.wg, and it does not wait for it: the serve loop would
+	// otherwise wait for itself when ctx is cancelled.
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.shutdown(stop)
+		case <-stop:
+		}
+	}()
+	return ws, nil
 }
 
 // Addr returns the current bound local address if running, otherwise the configured ListenAddr.
+// With several listeners it is the first one; see Addrs.
 func (s *Server) Addr() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.conn != nil {
 		return s.conn.LocalAddr().String()
 	}
-	return s.cfg.ListenAddr
+	return s.cfg.listenSpecs()[0].addr
 }
 
-func (s *Server) Stop() error {
-	var conn *net.UDPConn
-	s.stopOnce.Do(func() {
-		s.mu.Lock()
-		conn = s.conn
-		s.conn = nil
-		s.running = false
-		close(s.stopCh)
-		s.mu.Unlock()
-		if conn != nil {
-			_ = conn.Close()
+// Addrs returns the bound local address of every listener if running,
+// otherwise the configured listen addresses.
+func (s *Server) Addrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []string
+	if len(s.listeners) > 0 {
+		for _, l := range s.listeners {
+			// SO_REUSEPORT sockets of one address are adjacent.
+			if n := len(out); n == 0 || out[n-1] != l.local {
+				out = append(out, l.local)
+			}
 		}
-	})
+		return out
+	}
+	for _, spec := range s.cfg.listenSpecs() {
+		out = append(out, spec.addr)
+	}
+	return out
+}
 
+// Stop shuts the server down and waits for its goroutines. It is safe to
+// call more than once.
+func (s *Server) Stop() error {
+	s.mu.RLock()
+	stop := s.stopCh
+	s.mu.RUnlock()
+	s.shutdown(stop)
 	s.wg.Wait()
 	return nil
 }
 
+// shutdown ends the run that stop belongs to, unless it has already ended.
+func (s *Server) shutdown(stop chan struct{}) {
+	s.mu.Lock()
+	if !s.running || s.stopCh != stop {
+		s.mu.Unlock()
+		return
+	}
+	ls := s.listeners
+	s.conn = nil
+	s.listeners = nil
+	s.running = false
+	close(stop)
+	s.mu.Unlock()
+
+	for _, l := range ls {
+		_ = l.conn.Close()
+	}
+	if s.nts != nil {
+		s.nts.closeKE()
+	}
+}
+
+// NTSKEAddr returns the bound NTS-KE address, or "" if NTS is not running.
+func (s *Server) NTSKEAddr() string {
+	if s.nts == nil {
+		return ""
+	}
+	return s.nts.keAddr()
+}
+
 func (s *Server) Subscribe() (<-chan RequestEvent, func()) {
 	return s.hub.subscribe(s.cfg.EventBuffer)
 }
@@ -195,124 +699,414 @@ func (s *Server) History() []RequestEvent {
 }
 
 func (s *Server) Metrics() MetricsSnapshot {
-	return s.metrics.snapshot()
+	m := s.snapshot(true)
+	m.Processing = s.metrics.processing.snapshot(s.cfg.LatencyResetOnRead)
+	m.RxToTx = s.metrics.rxToTx.snapshot(s.cfg.LatencyResetOnRead)
+	return m
 }
 
-func (s *Server) serveLoop(ctx context.Context) {
-	defer s.wg.Done()
+// snapshot is Metrics without the latency histograms, which readers other
+// than Metrics must not clear. Without top it leaves out TopClients and
+// RecentTopClients, which merge the client summaries of every worker.
+func (s *Server) snapshot(top bool) MetricsSnapshot {
+	m := s.metrics.counters()
+	s.metrics.clientTotals(&m)
+	if top {
+		s.metrics.topClients(&m, s.cfg.Clock.Now())
+	}
+	m.EventsDropped = s.hub.dropped.Load()
+	if s.cfg.Keys != nil {
+		m.Keys = s.cfg.Keys.Stats()
+	}
+	if s.nts != nil {
+		m.NTS = s.nts.snapshot()
+	}
+	live := s.live.Load()
+	if live.cfg.RateLimitPerSecond > 0 {
+		m.RateLimit = live.limiter.snapshot()
+	}
+	if live.cfg.RateLimitPrefixPerSecond > 0 {
+		m.RateLimitPrefixes = live.prefixLimiter.snapshot()
+	}
+	s.mu.RLock()
+	for _, w := range s.workers {
+		m.Workers = append(m.Workers, w.snapshot())
+	}
+	s.mu.RUnlock()
+	return m
+}
+
+// Upstreams returns the state of the configured upstream servers.
+func (s *Server) Upstreams() []UpstreamStatus {
+	if s.ups == nil {
+		return nil
+	}
+	return s.ups.status()
+}
+
+func (s *Server) responseConfig(now time.Time) responseConfig {
+	cfg := &s.live.Load().cfg
+	if s.ups != nil && s.ups.mitigate {
+		sys := s.ups.system(now)
+		if !sys.synced {
+			refID := sys.refID
+			if refID == 0 {
+				refID = refIDFromASCII4("INIT")
+			}
+			return responseConfig{
+				LeapIndicator: leapAlarm,
+				Stratum:       stratumUnsync,
+				Precision:     cfg.Precision,
+				RefID:         refID,
+			}
+		}
+		return responseConfig{
+			LeapIndicator:  sys.leap,
+			Stratum:        sys.stratum,
+			Precision:      cfg.Precision,
+			RootDelay:      durationToShort(sys.rootDelay),
+			RootDispersion: durationToShort(sys.rootDispersion),
+			RefID:          sys.refID,
+			ReferenceTime:  sys.updated,
+		}
+	}
+	return responseConfig{
+		LeapIndicator:  cfg.LeapIndicator,
+		Stratum:        cfg.Stratum,
+		Precision:      cfg.Precision,
+		RootDelay:      cfg.RootDelay,
+		RootDispersion: cfg.RootDispersion,
+		RefID:          cfg.RefID,
+		ReferenceTime:  now,
+	}
+}
+
+// serveLoop reads requests from conn until the server stops. It returns nil
+// when stopped and the read error otherwise.
+func (s *Server) serveLoop(w *worker, stop chan struct{}) error {
+	l := w.l
+	conn := l.conn
+	s.mu.RLock()
+	kernelTS := s.kernelTS
+	s.mu.RUnlock()
+	uc, _ := conn.(*net.UDPConn)
+	kernelTS = kernelTS && uc != nil
+	if s.cfg.BatchSize > 1 {
+		if bc := newBatchConn(conn); bc != nil {
+			return s.serveBatch(w, bc, kernelTS, stop)
+		}
+	}
 
-	buf := make([]byte, 1024)
+	rw := newConnWriter(conn, s.storeSent)
+	buf := make([]byte, maxDatagramSize)
+	oob := make([]byte, timestampOOBSize)
 	for {
 		select {
-		case <-ctx.Done():
-			_ = s.Stop()
-			return
-		case <-s.stopCh:
-			return
+		case <-stop:
+			return nil
 		default:
 		}
 
-		s.mu.RLock()
-		conn := s.conn
-		s.mu.RUnlock()
-		if conn == nil {
-			return
-		}
-
 		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, raddr, err := conn.ReadFromUDP(buf)
+		var (
+			n, oobn int
+			from    remote
+			err     error
+		)
+		switch {
+		case kernelTS:
+			n, oobn, _, from.ap, err = uc.ReadMsgUDPAddrPort(buf, oob)
+		case uc != nil:
+			// No net.Addr is allocated on this path.
+			n, from.ap, err = uc.ReadFromUDPAddrPort(buf)
+		default:
+			var addr net.Addr
+			n, addr, err = conn.ReadFrom(buf)
+			from = remoteOf(addr)
+		}
 		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if s.readTimeout(err, l, kernelTS) {
 				continue
 			}
-			return
+			return s.readError(err, stop)
 		}
 
 		receivedAt := s.cfg.Clock.Now()
+		rxSource := TimestampUser
+		if kernelTS {
+			if at, src, ok := parseKernelTimestamp(oob[:oobn]); ok {
+				receivedAt, rxSource = at, src
+			}
+		}
 		start := time.Now()
+		ev := s.handlePacket(w, rw, buf[:n], from, receivedAt, rxSource)
+		took := time.Since(start)
+		s.observeLatency(&ev, took)
+		s.logRequest(&ev, took)
+		w.count(ev)
+		s.hub.publish(ev)
+	}
+}
 
-		clientIP := ""
-		clientPort := 0
-		clientAddr := ""
-		if raddr != nil {
-			clientIP = raddr.IP.String()
-			clientPort = raddr.Port
-			clientAddr = raddr.String()
-		}
+// readTimeout reports whether err is the periodic read deadline, which is
+// also when pending transmit timestamps are collected.
+func (s *Server) readTimeout(err error, l *listener, kernelTS bool) bool {
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		return false
+	}
+	if kernelTS && s.il != nil {
+		s.drainTxTimestamps(l)
+	}
+	return true
+}
+
+// readError returns nil if a read failed because the server stopped, and
+// err otherwise.
+func (s *Server) readError(err error, stop chan struct{}) error {
+	select {
+	case <-stop:
+		return nil
+	default:
+		return err
+	}
+}
 
-		s.metrics.incRequest(clientIP, receivedAt)
+// handlePacket answers one request b from raddr, received by w at
+// receivedAt, and returns the event describing it. Replies go out through rw.
+// It does not allocate for a plain client request.
+func (s *Server) handlePacket(w *worker, rw replyWriter, b []byte, from remote, receivedAt time.Time, rxSource string) RequestEvent {
+	start := time.Now()
+	l := w.l
 
-		if s.cfg.Debug && s.cfg.Logger != nil {
-			s.cfg.Logger.Printf("[DEBUG] NTP request from %s:%d", clientIP, clientPort)
-		} else if s.cfg.Logger != nil {
-			s.cfg.Logger.Printf("[INFO] NTP request from %s", clientIP)
+	clientIP := from.ip()
+	clientPort := int(from.ap.Port())
+
+	var vnMode uint8
+	if len(b) > 0 {
+		vnMode = b[0] & 0x3f
+	}
+	s.metrics.incRequest(w.clients, clientIP, clientPort, vnMode, receivedAt)
+
+	ev := RequestEvent{
+		At:         receivedAt,
+		ClientPort: clientPort,
+		LocalAddr:  l.local,
+		Interface:  l.iface,
+		Responded:  false,
+	}
+	if from.ap.IsValid() {
+		ev.client = from.addrPort()
+	}
+
+	live := s.live.Load()
+	flags, restricted := live.restrict.match(clientIP)
+	if reason := restrictReason(flags, vnMode&0x7); reason != "" {
+		ev.Version = vnMode >> 3
+		ev.Mode = vnMode & 0x7
+		ev.Error = reason
+		if reason == "restricted_noserve" && flags&RestrictKoD != 0 {
+			if req, ok := ParsePacket(b); ok && req.Mode == ModeClient {
+				ev.PacketValid = true
+				s.sendKissOfDeath(rw, from, req, KissRSTR, flags, &ev)
+			}
 		}
+		ev.ProcessingUSec = time.Since(start).Microseconds()
+		s.metrics.incError(ev.Error)
+		return ev
+	}
 
-		ev := RequestEvent{
-			At:         receivedAt,
-			ClientAddr: clientAddr,
-			ClientIP:   clientIP,
-			ClientPort: clientPort,
-			Responded:  false,
+	if reason := live.rateLimited(clientIP, time.Now(), !restricted || flags&RestrictLimited != 0); reason != "" {
+		ev.Version = vnMode >> 3
+		ev.Mode = vnMode & 0x7
+		ev.PacketValid = true
+		ev.Error = reason
+		// Under global overload, dropping is cheaper than answering. Without
+		// KoD there is nothing to answer with, so the packet is not parsed.
+		kod := live.cfg.KoD || flags&RestrictKoD != 0
+		if kod && ev.Mode == ModeClient && reason != "rate_limited_global" {
+			if req, ok := ParsePacket(b); ok {
+				s.sendKissOfDeath(rw, from, req, KissRATE, flags, &ev)
+			}
 		}
+		ev.ProcessingUSec = time.Since(start).Microseconds()
+		s.metrics.incError(ev.Error)
+		return ev
+	}
 
-		if !s.limiter.allow(clientIP, time.Now()) {
-			ev.PacketValid = true
-			ev.Error = "rate_limited"
-			ev.ProcessingUSec = time.Since(start).Microseconds()
-			s.metrics.incError()
-			s.hub.publish(ev)
-			continue
+	if len(b) > 0 && b[0]&0x7 == ModeControl {
+		werr := s.handleControl(rw, from, b, flags, &ev)
+		ev.ProcessingUSec = time.Since(start).Microseconds()
+		switch {
+		case werr != nil:
+			s.metrics.incError("write_failed")
+		case ev.Error != "":
+			s.metrics.incError(ev.Error)
+		default:
+			s.metrics.incResponse()
 		}
+		return ev
+	}
 
-		req, ok := ParsePacket(buf[:n])
-		ev.PacketValid = ok
-		ev.Version = req.VN
-		ev.Mode = req.Mode
+	req, ok := ParsePacket(b)
+	ev.PacketValid = ok
+	ev.Version = req.VN
+	ev.Mode = req.Mode
 
-		if !ok || req.Mode != ModeClient {
-			ev.Error = "invalid_request"
+	if ok && (req.Mode == ModeSymmetricActive || req.Mode == ModeSymmetricPassive) {
+		werr := s.handlePeer(rw, from, req, receivedAt, flags, &ev)
+		ev.ProcessingUSec = time.Since(start).Microseconds()
+		switch {
+		case werr != nil:
+			s.metrics.incError("write_failed")
+		case ev.Error != "":
+			s.metrics.incError(ev.Error)
+		case ev.Responded:
+			s.metrics.incResponse()
+		}
+		return ev
+	}
+
+	if !ok || req.Mode != ModeClient {
+		ev.Error = "invalid_request"
+		ev.ProcessingUSec = time.Since(start).Microseconds()
+		s.metrics.incError(ev.Error)
+		return ev
+	}
+
+	var nts *ntsSession
+	if s.nts != nil && isNTSRequest(req) {
+		sess, reason := s.nts.authenticate(req, b)
+		if reason != "" {
+			ev.Error = reason
+			if sess != nil {
+				// Bad cookie or authenticator: answer with an NTS NAK so the
+				// client can go back to NTS-KE. Like a crypto-NAK it is
+				// counted as an error only.
+				if _, werr := writePacket(rw, s.nts.nak(req, sess), from); werr == nil {
+					ev.Responded = true
+				}
+			}
 			ev.ProcessingUSec = time.Since(start).Microseconds()
-			s.metrics.incError()
-			s.hub.publish(ev)
-			continue
+			s.metrics.incError(ev.Error)
+			return ev
 		}
+		nts = sess
+		ev.Auth = "nts"
+	}
 
-		if s.cfg.Hook != nil {
-			dropReason := s.cfg.Hook(req, RequestMeta{ReceivedAt: receivedAt, ClientIP: clientIP, ClientPort: clientPort, RawLen: n})
-			if dropReason != "" {
-				ev.Error = dropReason
-				ev.ProcessingUSec = time.Since(start).Microseconds()
-				s.metrics.incError()
-				s.hub.publish(ev)
-				continue
+	var signKey *keyEntry
+	if s.cfg.Keys != nil && req.MAC != nil && !req.MAC.IsCryptoNAK() {
+		key, ok := s.cfg.Keys.verify(b[:len(b)-req.MAC.Len()], req.MAC)
+		if !ok {
+			// Unknown key, untrusted key or bad digest: reply with a crypto-NAK.
+			// It is counted as an error only, not also as a response.
+			now := s.cfg.Clock.Now()
+			nak := BuildResponse(req, s.responseConfig(now), receivedAt, now)
+			nak.MAC = &MAC{}
+			if _, werr := writePacket(rw, nak, from); werr == nil {
+				ev.Responded = true
 			}
+			ev.Error = "auth_failed"
+			ev.KeyID = req.MAC.KeyID
+			ev.ProcessingUSec = time.Since(start).Microseconds()
+			s.metrics.incError(ev.Error)
+			return ev
 		}
+		signKey = key
+		ev.Auth = "symmetric"
+		ev.KeyID = req.MAC.KeyID
+	}
 
-		now := s.cfg.Clock.Now()
-		resp := BuildResponse(req, responseConfig{
-			LeapIndicator:  s.cfg.LeapIndicator,
-			Stratum:        s.cfg.Stratum,
-			Precision:      s.cfg.Precision,
-			RootDelay:      s.cfg.RootDelay,
-			RootDispersion: s.cfg.RootDispersion,
-			RefID:          s.cfg.RefID,
-			ReferenceTime:  now,
-		}, receivedAt, now)
-
-		out := resp.Marshal()
-		_, werr := conn.WriteToUDP(out, raddr)
-		if werr != nil {
-			ev.Error = werr.Error()
+	if live.cfg.Hook != nil {
+		dropReason := live.cfg.Hook(req, RequestMeta{ReceivedAt: receivedAt, ClientIP: ipString(clientIP), ClientPort: clientPort, RawLen: len(b)})
+		if dropReason != "" {
+			ev.Error = dropReason
+			if code, ok := kissCodeFromDrop(dropReason); ok {
+				s.sendKissOfDeath(rw, from, req, code, flags, &ev)
+			}
 			ev.ProcessingUSec = time.Since(start).Microseconds()
-			s.metrics.incError()
-			s.hub.publish(ev)
-			continue
+			s.metrics.incError(ev.Error)
+			return ev
 		}
+	}
+
+	now := s.cfg.Clock.Now()
+	resp := BuildResponse(req, s.responseConfig(now), receivedAt, now)
+	ev.TimestampSource = rxSource
+	ev.TxTimestampSource = TimestampUser
+	if s.il != nil {
+		if s.kernelTS {
+			// Collects the transmit timestamps of earlier replies, this
+			// client's previous one included.
+			s.drainTxTimestamps(l)
+		}
+		if tx, src, ok := s.il.lookup(clientIP, req.Originate, receivedAt); ok {
+			// Interleaved reply: echo the client's receive timestamp of our
+			// previous reply and send when that reply actually left.
+			resp.Originate = req.Receive
+			resp.Transmit = tx
+			ev.Interleaved = true
+			ev.TxTimestampSource = src
+		}
+	}
+	if nts != nil {
+		resp = s.nts.seal(resp, nts)
+	}
+	if signKey != nil {
+		resp.MAC = signKey.sign(resp.Marshal())
+	}
 
-		s.metrics.incResponse()
-		ev.Responded = true
+	n, werr := writePacket(rw, resp, from)
+	if werr != nil {
+		ev.Error = werr.Error()
 		ev.ProcessingUSec = time.Since(start).Microseconds()
-		s.hub.publish(ev)
+		s.metrics.incError("write_failed")
+		return ev
+	}
+
+	if s.il != nil {
+		rw.afterSend(sentReply{ip: clientIP, rx: resp.Receive, n: n, at: receivedAt})
+	}
+
+	s.metrics.incResponse()
+	ev.Responded = true
+	ev.ProcessingUSec = time.Since(start).Microseconds()
+	return ev
+}
+
+// writePacket marshals p into a pooled buffer and writes it to to. It
+// returns the length of the packet.
+func writePacket(rw replyWriter, p Packet, to remote) (int, error) {
+	bp := replyBufs.Get().(*[]byte)
+	n, err := p.MarshalTo(*bp)
+	if errors.Is(err, io.ErrShortBuffer) {
+		// Larger than any request; only possible with many NTS cookies.
+		*bp = make([]byte, p.Len())
+		n, err = p.MarshalTo(*bp)
+	}
+	if err != nil {
+		rw.recycle(bp)
+		return 0, err
+	}
+	werr := rw.writeTo((*bp)[:n], to)
+	rw.recycle(bp)
+	return n, werr
+}
+
+// storeSent records when an interleaved reply left: now, until the kernel
+// transmit timestamp is read with the next request or read timeout.
+func (s *Server) storeSent(r sentReply) {
+	s.il.store(r.ip, r.rx, timeToTimestamp(s.cfg.Clock.Now()), TimestampUser, r.at)
+	if s.kernelTS {
+		s.txPending.add(r.ip, r.rx, r.n)
+	}
+}
+
+// ipString formats ip, or returns "" for the invalid address.
+func ipString(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
 	}
+	return ip.String()
 }
@@ -166,3 +166,50 @@ func TestServer_InvalidPacket_NoResponseAndInvalidEvent(t *testing.T) {
 		t.Fatalf("timeout waiting for event")
 	}
 }
+
+func TestServer_HookReceivesExtensions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan []ExtensionField, 1)
+	srv := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Hook: func(req Packet, _ RequestMeta) string {
+			got <- req.Extensions
+			return ""
+		},
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	raddr, err := net.ResolveUDPAddr("udp", srv.Addr())
+	if err != nil {
+		t.Fatalf("resolve server addr: %v", err)
+	}
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+
+	req := Packet{
+		VN:         4,
+		Mode:       ModeClient,
+		Transmit:   timeToTimestamp(time.Now()),
+		Extensions: []ExtensionField{{Type: 0x2005, Value: []byte("diag-0001")}},
+	}
+	if _, err := c.Write(req.Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case exts := <-got:
+		if len(exts) != 1 || exts[0].Type != 0x2005 {
+			t.Fatalf("hook extensions: got=%+v", exts)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for hook")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package ntpserver
+
+import "net"
+
+// setBroadcast is a no-op where socket options are not available.
+func setBroadcast(conn *net.UDPConn) error { return nil }
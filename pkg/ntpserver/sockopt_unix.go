@@ -0,0 +1,23 @@
+//go:build unix
+
+package ntpserver
+
+import (
+	"net"
+	"syscall"
+)
+
+// setBroadcast allows conn to send to subnet broadcast addresses.
+func setBroadcast(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
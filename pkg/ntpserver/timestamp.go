@@ -0,0 +1,112 @@
+package ntpserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Timestamp sources reported in RequestEvent.
+const (
+	// TimestampUser is a timestamp read from Config.Clock in the server loop.
+	TimestampUser = "user"
+	// TimestampKernelSW is a software timestamp taken by the kernel.
+	TimestampKernelSW = "kernel_sw"
+	// TimestampKernelHW is a hardware timestamp taken by the NIC.
+	TimestampKernelHW = "kernel_hw"
+)
+
+// ErrKernelTimestampsUnsupported is returned by Start when
+// Config.KernelTimestamps is set on a platform without SO_TIMESTAMPING.
+var ErrKernelTimestampsUnsupported = errors.New("ntpserver: kernel timestamps are not supported on this platform")
+
+// txPendingSize bounds the replies waiting for a kernel transmit timestamp.
+const txPendingSize = 64
+
+// txPending remembers recent replies so transmit timestamps read from the
+// socket error queue can be matched to the client they were sent to.
+type txPending struct {
+	mu      sync.Mutex
+	entries [txPendingSize]txPendingEntry
+	next    int
+}
+
+type txPendingEntry struct {
+	ip netip.Addr
+	rx Timestamp // receive timestamp written into the reply; identifies it
+	n  int       // reply length
+}
+
+func (p *txPending) add(ip netip.Addr, rx Timestamp, n int) {
+	p.mu.Lock()
+	p.entries[p.next] = txPendingEntry{ip: ip, rx: rx, n: n}
+	p.next = (p.next + 1) % txPendingSize
+	p.mu.Unlock()
+}
+
+// match finds the reply looped back in data. The kernel returns the sent
+// packet with its network headers, so the reply is the tail of data.
+func (p *txPending) match(data []byte) (txPendingEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.entries {
+		off := len(data) - e.n
+		if e.n < PacketSize || off < 0 {
+			continue
+		}
+		if Timestamp(binary.BigEndian.Uint64(data[off+32:off+40])) == e.rx {
+			return e, true
+		}
+	}
+	return txPendingEntry{}, false
+}
+
+// txReader reads the transmit timestamps of one listener's socket. The
+// workers sharing the socket take turns, reusing its buffers, so reading
+// does not allocate.
+type txReader struct {
+	mu     sync.Mutex
+	s      *Server
+	rc     syscall.RawConn
+	data   []byte
+	oob    []byte
+	readFn func(fd uintptr) // r.read, bound once
+}
+
+func newTxReader(s *Server, conn *net.UDPConn) (*txReader, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	r := &txReader{
+		s:    s,
+		rc:   rc,
+		data: make([]byte, maxDatagramSize+256), // the reply and its headers
+		oob:  make([]byte, timestampOOBSize),
+	}
+	r.readFn = r.read
+	return r, nil
+}
+
+// drainTxTimestamps reads pending transmit timestamps from the socket error
+// queue of l without blocking and records them as the send time of the
+// matching interleaved-mode replies.
+func (s *Server) drainTxTimestamps(l *listener) {
+	if r := l.tx; r != nil {
+		r.mu.Lock()
+		_ = r.rc.Control(r.readFn)
+		r.mu.Unlock()
+	}
+}
+
+// storeTx records a kernel transmit timestamp as the send time of the
+// interleaved-mode reply looped back in data.
+func (s *Server) storeTx(data []byte, at time.Time, source string) {
+	if e, ok := s.txPending.match(data); ok {
+		s.il.updateTx(e.ip, e.rx, timeToTimestamp(at), source)
+	}
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package ntpserver
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_TIMESTAMPING flags from linux/net_tstamp.h.
+const (
+	sofTimestampingTxHardware  = 1 << 0
+	sofTimestampingTxSoftware  = 1 << 1
+	sofTimestampingRxHardware  = 1 << 2
+	sofTimestampingRxSoftware  = 1 << 3
+	sofTimestampingSoftware    = 1 << 4
+	sofTimestampingRawHardware = 1 << 6
+)
+
+// timestampOOBSize fits the SCM_TIMESTAMPING control message and the
+// extended error that accompanies transmit timestamps.
+const timestampOOBSize = 256
+
+// enableKernelTimestamps turns on software and hardware receive timestamps
+// for conn and, with tx set, transmit timestamps on the error queue.
+// Hardware timestamps are only produced by NICs with timestamping enabled.
+func enableKernelTimestamps(conn *net.UDPConn, tx bool) error {
+	flags := sofTimestampingRxSoftware | sofTimestampingRxHardware |
+		sofTimestampingSoftware | sofTimestampingRawHardware
+	if tx {
+		flags |= sofTimestampingTxSoftware | sofTimestampingTxHardware
+	}
+	return setTimestamping(conn, flags)
+}
+
+// enableRxTimestamps turns on software receive timestamps only, so that
+// requests read together by a batched read keep their own arrival times.
+func enableRxTimestamps(conn *net.UDPConn) error {
+	return setTimestamping(conn, sofTimestampingRxSoftware|sofTimestampingSoftware)
+}
+
+func setTimestamping(conn *net.UDPConn, flags int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// parseKernelTimestamp extracts the SCM_TIMESTAMPING timestamp from control
+// messages, preferring the hardware timestamp when the NIC supplied one.
+// Raw hardware timestamps are taken as UTC, which assumes the NIC clock is
+// disciplined to the system clock (for example by phc2sys).
+func parseKernelTimestamp(oob []byte) (time.Time, string, bool) {
+	// One message at a time, as parsing them all at once allocates.
+	for len(oob) > 0 {
+		h, data, rest, err := unix.ParseOneSocketControlMessage(oob)
+		if err != nil {
+			break
+		}
+		oob = rest
+		if h.Level != syscall.SOL_SOCKET || h.Type != syscall.SO_TIMESTAMPING {
+			continue
+		}
+		var ts [3]syscall.Timespec
+		if len(data) < int(unsafe.Sizeof(ts)) {
+			continue
+		}
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&ts)), unsafe.Sizeof(ts)), data)
+		if hw := ts[2]; hw.Sec != 0 || hw.Nsec != 0 {
+			return time.Unix(hw.Unix()).UTC(), TimestampKernelHW, true
+		}
+		if sw := ts[0]; sw.Sec != 0 || sw.Nsec != 0 {
+			return time.Unix(sw.Unix()).UTC(), TimestampKernelSW, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// read drains the socket error queue without blocking and stores the
+// transmit timestamp of each looped-back reply.
+func (r *txReader) read(fd uintptr) {
+	for {
+		n, oobn, _, _, err := syscall.Recvmsg(int(fd), r.data, r.oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+		if err != nil {
+			return
+		}
+		if at, source, ok := parseKernelTimestamp(r.oob[:oobn]); ok {
+			r.s.storeTx(r.data[:n], at, source)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package ntpserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_KernelTimestampsLoopback(t *testing.T) {
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer probe.Close()
+	if err := enableKernelTimestamps(probe, true); err != nil {
+		t.Skipf("SO_TIMESTAMPING unavailable: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A clock far in the past shows which timestamps bypass it.
+	clock := fixedClock{t: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)}
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", Interleaved: true, KernelTimestamps: true, Clock: clock})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	c := dialServer(t, srv)
+	defer c.Close()
+	exchange := func(req Packet) (Packet, RequestEvent) {
+		t.Helper()
+		if _, err := c.Write(req.Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		resp, ok := readPacket(t, c, time.Second)
+		if !ok {
+			t.Fatalf("no response")
+		}
+		return resp, waitForEvent(t, events, ModeClient)
+	}
+
+	// The kernel enables receive timestamping asynchronously, so the first
+	// packets after the setsockopt may still be stamped in user space.
+	var (
+		first  Packet
+		ev     RequestEvent
+		before time.Time
+	)
+	for i := 0; i < 20; i++ {
+		before = time.Now()
+		first, ev = exchange(Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())})
+		if ev.TimestampSource != TimestampUser {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ev.TimestampSource != TimestampKernelSW && ev.TimestampSource != TimestampKernelHW {
+		t.Fatalf("rx source: got=%q want kernel", ev.TimestampSource)
+	}
+	if ev.TxTimestampSource != TimestampUser {
+		t.Fatalf("basic tx source: got=%q want=%q", ev.TxTimestampSource, TimestampUser)
+	}
+	if rx := timestampToTime(first.Receive); rx.Before(before.Add(-time.Second)) || rx.After(time.Now()) {
+		t.Fatalf("receive timestamp %v should come from the kernel, not the clock", rx)
+	}
+
+	req := Packet{VN: 4, Mode: ModeClient, Originate: first.Receive, Receive: timeToTimestamp(time.Now()), Transmit: timeToTimestamp(time.Now())}
+	second, ev := exchange(req)
+	if !ev.Interleaved {
+		t.Fatalf("second exchange should be interleaved")
+	}
+	if ev.TxTimestampSource != TimestampKernelSW && ev.TxTimestampSource != TimestampKernelHW {
+		t.Fatalf("interleaved tx source: got=%q want kernel", ev.TxTimestampSource)
+	}
+	if second.Transmit < first.Receive || second.Transmit > second.Receive {
+		t.Fatalf("kernel transmit %x not in [%x, %x]", second.Transmit, first.Receive, second.Receive)
+	}
+}
+
+// TestServer_KernelTimestampsNoAllocs is TestServer_ServeLoopNoAllocs for
+// interleaved replies with kernel receive and transmit timestamps.
+func TestServer_KernelTimestampsNoAllocs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("loopback exchange")
+	}
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer probe.Close()
+	if err := enableKernelTimestamps(probe, true); err != nil {
+		t.Skipf("SO_TIMESTAMPING unavailable: %v", err)
+	}
+	if allocs := loopbackAllocs(t, Config{Interleaved: true, KernelTimestamps: true}, 1); allocs != 0 {
+		t.Fatalf("allocs per exchange: got=%v want=0", allocs)
+	}
+}
+
+func TestServer_BatchKeepsPerRequestRxTimestamps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Without KernelTimestamps, batched requests are still stamped by the
+	// kernel one by one rather than by the clock once per batch.
+	clock := fixedClock{t: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)}
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", BatchSize: 8, Clock: clock})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+	events, unsubscribe := srv.Subscribe()
+	defer unsubscribe()
+
+	c := dialServer(t, srv)
+	defer c.Close()
+	const burst = 4
+	// As in TestServer_KernelTimestampsLoopback, the first packets may be
+	// read before the kernel stamps them.
+	for try := 0; ; try++ {
+		before := time.Now()
+		for i := 0; i < burst; i++ {
+			if _, err := c.Write((&Packet{VN: 4, Mode: ModeClient, Transmit: Timestamp(i + 1)}).Marshal()); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		kernel := 0
+		for i := 0; i < burst; i++ {
+			resp, ok := readPacket(t, c, time.Second)
+			if !ok {
+				t.Fatalf("no response")
+			}
+			ev := waitForEvent(t, events, ModeClient)
+			if ev.TimestampSource != TimestampKernelSW {
+				continue
+			}
+			kernel++
+			if rx := timestampToTime(resp.Receive); rx.Before(before) || rx.After(time.Now()) {
+				t.Fatalf("receive timestamp %v should come from the kernel, not the clock", rx)
+			}
+		}
+		if kernel == burst {
+			return
+		}
+		if try == 20 {
+			t.Fatalf("batched requests not stamped by the kernel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
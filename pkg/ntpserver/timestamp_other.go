@@ -0,0 +1,24 @@
+//go:build !linux
+
+package ntpserver
+
+import (
+	"net"
+	"time"
+)
+
+const timestampOOBSize = 0
+
+func enableKernelTimestamps(conn *net.UDPConn, tx bool) error {
+	return ErrKernelTimestampsUnsupported
+}
+
+func enableRxTimestamps(conn *net.UDPConn) error {
+	return ErrKernelTimestampsUnsupported
+}
+
+func parseKernelTimestamp(oob []byte) (time.Time, string, bool) {
+	return time.Time{}, "", false
+}
+
+func (r *txReader) read(fd uintptr) {}
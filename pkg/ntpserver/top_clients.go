@@ -0,0 +1,268 @@
+package ntpserver
+
+import (
+	"math"
+	"math/bits"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// spaceSaving is the Space-Saving heavy-hitter summary (Metwally, Agrawal
+// and El Abbadi, 2005) over at most cap clients. A new client that finds the
+// summary full replaces the one with the lowest count and inherits that
+// count as its error. With cap = 1/ε, every client that sent more than ε of
+// the requests is tracked, and no count is more than ε of the requests too
+// high.
+type spaceSaving struct {
+	heap  []clientStats // min-heap on count
+	index map[netip.Addr]int
+	cap   int
+}
+
+// newSpaceSaving returns an empty summary. It grows as clients arrive, as
+// every worker has its own summaries and most never fill up.
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{index: make(map[netip.Addr]int), cap: capacity}
+}
+
+func (ss *spaceSaving) observe(ip netip.Addr, port int, mv uint8, at time.Time) {
+	i, ok := ss.index[ip]
+	switch {
+	case ok:
+		c := &ss.heap[i]
+		c.count++
+		c.last, c.port, c.mv = at, port, mv
+	case len(ss.heap) < ss.cap:
+		i = len(ss.heap)
+		ss.heap = append(ss.heap, clientStats{ip: ip, count: 1, first: at, last: at, port: port, mv: mv})
+		ss.index[ip] = i
+		ss.up(i)
+		return
+	default:
+		i = 0
+		low := ss.heap[0].count
+		delete(ss.index, ss.heap[0].ip)
+		ss.heap[0] = clientStats{ip: ip, count: low + 1, err: low, first: at, last: at, port: port, mv: mv}
+		ss.index[ip] = 0
+	}
+	ss.down(i)
+}
+
+func (ss *spaceSaving) up(i int) {
+	for i > 0 {
+		p := (i - 1) / 2
+		if ss.heap[p].count <= ss.heap[i].count {
+			return
+		}
+		ss.swap(i, p)
+		i = p
+	}
+}
+
+func (ss *spaceSaving) down(i int) {
+	for {
+		c := 2*i + 1
+		if c >= len(ss.heap) {
+			return
+		}
+		if c+1 < len(ss.heap) && ss.heap[c+1].count < ss.heap[c].count {
+			c++
+		}
+		if ss.heap[i].count <= ss.heap[c].count {
+			return
+		}
+		ss.swap(i, c)
+		i = c
+	}
+}
+
+func (ss *spaceSaving) swap(i, j int) {
+	ss.heap[i], ss.heap[j] = ss.heap[j], ss.heap[i]
+	ss.index[ss.heap[i].ip] = i
+	ss.index[ss.heap[j].ip] = j
+}
+
+func (ss *spaceSaving) reset() {
+	ss.heap = ss.heap[:0]
+	clear(ss.index)
+}
+
+func (ss *spaceSaving) clone() *spaceSaving {
+	c := &spaceSaving{heap: append([]clientStats(nil), ss.heap...), index: make(map[netip.Addr]int, len(ss.index)), cap: ss.cap}
+	for ip, i := range ss.index {
+		c.index[ip] = i
+	}
+	return c
+}
+
+// mergeSummaries merges summaries of disjoint parts of the requests, such as
+// those of several workers, into one list of clients. A client missing from
+// a full summary may have sent up to its lowest count there, which is added
+// to the client's count and error, so the Space-Saving bounds still hold for
+// the merged counts.
+func mergeSummaries(sums []*spaceSaving) []clientStats {
+	merged := make(map[netip.Addr]clientStats)
+	for _, ss := range sums {
+		for _, c := range ss.heap {
+			m, ok := merged[c.ip]
+			if !ok {
+				merged[c.ip] = c
+				continue
+			}
+			m.count += c.count
+			m.err += c.err
+			if c.first.Before(m.first) {
+				m.first = c.first
+			}
+			if c.last.After(m.last) {
+				m.last, m.port, m.mv = c.last, c.port, c.mv
+			}
+			merged[c.ip] = m
+		}
+	}
+	if len(sums) > 1 {
+		for _, ss := range sums {
+			if len(ss.heap) < ss.cap {
+				continue
+			}
+			low := ss.heap[0].count
+			for ip, m := range merged {
+				if _, ok := ss.index[ip]; !ok {
+					m.count += low
+					m.err += low
+					merged[ip] = m
+				}
+			}
+		}
+	}
+	out := make([]clientStats, 0, len(merged))
+	for _, c := range merged {
+		out = append(out, c)
+	}
+	return out
+}
+
+// windowedTop keeps one spaceSaving per slot of a sliding window; slots are
+// reused as the window moves on.
+type windowedTop struct {
+	slot  time.Duration
+	epoch []int64 // slot number each entry of slots currently holds
+	slots []*spaceSaving
+}
+
+// windowSlots is how many slots a window is split into. As the newest slot
+// fills, the window reported grows from 9/10 of the window to all of it.
+const windowSlots = 10
+
+func newWindowedTop(window time.Duration, capacity int) *windowedTop {
+	w := &windowedTop{slot: max(window/windowSlots, 1), epoch: make([]int64, windowSlots), slots: make([]*spaceSaving, windowSlots)}
+	for i := range w.slots {
+		w.slots[i] = newSpaceSaving(capacity)
+		w.epoch[i] = math.MinInt64
+	}
+	return w
+}
+
+func (w *windowedTop) observe(ip netip.Addr, at time.Time) {
+	n := at.UnixNano() / int64(w.slot)
+	i := int(uint64(n) % windowSlots)
+	if w.epoch[i] != n {
+		w.slots[i].reset()
+		w.epoch[i] = n
+	}
+	w.slots[i].observe(ip, 0, 0, at)
+}
+
+// live returns copies of the slots of the window ending at now.
+func (w *windowedTop) live(now time.Time) []*spaceSaving {
+	n := now.UnixNano() / int64(w.slot)
+	var out []*spaceSaving
+	for i, ss := range w.slots {
+		if e := w.epoch[i]; e <= n-windowSlots || e > n || len(ss.heap) == 0 {
+			continue
+		}
+		out = append(out, ss.clone())
+	}
+	return out
+}
+
+func (w *windowedTop) reset() {
+	for i := range w.slots {
+		w.slots[i].reset()
+		w.epoch[i] = math.MinInt64
+	}
+}
+
+// topClients sorts cs busiest first and returns the first k.
+func topClients(cs []clientStats, k int) []ClientCount {
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].count == cs[j].count {
+			return cs[i].ip.Less(cs[j].ip)
+		}
+		return cs[i].count > cs[j].count
+	})
+	if len(cs) > k {
+		cs = cs[:k]
+	}
+	out := make([]ClientCount, len(cs))
+	for i, c := range cs {
+		out[i] = ClientCount{ClientIP: c.ip.String(), Count: c.count, Error: c.err}
+	}
+	return out
+}
+
+// hyperLogLog estimates the number of distinct clients in 4 KiB, with a
+// standard error of about 1.6%.
+type hyperLogLog struct {
+	reg [1 << hllBits]uint8
+}
+
+const hllBits = 12
+
+func (h *hyperLogLog) add(ip netip.Addr) {
+	a := ip.As16()
+	var hi, lo uint64
+	for i := 0; i < 8; i++ {
+		hi = hi<<8 | uint64(a[i])
+		lo = lo<<8 | uint64(a[8+i])
+	}
+	x := mix64(hi ^ mix64(lo))
+	r := uint8(bits.LeadingZeros64(x<<hllBits|1<<(hllBits-1))) + 1
+	if i := x >> (64 - hllBits); r > h.reg[i] {
+		h.reg[i] = r
+	}
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// merge makes h count the clients of o as well.
+func (h *hyperLogLog) merge(o *hyperLogLog) {
+	for i, r := range o.reg {
+		h.reg[i] = max(h.reg[i], r)
+	}
+}
+
+func (h *hyperLogLog) estimate() int {
+	const m = float64(len(h.reg))
+	sum, zeros := 0.0, 0
+	for _, r := range h.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small sets.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(e))
+}
@@ -0,0 +1,165 @@
+package ntpserver
+
+import (
+	"math"
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSpaceSaving_Guarantees(t *testing.T) {
+	const capacity, n = 50, 20000
+	ss := newSpaceSaving(capacity)
+	rng := rand.New(rand.NewSource(1))
+	at := time.Unix(1, 0)
+	truth := make(map[netip.Addr]uint64)
+	heavy := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	for i := 0; i < n; i++ {
+		ip := netip.AddrFrom4([4]byte{10, byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))})
+		if i%10 < 2 {
+			ip = heavy[i%2]
+		}
+		truth[ip]++
+		ss.observe(ip, 123, 0x23, at)
+	}
+	if len(ss.heap) != capacity || len(ss.index) != capacity {
+		t.Fatalf("size: heap=%d index=%d want=%d", len(ss.heap), len(ss.index), capacity)
+	}
+	bound := uint64(n / capacity)
+	for i, c := range ss.heap {
+		if ss.index[c.ip] != i {
+			t.Fatalf("index of %s: got=%d want=%d", c.ip, ss.index[c.ip], i)
+		}
+		if i > 0 && ss.heap[(i-1)/2].count > c.count {
+			t.Fatalf("heap order broken at %d", i)
+		}
+		if c.count < truth[c.ip] || c.count-c.err > truth[c.ip] || c.err > bound {
+			t.Fatalf("%s: count=%d err=%d true=%d", c.ip, c.count, c.err, truth[c.ip])
+		}
+	}
+	top := topClients(append([]clientStats(nil), ss.heap...), 2)
+	if len(top) != 2 || top[0].ClientIP != "192.0.2.1" || top[1].ClientIP != "2001:db8::1" {
+		t.Fatalf("top: got=%+v", top)
+	}
+}
+
+func TestWindowedTop(t *testing.T) {
+	w := newWindowedTop(10*time.Minute, 10)
+	t0 := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	old, cur := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	for i := 0; i < 5; i++ {
+		w.observe(old, t0)
+	}
+	w.observe(cur, t0.Add(8*time.Minute))
+	w.observe(cur, t0.Add(9*time.Minute))
+	busiest := func(now time.Time) []ClientCount { return topClients(mergeSummaries(w.live(now)), 10) }
+
+	if top := busiest(t0.Add(9 * time.Minute)); len(top) != 2 || top[0].ClientIP != "192.0.2.1" || top[0].Count != 5 || top[1].Count != 2 {
+		t.Fatalf("within window: got=%+v", top)
+	}
+	if top := busiest(t0.Add(11 * time.Minute)); len(top) != 1 || top[0].ClientIP != "192.0.2.2" {
+		t.Fatalf("after window: got=%+v", top)
+	}
+	// A slot is reused once the window has moved past it.
+	w.observe(cur, t0.Add(20*time.Minute))
+	if top := busiest(t0.Add(20 * time.Minute)); len(top) != 1 || top[0].Count != 1 {
+		t.Fatalf("reused slot: got=%+v", top)
+	}
+}
+
+func TestHyperLogLog_Estimate(t *testing.T) {
+	var h hyperLogLog
+	if got := h.estimate(); got != 0 {
+		t.Fatalf("empty: got=%d", got)
+	}
+	for _, n := range []int{100, 10000, 200000} {
+		h = hyperLogLog{}
+		for i := 0; i < n; i++ {
+			ip := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+			h.add(ip)
+			h.add(ip)
+		}
+		if got := h.estimate(); math.Abs(float64(got-n)) > 0.05*float64(n) {
+			t.Fatalf("estimate of %d: got=%d", n, got)
+		}
+	}
+}
+
+func TestMetrics_TopClientsBounded(t *testing.T) {
+	m := newMetrics(Config{TopClients: 3, TopClientsError: 0.01, TopClientsWindow: time.Minute}.normalize())
+	at := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 50000; i++ {
+		m.incRequest(nil, netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), 123, 0x23, at)
+		m.incRequest(nil, netip.MustParseAddr("192.0.2.1"), 123, 0x23, at)
+	}
+	if len(m.shared.top.heap) != 100 || len(m.clients()) != 100 {
+		t.Fatalf("tracked: got=%d want=100", len(m.shared.top.heap))
+	}
+	var s MetricsSnapshot
+	m.clientTotals(&s)
+	m.topClients(&s, at)
+	if len(s.TopClients) != 3 || s.TopClients[0].ClientIP != "192.0.2.1" || s.TopClients[0].Count < 50000 {
+		t.Fatalf("TopClients: got=%+v", s.TopClients)
+	}
+	if len(s.RecentTopClients) != 3 || s.RecentTopClients[0].ClientIP != "192.0.2.1" {
+		t.Fatalf("RecentTopClients: got=%+v", s.RecentTopClients)
+	}
+	if s.UniqueClients < 48000 || s.UniqueClients > 53000 {
+		t.Fatalf("UniqueClients: got=%d", s.UniqueClients)
+	}
+	var later MetricsSnapshot
+	m.topClients(&later, at.Add(2*time.Minute))
+	if len(later.RecentTopClients) != 0 || len(later.TopClients) != 3 {
+		t.Fatalf("after the window: recent=%+v top=%d", later.RecentTopClients, len(later.TopClients))
+	}
+}
+
+func TestMetrics_ClientShardsMerged(t *testing.T) {
+	m := newMetrics(Config{TopClients: 2, TopClientsError: 0.5, TopClientsWindow: time.Minute}.normalize())
+	a, b := m.addClientShard(), m.addClientShard()
+	t0 := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	heavy, other := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	for i := 0; i < 5; i++ {
+		m.incRequest(a, heavy, 123, 0x23, t0)
+	}
+	m.incRequest(b, other, 123, 0x23, t0)
+	m.incRequest(b, other, 123, 0x23, t0)
+	m.incRequest(b, heavy, 4123, 0x1b, t0.Add(time.Second))
+	// Shard a is full (capacity 2); other was not seen there.
+	m.incRequest(a, netip.MustParseAddr("192.0.2.3"), 123, 0x23, t0)
+
+	var s MetricsSnapshot
+	m.clientTotals(&s)
+	m.topClients(&s, t0.Add(time.Second))
+	if len(s.TopClients) != 2 || s.TopClients[0] != (ClientCount{ClientIP: "192.0.2.1", Count: 6}) {
+		t.Fatalf("TopClients: got=%+v", s.TopClients)
+	}
+	// other may have sent up to shard a's lowest count, 1, there.
+	if s.TopClients[1] != (ClientCount{ClientIP: "192.0.2.2", Count: 3, Error: 1}) {
+		t.Fatalf("TopClients[1]: got=%+v", s.TopClients[1])
+	}
+	if len(s.RecentTopClients) != 2 || s.RecentTopClients[0].Count != 6 {
+		t.Fatalf("RecentTopClients: got=%+v", s.RecentTopClients)
+	}
+	if s.UniqueClients != 3 || s.LastRequestIP != "192.0.2.1" || !s.LastRequestAt.Equal(t0.Add(time.Second)) {
+		t.Fatalf("unique=%d last=%s at %v", s.UniqueClients, s.LastRequestIP, s.LastRequestAt)
+	}
+	var c clientStats
+	for _, cs := range m.clients() {
+		if cs.ip == heavy {
+			c = cs
+		}
+	}
+	if c.count != 6 || !c.first.Equal(t0) || !c.last.Equal(t0.Add(time.Second)) || c.port != 4123 || c.mv != 0x1b {
+		t.Fatalf("merged client: got=%+v", c)
+	}
+
+	m.reset(t0)
+	var empty MetricsSnapshot
+	m.clientTotals(&empty)
+	m.topClients(&empty, t0)
+	if len(empty.TopClients) != 0 || empty.UniqueClients != 0 {
+		t.Fatalf("after reset: got=%+v", empty)
+	}
+}
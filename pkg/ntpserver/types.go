@@ -1,6 +1,9 @@
 package ntpserver
 
-import "time"
+import (
+	"net/netip"
+	"time"
+)
 
 // Clock abstracts a time source for the server.
 // This keeps testing easy and allows future replacement with a more accurate clock.
@@ -19,33 +22,133 @@ type RequestEvent struct {
 	ClientAddr     string    `json:"client_addr"`
 	ClientIP       string    `json:"client_ip"`
 	ClientPort     int       `json:"client_port"`
+	LocalAddr      string    `json:"local_addr,omitempty"`
+	Interface      string    `json:"interface,omitempty"`
 	Version        uint8     `json:"version"`
 	Mode           uint8     `json:"mode"`
 	PacketValid    bool      `json:"packet_valid"`
 	Responded      bool      `json:"responded"`
+	Auth           string    `json:"auth,omitempty"`
+	KeyID          uint32    `json:"key_id,omitempty"`
+	Kiss           string    `json:"kiss,omitempty"`
+	Interleaved    bool      `json:"interleaved,omitempty"`
 	Error          string    `json:"error,omitempty"`
 	ProcessingUSec int64     `json:"processing_usec"`
+
+	// TimestampSource and TxTimestampSource say where the reply's receive
+	// and transmit timestamps came from: TimestampUser, TimestampKernelSW or
+	// TimestampKernelHW.
+	TimestampSource   string `json:"timestamp_source,omitempty"`
+	TxTimestampSource string `json:"tx_timestamp_source,omitempty"`
+
+	// Kind is empty for requests and EventReload for a configuration reload,
+	// which only sets At.
+	Kind string `json:"kind,omitempty"`
+
+	// client backs ClientAddr and ClientIP, which fillClient builds only
+	// when the event is delivered.
+	client netip.AddrPort
+}
+
+// countsAsResponse reports whether ev is counted as a response. Replies that
+// refuse a request, Kiss-o'-Death, crypto-NAK and NTS NAK alike, count as
+// errors only.
+func (ev *RequestEvent) countsAsResponse() bool {
+	return ev.Responded && ev.Error == ""
+}
+
+func (ev *RequestEvent) fillClient() {
+	if ev.ClientIP != "" || !ev.client.IsValid() {
+		return
+	}
+	ev.ClientIP = ev.client.Addr().WithZone("").String()
+	ev.ClientAddr = ev.client.String()
+}
+
+// WorkerMetrics counts the requests handled by one serving goroutine.
+type WorkerMetrics struct {
+	ID        int    `json:"id"`
+	LocalAddr string `json:"local_addr"`
+	Interface string `json:"interface,omitempty"`
+	Requests  uint64 `json:"requests"`
+	Responses uint64 `json:"responses"`
+	Errors    uint64 `json:"errors"`
 }
 
+// ClientCount is a client's request count. Clients are counted in bounded
+// memory, so Count may be up to Error too high.
 type ClientCount struct {
 	ClientIP string `json:"client_ip"`
 	Count    uint64 `json:"count"`
+	Error    uint64 `json:"error,omitempty"`
 }
 
+// MetricsSnapshot is a copy of the server's counters. TotalResponses counts
+// answered requests; refusals (Kiss-o'-Death, crypto-NAK and NTS NAK) count
+// in TotalErrors instead, and kisses also in KoDSent.
 type MetricsSnapshot struct {
-	StartedAt      time.Time     `json:"started_at"`
-	TotalRequests  uint64        `json:"total_requests"`
-	TotalResponses uint64        `json:"total_responses"`
-	TotalErrors    uint64        `json:"total_errors"`
-	LastRequestAt  time.Time     `json:"last_request_at"`
-	LastRequestIP  string        `json:"last_request_ip"`
-	UniqueClients  int           `json:"unique_clients"`
-	TopClients     []ClientCount `json:"top_clients"`
+	StartedAt       time.Time     `json:"started_at"`
+	TotalRequests   uint64        `json:"total_requests"`
+	TotalResponses  uint64        `json:"total_responses"`
+	TotalErrors     uint64        `json:"total_errors"`
+	KoDSent         uint64        `json:"kod_sent"`
+	KoDSuppressed   uint64        `json:"kod_suppressed"`
+	BroadcastsSent  uint64        `json:"broadcasts_sent"`
+	BroadcastErrors uint64        `json:"broadcast_errors"`
+	LastRequestAt   time.Time     `json:"last_request_at"`
+	LastRequestIP   string        `json:"last_request_ip"`
+	TopClients      []ClientCount `json:"top_clients"`
+	Keys            []KeyStats    `json:"keys,omitempty"`
+	NTS             *NTSMetrics   `json:"nts,omitempty"`
+
+	// UniqueClients is a HyperLogLog estimate of the distinct client
+	// addresses seen since Start, typically within 2% of the exact count.
+	UniqueClients int `json:"unique_clients"`
+
+	// Workers has one entry per serving goroutine of the current or last run.
+	Workers []WorkerMetrics `json:"workers,omitempty"`
+
+	// RateLimit and RateLimitPrefixes describe the tables of the per-address
+	// and per-prefix rate limits when those are enabled.
+	RateLimit         *RateLimitMetrics `json:"rate_limit,omitempty"`
+	RateLimitPrefixes *RateLimitMetrics `json:"rate_limit_prefixes,omitempty"`
+
+	// Reloads counts Server.Reconfigure calls since New.
+	Reloads      uint64    `json:"reloads"`
+	LastReloadAt time.Time `json:"last_reload_at"`
+
+	// ErrorsByReason splits TotalErrors by RequestEvent.Error. Socket errors
+	// count as "write_failed"; hook drop reasons beyond the first 64 distinct
+	// ones count as "other".
+	ErrorsByReason map[string]uint64 `json:"errors_by_reason,omitempty"`
+
+	// RequestsByVersion and RequestsByMode split TotalRequests by the NTP
+	// version and mode in the first byte of each packet, whether or not it
+	// was valid; empty packets count as version 0, mode 0.
+	RequestsByVersion map[uint8]uint64 `json:"requests_by_version,omitempty"`
+	RequestsByMode    map[uint8]uint64 `json:"requests_by_mode,omitempty"`
+
+	// EventsDropped counts events not delivered to a subscriber whose
+	// channel was full, since New.
+	EventsDropped uint64 `json:"events_dropped"`
+
+	// RecentTopClients are the busiest clients of the last
+	// Config.TopClientsWindow; TopClients covers the time since Start.
+	RecentTopClients []ClientCount `json:"recent_top_clients,omitempty"`
+
+	// Processing is the time spent on each request after it was read,
+	// including the write of its reply except in batches, which are sent
+	// together afterwards. RxToTx is the time from the receive timestamp of an
+	// answered request (kernel or Clock) to the reply being written. See
+	// Config.LatencyResetOnRead.
+	Processing LatencyMetrics `json:"processing"`
+	RxToTx     LatencyMetrics `json:"rx_to_tx"`
 }
 
 // PacketHook can observe requests and influence future policy decisions.
 // For now it is called after parsing and before responding.
-// If it returns non-empty error text, the request is dropped.
+// If it returns non-empty error text, the request is dropped; returning one of
+// the DropKoD* reasons (or KissDrop) also sends a Kiss-o'-Death when Config.KoD is set.
 type PacketHook func(req Packet, meta RequestMeta) (dropReason string)
 
 type RequestMeta struct {
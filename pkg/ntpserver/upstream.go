@@ -0,0 +1,512 @@
+package ntpserver
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcuoli/go-ntpserver/pkg/clockselect"
+)
+
+const (
+	// phi is the frequency tolerance (15 PPM) used to age dispersion, RFC 5905.
+	phi = clockselect.PHI
+	// stratumUnsync is the stratum reported while no upstream is usable.
+	stratumUnsync = 16
+	// leapAlarm marks the clock as unsynchronized.
+	leapAlarm = 3
+	// burstCount is how many packets are sent per poll while an upstream is
+	// unreachable, like ntpd's iburst, so the clock filter fills quickly.
+	burstCount = clockselect.FilterStages
+	// burstSpacing is the gap between burst packets.
+	burstSpacing = 2 * time.Second
+	// stepThreshold is the largest combined offset served through (RFC 5905
+	// STEPT). Beyond it the local clock needs stepping, and the server reports
+	// itself unsynchronized rather than serve time it knows to be wrong.
+	stepThreshold = 128 * time.Millisecond
+)
+
+var (
+	errUpstreamBogus  = errors.New("ntpserver: upstream response does not match request")
+	errUpstreamUnsync = errors.New("ntpserver: upstream is not synchronized")
+	errUpstreamKoD    = errors.New("ntpserver: upstream sent kiss-o'-death")
+)
+
+// UpstreamStatus describes one configured upstream server.
+type UpstreamStatus struct {
+	Address        string        `json:"address"`
+	Resolved       string        `json:"resolved"`
+	Reach          uint8         `json:"reach"`
+	Stratum        uint8         `json:"stratum"`
+	RefID          uint32        `json:"refid"`
+	LeapIndicator  uint8         `json:"leap"`
+	Offset         time.Duration `json:"offset"`
+	Delay          time.Duration `json:"delay"`
+	Dispersion     time.Duration `json:"dispersion"`
+	Jitter         time.Duration `json:"jitter"`
+	RootDelay      time.Duration `json:"root_delay"`
+	RootDispersion time.Duration `json:"root_dispersion"`
+	LastSample     time.Time     `json:"last_sample"`
+	LastError      string        `json:"last_error,omitempty"`
+	Survivor       bool          `json:"survivor"`
+	Falseticker    bool          `json:"falseticker"`
+	Selected       bool          `json:"selected"`
+}
+
+// Reachable reports whether any of the last eight polls got a valid answer.
+func (u UpstreamStatus) Reachable() bool {
+	return u.Reach != 0
+}
+
+func (u UpstreamStatus) candidate() clockselect.Peer {
+	return clockselect.Peer{
+		ID:             u.Address,
+		Stratum:        u.Stratum,
+		RootDelay:      u.RootDelay,
+		RootDispersion: u.RootDispersion,
+		Offset:         u.Offset,
+		Delay:          u.Delay,
+		Dispersion:     u.Dispersion,
+		Jitter:         u.Jitter,
+	}
+}
+
+// upstreamSample is the result of a single client/server exchange.
+type upstreamSample struct {
+	resolved string
+	resp     Packet
+	offset   time.Duration
+	delay    time.Duration
+	disp     time.Duration
+	at       time.Time
+}
+
+// systemState is what the server advertises about its own synchronization.
+type systemState struct {
+	synced         bool
+	leap           uint8
+	stratum        uint8
+	refID          uint32
+	rootDelay      time.Duration
+	rootDispersion time.Duration
+	offset         time.Duration
+	jitter         time.Duration
+	updated        time.Time
+}
+
+type upstreamSet struct {
+	clock     Clock
+	precision int8
+	interval  time.Duration
+	timeout   time.Duration
+	network   string
+
+	mu      sync.RWMutex
+	peers   []UpstreamStatus
+	filters []clockselect.Filter
+	assocs  []*association
+	passive []netip.Prefix
+	sys     systemState
+
+	// local holds the RefIDs a source synchronized to this server reports:
+	// those of the addresses it listens on.
+	local map[uint32]struct{}
+
+	nextAssocID uint16
+
+	// mitigate is set when upstreams or configured peers drive the system
+	// state; passive associations alone leave the static configuration in use.
+	mitigate bool
+}
+
+func newUpstreamSet(cfg Config) *upstreamSet {
+	u := &upstreamSet{
+		clock:     cfg.Clock,
+		precision: cfg.Precision,
+		interval:  cfg.UpstreamPollInterval,
+		timeout:   cfg.UpstreamTimeout,
+		network:   cfg.Network,
+		peers:     make([]UpstreamStatus, len(cfg.Upstreams)),
+		filters:   make([]clockselect.Filter, len(cfg.Upstreams)),
+		passive:   cfg.PassivePeers,
+		mitigate:  len(cfg.Upstreams) > 0 || len(cfg.Peers) > 0,
+	}
+	for i, addr := range cfg.Upstreams {
+		u.peers[i].Address = addr
+		u.filters[i].Precision = precisionToDuration(cfg.Precision)
+	}
+	u.nextAssocID = uint16(len(cfg.Upstreams) + 1)
+	for _, addr := range cfg.Peers {
+		a := &association{id: u.nextAssocID}
+		u.nextAssocID++
+		a.status.Address = addr
+		a.status.HostMode = ModeSymmetricActive
+		a.filter.Precision = precisionToDuration(cfg.Precision)
+		u.assocs = append(u.assocs, a)
+	}
+	return u
+}
+
+// run polls every upstream immediately and then every interval until stop
+// closes. Unreachable upstreams are polled with a burst of packets.
+func (u *upstreamSet) run(stop <-chan struct{}, wg *sync.WaitGroup) {
+	spacing := burstSpacing
+	if s := u.interval / burstCount; s < spacing {
+		spacing = s
+	}
+	for i := range u.peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t := time.NewTicker(u.interval)
+			defer t.Stop()
+			for {
+				n := 1
+				if !u.reachable(i) {
+					n = burstCount
+				}
+				for k := 0; k < n; k++ {
+					if k > 0 {
+						select {
+						case <-stop:
+							return
+						case <-time.After(spacing):
+						}
+					}
+					u.poll(i, stop)
+				}
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+				}
+			}
+		}(i)
+	}
+}
+
+func (u *upstreamSet) reachable(i int) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.peers[i].Reachable()
+}
+
+func (u *upstreamSet) poll(i int, stop <-chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	u.mu.RLock()
+	addr := u.peers[i].Address
+	u.mu.RUnlock()
+
+	sample, err := queryUpstream(ctx, u.network, addr, u.clock, u.precision)
+
+	u.mu.Lock()
+	p := &u.peers[i]
+	p.Reach <<= 1
+	if err != nil {
+		p.LastError = err.Error()
+		if p.Reach == 0 {
+			u.filters[i].Reset()
+		}
+	} else {
+		p.Reach |= 1
+		p.LastError = ""
+		p.Resolved = sample.resolved
+		p.Stratum = sample.resp.Stratum
+		p.RefID = sample.resp.RefID
+		p.LeapIndicator = sample.resp.LI
+		p.RootDelay = shortToDuration(sample.resp.RootDelay)
+		p.RootDispersion = shortToDuration(sample.resp.RootDispersion)
+		if res, ok := u.filters[i].Add(clockselect.Sample{
+			Offset:     sample.offset,
+			Delay:      sample.delay,
+			Dispersion: sample.disp,
+			At:         sample.at,
+		}); ok {
+			p.Offset = res.Offset
+			p.Delay = res.Delay
+			p.Dispersion = res.Dispersion
+			p.Jitter = res.Jitter
+			p.LastSample = res.At
+		}
+	}
+	u.updateSystemLocked()
+	u.mu.Unlock()
+}
+
+// updateSystemLocked runs the RFC 5905 selection, clustering and combine
+// algorithms over the reachable upstreams and symmetric peers and derives the
+// advertised system variables from the result.
+func (u *upstreamSet) updateSystemLocked() {
+	var cands []clockselect.Peer
+	byID := make(map[string]*UpstreamStatus, len(u.peers)+len(u.assocs))
+	add := func(id string, p *UpstreamStatus) {
+		p.Selected = false
+		p.Survivor = false
+		p.Falseticker = false
+		// A stratum 15 source would make us stratum 16, which is unsynchronized,
+		// so it cannot be used (RFC 5905, section 11.2.1).
+		if !p.Reachable() || p.LastSample.IsZero() || p.LeapIndicator == leapAlarm || p.Stratum >= stratumUnsync-1 || u.loopLocked(p) {
+			return
+		}
+		c := p.candidate()
+		c.ID = id
+		cands = append(cands, c)
+		byID[id] = p
+	}
+	// Addresses need not be unique, so candidates are keyed by position.
+	for i := range u.peers {
+		add("u"+strconv.Itoa(i), &u.peers[i])
+	}
+	for _, a := range u.assocs {
+		add("a"+strconv.Itoa(int(a.id)), &a.status.UpstreamStatus)
+	}
+
+	res, err := clockselect.Select(cands)
+	for _, f := range res.Falsetickers {
+		byID[f.ID].Falseticker = true
+	}
+	if err != nil {
+		u.sys = systemState{}
+		return
+	}
+	for _, sv := range res.Survivors {
+		byID[sv.ID].Survivor = true
+	}
+	p := byID[res.SystemPeer.ID]
+	p.Selected = true
+	if absDuration(res.Offset) > stepThreshold {
+		u.sys = systemState{refID: refIDFromASCII4("STEP"), offset: res.Offset, jitter: res.Jitter}
+		return
+	}
+	u.sys = systemState{
+		synced:    true,
+		leap:      p.LeapIndicator,
+		stratum:   p.Stratum + 1,
+		refID:     refIDForAddr(p.Resolved),
+		rootDelay: p.RootDelay + p.Delay,
+		// The served clock is not steered by the combined offset, so it is part
+		// of the error budget (RFC 5905, section 11.3).
+		rootDispersion: p.RootDispersion + p.Dispersion + res.Jitter + absDuration(res.Offset),
+		offset:         res.Offset,
+		jitter:         res.Jitter,
+		updated:        p.LastSample,
+	}
+}
+
+// loopLocked is the RFC 5905 fit() loop test: it reports whether p is
+// synchronized to this server, directly (its RefID is one of our addresses)
+// or through our system peer (its RefID is ours). A source below our stratum
+// cannot be downstream of us, so only sources at or above it are excluded;
+// while unsynchronized every such source is.
+func (u *upstreamSet) loopLocked(p *UpstreamStatus) bool {
+	if _, ok := u.local[p.RefID]; !ok && (!u.sys.synced || p.RefID != u.sys.refID) {
+		return false
+	}
+	return !u.sys.synced || p.Stratum >= u.sys.stratum
+}
+
+// setLocal records the RefIDs of the addresses the server listens on.
+func (u *upstreamSet) setLocal(refIDs map[uint32]struct{}) {
+	u.mu.Lock()
+	u.local = refIDs
+	u.mu.Unlock()
+}
+
+// system returns the advertised system state, with root dispersion aged since the last update.
+func (u *upstreamSet) system(now time.Time) systemState {
+	u.mu.RLock()
+	sys := u.sys
+	u.mu.RUnlock()
+	if sys.synced {
+		if age := now.Sub(sys.updated); age > 0 {
+			sys.rootDispersion += time.Duration(float64(age) * phi)
+		}
+	}
+	return sys
+}
+
+func (u *upstreamSet) status() []UpstreamStatus {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	out := make([]UpstreamStatus, len(u.peers))
+	copy(out, u.peers)
+	return out
+}
+
+// queryUpstream performs one client-mode exchange with addr.
+func queryUpstream(ctx context.Context, network, addr string, clock Clock, precision int8) (upstreamSample, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "123")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return upstreamSample{}, err
+	}
+	defer func() { _ = conn.Close() }()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.SetDeadline(time.Now())
+	}()
+
+	t1 := clock.Now()
+	req := Packet{VN: 4, Mode: ModeClient, Prec: precision, Transmit: timeToTimestamp(t1)}
+	if _, err := conn.Write(req.Marshal()); err != nil {
+		return upstreamSample{}, err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return upstreamSample{}, err
+		}
+		t4 := clock.Now()
+		resp, ok := ParsePacket(buf[:n])
+		if !ok || resp.Mode != ModeServer || resp.Originate != req.Transmit {
+			// Stray or spoofed packet; keep waiting for the real answer.
+			continue
+		}
+		if resp.Stratum == 0 {
+			return upstreamSample{}, errUpstreamKoD
+		}
+		if resp.LI == leapAlarm || resp.Stratum >= stratumUnsync || resp.Transmit == 0 {
+			return upstreamSample{}, errUpstreamUnsync
+		}
+		if resp.Receive == 0 {
+			return upstreamSample{}, errUpstreamBogus
+		}
+
+		t2 := timestampToTime(resp.Receive)
+		t3 := timestampToTime(resp.Transmit)
+		offset := (t2.Sub(t1) + t3.Sub(t4)) / 2
+		delay := t4.Sub(t1) - t3.Sub(t2)
+		if delay < 0 {
+			delay = 0
+		}
+		disp := precisionToDuration(precision) + precisionToDuration(resp.Prec) + time.Duration(float64(t4.Sub(t1))*phi)
+		return upstreamSample{
+			resolved: conn.RemoteAddr().String(),
+			resp:     resp,
+			offset:   offset,
+			delay:    delay,
+			disp:     disp,
+			at:       t4,
+		}, nil
+	}
+}
+
+// refIDForAddr returns the RefID for an upstream address: the IPv4 address
+// itself, or the first four bytes of the MD5 digest of an IPv6 address (RFC 5905).
+func refIDForAddr(hostport string) uint32 {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return 0
+	}
+	return refIDForIP(ip)
+}
+
+func refIDForIP(ip netip.Addr) uint32 {
+	ip = ip.Unmap()
+	if ip.Is4() {
+		v4 := ip.As4()
+		return binary.BigEndian.Uint32(v4[:])
+	}
+	v6 := ip.As16()
+	sum := md5.Sum(v6[:])
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// localRefIDs returns the RefIDs of the addresses ls listen on, taking every
+// interface address for a listener bound to the wildcard address.
+func localRefIDs(ls []*listener) map[uint32]struct{} {
+	out := make(map[uint32]struct{})
+	wildcard := false
+	for _, l := range ls {
+		ap := addrPortOf(l.conn.LocalAddr())
+		switch {
+		case !ap.IsValid():
+		case ap.Addr().IsUnspecified():
+			wildcard = true
+		default:
+			out[refIDForIP(ap.Addr())] = struct{}{}
+		}
+	}
+	if wildcard {
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				if ip, ok := netip.AddrFromSlice(n.IP); ok {
+					out[refIDForIP(ip)] = struct{}{}
+				}
+			}
+		}
+	}
+	return out
+}
+
+func timestampToTime(ts Timestamp) time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	frac := uint64(ts & 0xffffffff)
+	nanos := int64((frac * 1_000_000_000) >> 32)
+	return time.Unix(secs, nanos).UTC()
+}
+
+// shortToDuration converts an NTP short format (16.16 seconds) value.
+func shortToDuration(v uint32) time.Duration {
+	return time.Duration(uint64(v) * uint64(time.Second) >> 16)
+}
+
+// durationToShort converts to NTP short format, saturating at the maximum.
+func durationToShort(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	// Check the range first: the shift overflows from about 78 hours.
+	if d >= 1<<16*time.Second {
+		return math.MaxUint32
+	}
+	return uint32(uint64(d) << 16 / uint64(time.Second))
+}
+
+// pollExponent returns the log2 seconds poll exponent for an interval.
+func pollExponent(d time.Duration) int8 {
+	if secs := d.Seconds(); secs > 1 {
+		return int8(math.Round(math.Log2(secs)))
+	}
+	return 0
+}
+
+func precisionToDuration(p int8) time.Duration {
+	return time.Duration(math.Ldexp(float64(time.Second), int(p)))
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
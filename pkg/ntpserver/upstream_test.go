@@ -0,0 +1,275 @@
+package ntpserver
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestShortFormatConversions(t *testing.T) {
+	if got := durationToShort(1500 * time.Millisecond); got != 0x00018000 {
+		t.Fatalf("durationToShort: got=%08x want=%08x", got, 0x00018000)
+	}
+	if got := shortToDuration(0x00018000); got != 1500*time.Millisecond {
+		t.Fatalf("shortToDuration: got=%v", got)
+	}
+	if got := durationToShort(-time.Second); got != 0 {
+		t.Fatalf("negative duration: got=%d", got)
+	}
+	for _, tt := range []struct {
+		d    time.Duration
+		want uint32
+	}{
+		{0, 0},
+		{time.Hour, 3600 << 16},
+		{1<<16*time.Second - time.Nanosecond, 0xFFFFFFFF},
+		{1 << 16 * time.Second, 0xFFFFFFFF},
+		{78 * time.Hour, 0xFFFFFFFF},
+		{1 << 48, 0xFFFFFFFF}, // first duration that overflowed the shift
+		{3 * 24 * time.Hour, 0xFFFFFFFF},
+		{30 * 24 * time.Hour, 0xFFFFFFFF},
+		{math.MaxInt64, 0xFFFFFFFF},
+	} {
+		if got := durationToShort(tt.d); got != tt.want {
+			t.Fatalf("durationToShort(%v): got=%08x want=%08x", tt.d, got, tt.want)
+		}
+	}
+	at := time.Date(2025, 6, 7, 8, 9, 10, 500_000_000, time.UTC)
+	if got := timestampToTime(timeToTimestamp(at)); got.Sub(at).Abs() > time.Microsecond {
+		t.Fatalf("timestamp roundtrip: got=%v want=%v", got, at)
+	}
+}
+
+func TestRefIDForAddr(t *testing.T) {
+	if got := refIDForAddr("192.0.2.1:123"); got != 0xc0000201 {
+		t.Fatalf("ipv4 refid: got=%08x", got)
+	}
+	if got := refIDForAddr("[2001:db8::1]:123"); got == 0 {
+		t.Fatalf("ipv6 refid: expected hash, got 0")
+	}
+}
+
+func waitForUpstream(t *testing.T, srv *Server) UpstreamStatus {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		st := srv.Upstreams()
+		if len(st) > 0 && st[0].Selected {
+			return st[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("upstream never became selected: %+v", srv.Upstreams())
+	return UpstreamStatus{}
+}
+
+func TestServer_UpstreamSync_StratumPlusOne(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary := New(Config{
+		ListenAddr:     "127.0.0.1:0",
+		Network:        "udp4",
+		Stratum:        1,
+		RefID:          refIDFromASCII4("GPS"),
+		RootDispersion: durationToShort(time.Millisecond),
+	})
+	if err := primary.Start(ctx); err != nil {
+		t.Fatalf("start primary: %v", err)
+	}
+	defer func() { _ = primary.Stop() }()
+
+	secondary := New(Config{
+		ListenAddr:           "127.0.0.1:0",
+		Network:              "udp4",
+		Upstreams:            []string{primary.Addr()},
+		UpstreamPollInterval: 80 * time.Millisecond,
+	})
+	if err := secondary.Start(ctx); err != nil {
+		t.Fatalf("start secondary: %v", err)
+	}
+	defer func() { _ = secondary.Stop() }()
+
+	st := waitForUpstream(t, secondary)
+	if st.Stratum != 1 || !st.Survivor || st.Jitter <= 0 {
+		t.Fatalf("upstream status: %+v", st)
+	}
+
+	c := dialServer(t, secondary)
+	defer func() { _ = c.Close() }()
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}
+	if _, err := c.Write(req.Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	resp, ok := readPacket(t, c, 2*time.Second)
+	if !ok {
+		t.Fatalf("no response")
+	}
+	if resp.Stratum != 2 {
+		t.Fatalf("stratum: got=%d want=2", resp.Stratum)
+	}
+	if resp.RefID != 0x7f000001 {
+		t.Fatalf("refid: got=%08x want=%08x", resp.RefID, 0x7f000001)
+	}
+	if resp.LI != 0 {
+		t.Fatalf("leap: got=%d want=0", resp.LI)
+	}
+	if resp.RootDispersion < durationToShort(time.Millisecond) {
+		t.Fatalf("root dispersion should include the upstream's: got=%v", shortToDuration(resp.RootDispersion))
+	}
+}
+
+func TestServer_UpstreamUnreachable_Unsynchronized(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Grab a free port and release it, so nothing answers there.
+	dead := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4"})
+	if err := dead.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	deadAddr := dead.Addr()
+	_ = dead.Stop()
+
+	srv := New(Config{
+		ListenAddr:      "127.0.0.1:0",
+		Network:         "udp4",
+		Upstreams:       []string{deadAddr},
+		UpstreamTimeout: 100 * time.Millisecond,
+	})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	c := dialServer(t, srv)
+	defer func() { _ = c.Close() }()
+	req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}
+	if _, err := c.Write(req.Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	resp, ok := readPacket(t, c, 2*time.Second)
+	if !ok {
+		t.Fatalf("no response")
+	}
+	if resp.Stratum != 16 || resp.LI != 3 || resp.Reference != 0 {
+		t.Fatalf("expected unsynchronized reply, got stratum=%d li=%d ref=%d", resp.Stratum, resp.LI, resp.Reference)
+	}
+}
+
+// skewedClock runs skew ahead of the real clock.
+type skewedClock struct{ skew time.Duration }
+
+func (c skewedClock) Now() time.Time { return time.Now().Add(c.skew) }
+
+func TestServer_UpstreamSync_SkewedClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", Stratum: 1})
+	if err := primary.Start(ctx); err != nil {
+		t.Fatalf("start primary: %v", err)
+	}
+	defer func() { _ = primary.Stop() }()
+
+	for _, tc := range []struct {
+		skew    time.Duration
+		li      uint8
+		stratum uint8
+	}{
+		// Within the step threshold the offset is served as dispersion.
+		{skew: 50 * time.Millisecond, li: 0, stratum: 2},
+		// Beyond it the server stops claiming to be synchronized.
+		{skew: 2 * time.Second, li: leapAlarm, stratum: stratumUnsync},
+	} {
+		t.Run(tc.skew.String(), func(t *testing.T) {
+			srv := New(Config{
+				ListenAddr:           "127.0.0.1:0",
+				Network:              "udp4",
+				Clock:                skewedClock{skew: tc.skew},
+				Upstreams:            []string{primary.Addr()},
+				UpstreamPollInterval: 80 * time.Millisecond,
+			})
+			if err := srv.Start(ctx); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			defer func() { _ = srv.Stop() }()
+			if st := waitForUpstream(t, srv); absDuration(st.Offset+tc.skew) > 20*time.Millisecond {
+				t.Fatalf("upstream offset: got=%v want=%v", st.Offset, -tc.skew)
+			}
+
+			c := dialServer(t, srv)
+			defer func() { _ = c.Close() }()
+			req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}
+			if _, err := c.Write(req.Marshal()); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			resp, ok := readPacket(t, c, 2*time.Second)
+			if !ok {
+				t.Fatalf("no response")
+			}
+			if resp.LI != tc.li || resp.Stratum != tc.stratum {
+				t.Fatalf("li=%d stratum=%d, want li=%d stratum=%d", resp.LI, resp.Stratum, tc.li, tc.stratum)
+			}
+			if tc.li == leapAlarm {
+				if resp.RefID != refIDFromASCII4("STEP") {
+					t.Fatalf("refid: got=%08x want STEP", resp.RefID)
+				}
+			} else if d := shortToDuration(resp.RootDispersion); d < tc.skew*9/10 {
+				t.Fatalf("root dispersion should cover the offset: got=%v want~%v", d, tc.skew)
+			}
+		})
+	}
+}
+
+func TestUpstreamSet_DuplicateAddresses(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	u := newUpstreamSet(Config{Upstreams: []string{"ntp.example:123", "ntp.example:123", "ntp.example:123", "ntp.example:123"}})
+	for i := range u.peers {
+		p := &u.peers[i]
+		p.Reach, p.LastSample, p.Stratum = 1, now, 2
+		p.Offset = time.Duration(i) * time.Millisecond
+		p.Delay, p.Dispersion = 10*time.Millisecond, time.Millisecond
+	}
+	// The first entry is far off, so it is the falseticker.
+	u.peers[0].Offset = time.Second
+	u.updateSystemLocked()
+
+	selected := 0
+	for i, p := range u.peers {
+		if p.Falseticker != (i == 0) {
+			t.Fatalf("peer %d: falseticker=%v", i, p.Falseticker)
+		}
+		if p.Survivor == (i == 0) {
+			t.Fatalf("peer %d: survivor=%v", i, p.Survivor)
+		}
+		if p.Selected {
+			selected++
+		}
+	}
+	if selected != 1 || u.peers[0].Selected {
+		t.Fatalf("selected: got=%d, first=%v", selected, u.peers[0].Selected)
+	}
+}
+
+func TestUpstreamSet_SkipsStratum15(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	u := newUpstreamSet(Config{Upstreams: []string{"a.example:123", "b.example:123"}})
+	for i := range u.peers {
+		p := &u.peers[i]
+		p.Reach, p.LastSample, p.Stratum = 1, now, stratumUnsync-1
+		p.Delay, p.Dispersion = 10*time.Millisecond, time.Millisecond
+	}
+	u.updateSystemLocked()
+	if u.sys.synced || u.peers[0].Selected || u.peers[1].Selected {
+		t.Fatalf("stratum 15 sources used: sys=%+v", u.sys)
+	}
+
+	// A usable source is selected and the other stays out.
+	u.peers[1].Stratum = 3
+	u.updateSystemLocked()
+	if !u.sys.synced || u.sys.stratum != 4 || !u.peers[1].Selected || u.peers[0].Survivor {
+		t.Fatalf("sys=%+v peers=%+v", u.sys, u.peers)
+	}
+}
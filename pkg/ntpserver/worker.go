@@ -0,0 +1,49 @@
+package ntpserver
+
+import "sync/atomic"
+
+// worker is one goroutine answering requests from a listener. With
+// Config.ReusePort every worker has its own socket; otherwise the workers of
+// a listener share it.
+type worker struct {
+	id      int
+	l       *listener
+	clients *clientShard // nil for the metrics' shared shard
+
+	requests  atomic.Uint64
+	responses atomic.Uint64
+	errors    atomic.Uint64
+}
+
+// count records the outcome of one request handled by w.
+func (w *worker) count(ev RequestEvent) {
+	w.requests.Add(1)
+	if ev.countsAsResponse() {
+		w.responses.Add(1)
+	}
+	if ev.Error != "" {
+		w.errors.Add(1)
+	}
+}
+
+func (w *worker) snapshot() WorkerMetrics {
+	return WorkerMetrics{
+		ID:        w.id,
+		LocalAddr: w.l.local,
+		Interface: w.l.iface,
+		Requests:  w.requests.Load(),
+		Responses: w.responses.Load(),
+		Errors:    w.errors.Load(),
+	}
+}
+
+// newWorkers starts perListener workers on each listener, numbered from 0.
+func newWorkers(ls []*listener, perListener int) []*worker {
+	ws := make([]*worker, 0, len(ls)*perListener)
+	for _, l := range ls {
+		for i := 0; i < perListener; i++ {
+			ws = append(ws, &worker{id: len(ws), l: l})
+		}
+	}
+	return ws
+}
@@ -0,0 +1,128 @@
+package ntpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func runWorkerClients(t *testing.T, srv *Server, clients int) {
+	t.Helper()
+	for i := 0; i < clients; i++ {
+		c := dialServer(t, srv)
+		req := Packet{VN: 4, Mode: ModeClient, Transmit: timeToTimestamp(time.Now())}
+		if _, err := c.Write(req.Marshal()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, ok := readPacket(t, c, time.Second); !ok {
+			t.Fatalf("client %d: no response", i)
+		}
+		_ = c.Close()
+	}
+}
+
+func checkWorkerMetrics(t *testing.T, srv *Server, workers, requests int) {
+	t.Helper()
+	m := srv.Metrics()
+	if len(m.Workers) != workers {
+		t.Fatalf("workers: got=%d want=%d", len(m.Workers), workers)
+	}
+	var total uint64
+	for i, w := range m.Workers {
+		if w.ID != i || w.LocalAddr != srv.Addr() {
+			t.Fatalf("worker %d: %+v", i, w)
+		}
+		total += w.Responses
+	}
+	if total != uint64(requests) || m.TotalResponses != uint64(requests) {
+		t.Fatalf("responses: workers=%d total=%d want=%d", total, m.TotalResponses, requests)
+	}
+}
+
+func TestServer_WorkersShareSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", Workers: 4})
+	if err := srv.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	runWorkerClients(t, srv, 20)
+	checkWorkerMetrics(t, srv, 4, 20)
+
+	stopped := make(chan struct{})
+	go func() {
+		_ = srv.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Stop hung with several workers")
+	}
+}
+
+func TestServer_WorkersReusePort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := New(Config{ListenAddr: "127.0.0.1:0", Network: "udp4", Workers: 4, ReusePort: true})
+	err := srv.Start(ctx)
+	if errors.Is(err, ErrReusePortUnsupported) {
+		t.Skip("SO_REUSEPORT unsupported")
+	}
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() { _ = srv.Stop() }()
+
+	if addrs := srv.Addrs(); len(addrs) != 1 {
+		t.Fatalf("addrs: got=%v want one address", addrs)
+	}
+	runWorkerClients(t, srv, 40)
+	checkWorkerMetrics(t, srv, 4, 40)
+
+	_ = srv.Stop()
+	c, err := net.Dial("udp4", srv.Metrics().Workers[0].LocalAddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	_, _ = c.Write(Packet{VN: 4, Mode: ModeClient}.Marshal())
+	_ = c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 64)); err == nil {
+		t.Fatalf("no worker socket may answer after Stop")
+	}
+}
+
+func TestServer_ServeWithWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := New(Config{Workers: 3})
+	conn := newMemPacketConn()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, conn) }()
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	for i := 0; i < 6; i++ {
+		conn.deliver(Packet{VN: 4, Mode: ModeClient}.Marshal(), from)
+		select {
+		case <-conn.sent:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no response %d", i)
+		}
+	}
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Serve did not return")
+	}
+	if m := srv.Metrics(); len(m.Workers) != 3 {
+		t.Fatalf("workers: got=%d want=3", len(m.Workers))
+	}
+}